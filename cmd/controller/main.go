@@ -16,9 +16,12 @@ limitations under the License.
 package main
 
 import (
+	"net/http"
+
 	"github.com/samber/lo"
 
 	"github.com/azure/gpu-provisioner/pkg/cloudprovider"
+	"github.com/azure/gpu-provisioner/pkg/controllers"
 	"github.com/azure/gpu-provisioner/pkg/operator"
 
 	"github.com/aws/karpenter-core/pkg/cloudprovider/metrics"
@@ -28,14 +31,25 @@ import (
 )
 
 func main() {
-	ctx, op := operator.NewOperator(coreoperator.NewOperator())
+	// the cloud config flag is not known to karpenter-core, it has to be removed before core parses the flags
+	cloudConfigPath := operator.ExtractCloudConfigFlag()
+	coreCtx, coreOp := coreoperator.NewOperator()
+	ctx, op := operator.NewOperator(coreCtx, coreOp, cloudConfigPath)
 	azureCloudProvider := cloudprovider.New(
 		op.InstanceTypesProvider,
 		op.InstanceProvider,
 		op.GetClient(),
 	)
 
+	// the controller starts even if the Azure clients cannot be built yet, the readiness check reports why until they
+	// are. The liveness check does not depend on Azure, so an AAD outage does not restart the controller.
 	lo.Must0(op.AddHealthzCheck("cloud-provider", azureCloudProvider.LivenessProbe))
+	lo.Must0(op.AddReadyzCheck("cloud-provider", func(req *http.Request) error {
+		if err := op.ReadinessProbe(req); err != nil {
+			return err
+		}
+		return azureCloudProvider.LivenessProbe(req)
+	}))
 	cloudProvider := metrics.Decorate(azureCloudProvider)
 
 	op.
@@ -48,5 +62,12 @@ func main() {
 			op.EventRecorder,
 			cloudProvider,
 		)...).
+		WithControllers(ctx, controllers.NewControllers(
+			ctx,
+			op.Clock,
+			op.GetClient(),
+			op.EventRecorder,
+			op.InstanceProvider,
+		)...).
 		Start(ctx)
 }
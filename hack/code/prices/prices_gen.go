@@ -27,6 +27,8 @@ import (
 	"sort"
 	"time"
 
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/azure/gpu-provisioner/pkg/apis/settings"
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
 	"github.com/samber/lo"
 )
@@ -82,6 +84,11 @@ var regions = []string{
 	"westus3",
 }
 
+// sources are the price sources that get static prices, the other price sources fall back to the default one
+var sources = []pricing.PriceSource{
+	pricing.DefaultPriceSource,
+}
+
 func main() {
 	flag.Parse()
 	if flag.NArg() != 1 {
@@ -109,18 +116,48 @@ func generatePricing(filePath string) {
 	now := time.Now().UTC().Format(time.RFC3339)
 	fmt.Fprintf(src, "// generated at %s\n\n\n", now)
 	fmt.Fprintf(src, "var initialPriceUpdate, _ = time.Parse(time.RFC3339, \"%s\")\n", now)
-	fmt.Fprintln(src, "var initialOnDemandPrices = map[string]map[string]float64{}")
+	fmt.Fprintln(src, "var initialOnDemandPrices = map[PriceSource]map[string]map[string]float64{}")
+	fmt.Fprintln(src, "var initialSpotPrices = map[PriceSource]map[string]map[string]float64{}")
+	for _, source := range sources {
+		writeSource(ctx, src, source, updateStarted)
+	}
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		if err := os.WriteFile(filePath, src.Bytes(), 0644); err != nil {
+			log.Fatalf("writing output, %s", err)
+		}
+		log.Fatalf("formatting generated source, %s", err)
+	}
+
+	if err := os.WriteFile(filePath, formatted, 0644); err != nil {
+		log.Fatalf("writing output, %s", err)
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		log.Fatal("could not write memory profile: ", err)
+	}
+	log.Printf("successfully generated pricing file: \"%s\"\n", filePath)
+}
+
+// writeSource writes an init function recording the prices of every region for the price source
+func writeSource(ctx context.Context, src *bytes.Buffer, source pricing.PriceSource, updateStarted time.Time) {
+	ctx = settings.ToContext(ctx, &settings.Settings{PriceCurrency: source.Currency, PriceType: source.PriceType})
 	fmt.Fprintln(src, "func init() {")
+	fmt.Fprintf(src, "// %s %s\n", source.Currency, source.PriceType)
+	fmt.Fprintln(src, "onDemandPrices := map[string]map[string]float64{}")
+	fmt.Fprintln(src, "spotPrices := map[string]map[string]float64{}")
+	fmt.Fprintf(src, "initialOnDemandPrices[PriceSource{Currency: %q, PriceType: %q}] = onDemandPrices\n", source.Currency, source.PriceType)
+	fmt.Fprintf(src, "initialSpotPrices[PriceSource{Currency: %q, PriceType: %q}] = spotPrices\n", source.Currency, source.PriceType)
 	// record prices for each region
 	var pricingProviderByRegion = map[string]chan *pricing.Provider{}
 	for _, region := range regions {
 		resultsChan := make(chan *pricing.Provider)
 		log.Println("fetching pricing data in region", region)
 		go func(region string, resultsChan chan *pricing.Provider) {
-			pricingProvider := pricing.NewProvider(ctx, pricing.NewAPI(), region, make(chan struct{}))
+			pricingProvider := pricing.NewProvider(ctx, pricing.NewAPI(&azure.PublicCloud), region, make(chan struct{}))
 			attempts := 0
 			for {
-				if pricingProvider.OnDemandLastUpdated().After(updateStarted) {
+				if pricingProvider.OnDemandLastUpdated().After(updateStarted) && pricingProvider.SpotLastUpdated().After(updateStarted) {
 					break
 				}
 
@@ -139,6 +176,7 @@ func generatePricing(filePath string) {
 		}(region, resultsChan)
 		pricingProviderByRegion[region] = resultsChan
 	}
+	spotCount := 0
 	for _, region := range regions {
 		pricingProviderChan := pricingProviderByRegion[region]
 		var pricingProvider *pricing.Provider = <-pricingProviderChan
@@ -146,36 +184,31 @@ func generatePricing(filePath string) {
 		instanceTypes := pricingProvider.InstanceTypes()
 		sort.Strings(instanceTypes)
 
-		writePricing(src, instanceTypes, region, pricingProvider.OnDemandPrice)
+		writePricing(src, "onDemandPrices", instanceTypes, region, pricingProvider.OnDemandPrice)
+		spotCount += writePricing(src, "spotPrices", instanceTypes, region, func(instanceType string) (float64, bool) {
+			// spot prices are regional, all zones share the same price
+			return pricingProvider.SpotPrice(instanceType, "")
+		})
 	}
-	fmt.Fprintln(src, "}")
-	formatted, err := format.Source(src.Bytes())
-	if err != nil {
-		if err := os.WriteFile(filePath, src.Bytes(), 0644); err != nil {
-			log.Fatalf("writing output, %s", err)
-		}
-		log.Fatalf("formatting generated source, %s", err)
+	// the static prices are the fallback of spot offerings too, never write them without any spot price
+	if spotCount == 0 {
+		log.Fatalf("no spot prices were fetched for %s %s", source.Currency, source.PriceType)
 	}
-
-	if err := os.WriteFile(filePath, formatted, 0644); err != nil {
-		log.Fatalf("writing output, %s", err)
-	}
-	runtime.GC()
-	if err := pprof.WriteHeapProfile(f); err != nil {
-		log.Fatal("could not write memory profile: ", err)
-	}
-	log.Printf("successfully generated pricing file: \"%s\"\n", filePath)
+	fmt.Fprintln(src, "}")
 }
 
-func writePricing(src *bytes.Buffer, instanceNames []string, region string, getPrice func(instanceType string) (float64, bool)) {
+// writePricing writes the prices of the region and returns the number of instance types with a price
+func writePricing(src *bytes.Buffer, mapName string, instanceNames []string, region string, getPrice func(instanceType string) (float64, bool)) int {
 	fmt.Fprintf(src, "// %s\n", region)
-	fmt.Fprintf(src, "initialOnDemandPrices[%q] = map[string]float64{\n", region)
+	fmt.Fprintf(src, "%s[%q] = map[string]float64{\n", mapName, region)
 	sort.Strings(instanceNames)
+	count := 0
 	for _, instanceName := range instanceNames {
 		price, ok := getPrice(instanceName)
 		if !ok {
 			continue
 		}
+		count++
 
 		// TODO: look at grouping by families to make the generated output nicer:
 		// https://github.com/Azure/karpenter/pull/94#discussion_r1120901524
@@ -185,4 +218,5 @@ func writePricing(src *bytes.Buffer, instanceNames []string, region string, getP
 		}
 	}
 	fmt.Fprintln(src, "\n}")
+	return count
 }
@@ -31,12 +31,28 @@ type settingsKeyType struct{}
 var ContextKey = settingsKeyType{}
 
 var defaultSettings = Settings{
-	ClusterName: "",
+	ClusterName:    "",
+	PriceCurrency:  "USD",
+	PriceType:      "Consumption",
+	PriceConfigMap: "gpu-provisioner-pricing",
+	PriceFile:      "",
 }
 
 // +k8s:deepcopy-gen=true
 type Settings struct {
 	ClusterName string `validate:"required"`
+	// PriceCurrency is the ISO 4217 currency code of the retail prices used to rank instance types
+	PriceCurrency string `validate:"required,len=3,uppercase"`
+	// PriceType selects the on-demand price used to rank instance types: Consumption (pay as you go), Reservation
+	// (1 year reserved instance) or SavingsPlan (1 year savings plan). Instance types without a reservation or savings
+	// plan price are ranked by their consumption price.
+	PriceType string `validate:"required,oneof=Consumption Reservation SavingsPlan"`
+	// PriceConfigMap is the ConfigMap in the system namespace the leader persists the last fetched prices to, so they
+	// survive restarts. An empty name disables persisting the prices.
+	PriceConfigMap string
+	// PriceFile is the path of a price table provided by the operator, used by clusters that cannot reach the retail
+	// prices API. It uses the same format as the ConfigMap.
+	PriceFile string
 }
 
 func (*Settings) ConfigMap() string {
@@ -49,6 +65,10 @@ func (*Settings) Inject(ctx context.Context, cm *v1.ConfigMap) (context.Context,
 
 	if err := configmap.Parse(cm.Data,
 		configmap.AsString("azure.clusterName", &s.ClusterName),
+		configmap.AsString("azure.pricing.currency", &s.PriceCurrency),
+		configmap.AsString("azure.pricing.priceType", &s.PriceType),
+		configmap.AsString("azure.pricing.configMap", &s.PriceConfigMap),
+		configmap.AsString("azure.pricing.file", &s.PriceFile),
 	); err != nil {
 		return ctx, fmt.Errorf("parsing settings, %w", err)
 	}
@@ -46,7 +46,62 @@ var _ = Describe("Validation", func() {
 		Expect(err).ToNot(HaveOccurred())
 		s := settings.FromContext(ctx)
 		Expect(s.ClusterName).To(Equal("my-cluster"))
+		Expect(s.PriceCurrency).To(Equal("USD"))
+		Expect(s.PriceType).To(Equal("Consumption"))
+		Expect(s.PriceConfigMap).To(Equal("gpu-provisioner-pricing"))
+		Expect(s.PriceFile).To(BeEmpty())
+	})
 
+	It("should succeed to set the price stores", func() {
+		cm := &v1.ConfigMap{
+			Data: map[string]string{
+				"azure.clusterName":       "my-cluster",
+				"azure.pricing.configMap": "",
+				"azure.pricing.file":      "/etc/gpu-provisioner/prices.json",
+			},
+		}
+		ctx, err := (&settings.Settings{}).Inject(ctx, cm)
+		Expect(err).ToNot(HaveOccurred())
+		s := settings.FromContext(ctx)
+		Expect(s.PriceConfigMap).To(BeEmpty())
+		Expect(s.PriceFile).To(Equal("/etc/gpu-provisioner/prices.json"))
+	})
+
+	It("should succeed to set the price source", func() {
+		cm := &v1.ConfigMap{
+			Data: map[string]string{
+				"azure.clusterName":       "my-cluster",
+				"azure.pricing.currency":  "EUR",
+				"azure.pricing.priceType": "Reservation",
+			},
+		}
+		ctx, err := (&settings.Settings{}).Inject(ctx, cm)
+		Expect(err).ToNot(HaveOccurred())
+		s := settings.FromContext(ctx)
+		Expect(s.PriceCurrency).To(Equal("EUR"))
+		Expect(s.PriceType).To(Equal("Reservation"))
+	})
+
+	It("should fail validation with an unknown price type", func() {
+		cm := &v1.ConfigMap{
+			Data: map[string]string{
+				"azure.clusterName":       "my-cluster",
+				"azure.pricing.priceType": "Spot",
+			},
+		}
+		_, err := (&settings.Settings{}).Inject(ctx, cm)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail validation with an invalid currency", func() {
+		cm := &v1.ConfigMap{
+			Data: map[string]string{
+				"azure.clusterName":      "my-cluster",
+				"azure.pricing.currency": "euro",
+			},
+		}
+		_, err := (&settings.Settings{}).Inject(ctx, cm)
+		Expect(err).To(HaveOccurred())
 	})
 
 	It("should fail validation with panic when clusterName not included", func() {
@@ -16,12 +16,10 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	//nolint SA1019 - deprecated package
-	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-12-01/compute"
-	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
 )
 
 const ()
@@ -29,9 +27,6 @@ const ()
 var (
 	LabelDomain = "karpenter.k8s.azure"
 
-	// may not be able to use Regular instead of On-demand
-	PrioritySpot             = string(compute.Spot)
-	PriorityRegular          = string(compute.Regular)
 	AzureToKubeArchitectures = map[string]string{
 		// TODO: consider using constants like compute.ArchitectureArm64
 		"x64":   v1alpha5.ArchitectureAmd64,
@@ -44,6 +39,28 @@ var (
 	// alternative zone label for Machine (the standard one is protected for AKS nodes)
 	AlternativeLabelTopologyZone = LabelDomain + "/zone"
 
+	// AgentPoolNameAnnotationKey records the name of the agent pool backing a Machine
+	AgentPoolNameAnnotationKey = LabelDomain + "/agentpool-name"
+	// AgentPoolCreateResumeTokenAnnotationKey records the resume token of the agent pool creation while it is in
+	// progress, so polling the creation survives a controller restart
+	AgentPoolCreateResumeTokenAnnotationKey = LabelDomain + "/agentpool-create-resume-token"
+	// AgentPoolNodeCountAnnotationKey requests the number of identical nodes of the agent pool backing a Machine,
+	// one if it is not set. The Machine keeps the provider id of the first node it was launched with.
+	AgentPoolNodeCountAnnotationKey = LabelDomain + "/agentpool-node-count"
+	// AgentPoolNodeProviderIDsAnnotationKey records the comma separated provider ids of all the nodes of a multi-node
+	// agent pool on its Machine, ordered by their scale set instance id
+	AgentPoolNodeProviderIDsAnnotationKey = LabelDomain + "/agentpool-node-provider-ids"
+	// AgentPoolOSSKUAnnotationKey selects the OS SKU of the nodes of the agent pool backing a Machine, Ubuntu,
+	// AzureLinux or CBLMariner. AKS picks the default of the cluster if it is not set.
+	AgentPoolOSSKUAnnotationKey = LabelDomain + "/agentpool-os-sku"
+	// AgentPoolKubernetesVersionAnnotationKey selects the Kubernetes version of the agent pool backing a Machine, the
+	// version of the control plane if it is not set. The version the agent pool was provisioned with is recorded here,
+	// the Machine drifts once the agent pool runs another version.
+	AgentPoolKubernetesVersionAnnotationKey = LabelDomain + "/agentpool-kubernetes-version"
+	// AgentPoolNodeImageVersionAnnotationKey records the node image version the agent pool backing a Machine was
+	// provisioned with, the Machine drifts once the agent pool runs another node image
+	AgentPoolNodeImageVersionAnnotationKey = LabelDomain + "/agentpool-node-image-version"
+
 	ManufacturerNvidia = "nvidia"
 
 	// TODO: this set needs to be designed properly and carefully; essentially represents the API
@@ -116,6 +133,8 @@ var (
 func init() {
 	v1alpha5.RestrictedLabelDomains = v1alpha5.RestrictedLabelDomains.Insert(RestrictedLabelDomains...)
 	v1alpha5.WellKnownLabels = v1alpha5.WellKnownLabels.Insert(
+		AlternativeLabelTopologyZone,
+
 		LabelSKUTier,
 		LabelSKUName,
 		LabelSKUSize,
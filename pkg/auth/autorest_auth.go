@@ -17,80 +17,83 @@ package auth
 
 import (
 	"context"
-	"fmt"
-	"os"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 	"github.com/pkg/errors"
 	"k8s.io/klog/v2"
 )
 
-// authResult contains the subset of results from token acquisition operation in ConfidentialClientApplication
-// For details see https://aka.ms/msal-net-authenticationresult
-type authResult struct {
-	accessToken    string
-	expiresOn      time.Time
-	grantedScopes  []string
-	declinedScopes []string
-}
+// tokenRefreshBuffer is how long before it expires the authorizer replaces its token
+const tokenRefreshBuffer = 5 * time.Minute
 
+// NewAuthorizer returns the track 1 authorizer, it gets its token from the same credential mode as the track 2 clients
+// and refreshes it before it expires. A token is acquired up front so a misconfigured credential fails at startup.
 func NewAuthorizer(config *Config, env *azure.Environment) (autorest.Authorizer, error) {
-
-	// Azure AD Workload Identity webhook will inject the following env vars:
-	// 	AZURE_FEDERATED_TOKEN_FILE is the service account token path
-	// 	AZURE_AUTHORITY_HOST is the AAD authority hostname
-
-	tokenFilePath := os.Getenv("AZURE_FEDERATED_TOKEN_FILE")
-	authority := os.Getenv("AZURE_AUTHORITY_HOST")
-
-	if tokenFilePath == "" || authority == "" {
-		return nil, fmt.Errorf("required environment variables not set, AZURE_FEDERATED_TOKEN_FILE: %s, AZURE_AUTHORITY_HOST: %s", tokenFilePath, authority)
-	}
-
-	cred := confidential.NewCredFromAssertionCallback(func(context.Context, confidential.AssertionRequestOptions) (string, error) {
-		return readJWTFromFS(tokenFilePath)
-	})
-	// create the confidential client to request an AAD token
-	confidentialClientApp, err := confidential.New(
-		fmt.Sprintf("%s%s/oauth2/token", authority, config.TenantID),
-		config.UserAssignedIdentityID,
-		cred)
+	cred, err := newTokenCredential(config, env)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create confidential client app: %w", err)
+		return nil, err
 	}
 
-	result, err := confidentialClientApp.AcquireTokenByCredential(context.Background(), []string{strings.TrimSuffix(env.ResourceManagerEndpoint, "/") + "/.default"})
-	if err != nil {
+	authorizer := newTokenAuthorizer(cred, strings.TrimSuffix(TokenAudience(env), "/")+"/.default")
+	if _, err := authorizer.token(context.Background()); err != nil {
 		klog.ErrorS(err, "failed to acquire token")
-		return autorest.NewBearerAuthorizer(authResult{}), errors.Wrap(err, "failed to acquire token")
+		return authorizer, errors.Wrap(err, "failed to acquire token")
 	}
+	return authorizer, nil
+}
+
+// tokenAuthorizer authorizes track 1 requests with a bearer token from a token credential. The token is cached and
+// refreshed shortly before it expires, so long lived clients keep working after the first token expired.
+type tokenAuthorizer struct {
+	cred   azcore.TokenCredential
+	scopes []string
 
-	return autorest.NewBearerAuthorizer(authResult{
-		accessToken:    result.AccessToken,
-		expiresOn:      result.ExpiresOn,
-		grantedScopes:  result.GrantedScopes,
-		declinedScopes: result.DeclinedScopes,
-	}), nil
+	mu          sync.Mutex
+	accessToken azcore.AccessToken
 }
 
-// OAuthToken implements the OAuthTokenProvider interface.  It returns the current access token.
-func (ar authResult) OAuthToken() string {
-	return ar.accessToken
+func newTokenAuthorizer(cred azcore.TokenCredential, scopes ...string) *tokenAuthorizer {
+	return &tokenAuthorizer{
+		cred:   cred,
+		scopes: scopes,
+	}
 }
 
-func (a *authResult) WithAuthorization() autorest.PrepareDecorator {
-	return autorest.WithBearerAuthorization(a.accessToken)
+// WithAuthorization implements the autorest.Authorizer interface
+func (a *tokenAuthorizer) WithAuthorization() autorest.PrepareDecorator {
+	return func(p autorest.Preparer) autorest.Preparer {
+		return autorest.PreparerFunc(func(r *http.Request) (*http.Request, error) {
+			r, err := p.Prepare(r)
+			if err != nil {
+				return r, err
+			}
+			token, err := a.token(r.Context())
+			if err != nil {
+				return r, autorest.NewErrorWithError(err, "auth.tokenAuthorizer", "WithAuthorization", nil, "failed to refresh token")
+			}
+			return autorest.Prepare(r, autorest.WithBearerAuthorization(token))
+		})
+	}
 }
 
-// readJWTFromFS reads the jwt from file system
-func readJWTFromFS(tokenFilePath string) (string, error) {
-	token, err := os.ReadFile(tokenFilePath)
+// token returns the cached token, or acquires a new one if it is about to expire
+func (a *tokenAuthorizer) token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.accessToken.Token != "" && time.Until(a.accessToken.ExpiresOn) > tokenRefreshBuffer {
+		return a.accessToken.Token, nil
+	}
+	accessToken, err := a.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: a.scopes})
 	if err != nil {
 		return "", err
 	}
-	return string(token), nil
+	a.accessToken = accessToken
+	return accessToken.Token, nil
 }
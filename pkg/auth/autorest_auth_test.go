@@ -0,0 +1,109 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCredential hands out numbered tokens that expire after the configured lifetime
+type fakeCredential struct {
+	lifetime time.Duration
+	err      error
+	calls    int
+	scopes   []string
+}
+
+func (f *fakeCredential) GetToken(_ context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	f.scopes = opts.Scopes
+	if f.err != nil {
+		return azcore.AccessToken{}, f.err
+	}
+	f.calls++
+	return azcore.AccessToken{
+		Token:     fmt.Sprintf("token-%d", f.calls),
+		ExpiresOn: time.Now().Add(f.lifetime),
+	}, nil
+}
+
+func authorize(t *testing.T, authorizer autorest.Authorizer) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, "https://management.azure.com/subscriptions", nil)
+	assert.NoError(t, err)
+	req, err = autorest.Prepare(req, authorizer.WithAuthorization())
+	if err != nil {
+		return "", err
+	}
+	return req.Header.Get("Authorization"), nil
+}
+
+func TestTokenAuthorizer(t *testing.T) {
+	tests := []struct {
+		name           string
+		lifetime       time.Duration
+		expectedTokens []string
+		expectedCalls  int
+	}{
+		{
+			name:           "reuses a token that is still valid",
+			lifetime:       time.Hour,
+			expectedTokens: []string{"Bearer token-1", "Bearer token-1", "Bearer token-1"},
+			expectedCalls:  1,
+		},
+		{
+			name:           "refreshes a token that is about to expire",
+			lifetime:       time.Minute,
+			expectedTokens: []string{"Bearer token-1", "Bearer token-2", "Bearer token-3"},
+			expectedCalls:  3,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cred := &fakeCredential{lifetime: tc.lifetime}
+			authorizer := newTokenAuthorizer(cred, "https://management.azure.com/.default")
+			for _, expected := range tc.expectedTokens {
+				header, err := authorize(t, authorizer)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, header)
+			}
+			assert.Equal(t, tc.expectedCalls, cred.calls)
+			assert.Equal(t, []string{"https://management.azure.com/.default"}, cred.scopes)
+		})
+	}
+}
+
+func TestTokenAuthorizerError(t *testing.T) {
+	cred := &fakeCredential{lifetime: time.Hour, err: errors.New("aad is down")}
+	authorizer := newTokenAuthorizer(cred, "https://management.azure.com/.default")
+	_, err := authorize(t, authorizer)
+	assert.ErrorContains(t, err, "aad is down")
+
+	// the next request gets a token once the credential recovers
+	cred.err = nil
+	header, err := authorize(t, authorizer)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer token-1", header)
+}
@@ -0,0 +1,83 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// Cloud names accepted in ARM_CLOUD, the autorest names (e.g. AzureUSGovernmentCloud) are accepted as well
+const (
+	AzurePublicCloud       = "AzurePublic"
+	AzureChinaCloud        = "AzureChina"
+	AzureUSGovernmentCloud = "AzureUSGovernment"
+	// AzureStackCloud reads the environment from the file set in AZURE_ENVIRONMENT_FILEPATH
+	AzureStackCloud = "AzureStackCloud"
+)
+
+// Environment returns the Azure environment of the configured cloud, defaulting to the public cloud. A custom
+// environment, like the one of Azure Stack, is read from the cloud environment file.
+func (cfg *Config) Environment() (*azure.Environment, error) {
+	if strings.EqualFold(cfg.Cloud, AzureStackCloud) || (cfg.Cloud == "" && cfg.CloudEnvironmentFile != "") {
+		if cfg.CloudEnvironmentFile == "" {
+			return nil, fmt.Errorf("cloud %s requires %s to be set", cfg.Cloud, azure.EnvironmentFilepathName)
+		}
+		env, err := azure.EnvironmentFromFile(cfg.CloudEnvironmentFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading cloud environment file %s, %w", cfg.CloudEnvironmentFile, err)
+		}
+		return &env, nil
+	}
+	if cfg.Cloud == "" {
+		return &azure.PublicCloud, nil
+	}
+
+	name := cfg.Cloud
+	if !strings.HasSuffix(strings.ToLower(name), "cloud") {
+		name += "Cloud"
+	}
+	env, err := azure.EnvironmentFromName(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown cloud %s", cfg.Cloud)
+	}
+	return &env, nil
+}
+
+// CloudConfiguration converts the environment to the cloud configuration used by the track 2 ARM clients
+func CloudConfiguration(env *azure.Environment) cloud.Configuration {
+	return cloud.Configuration{
+		ActiveDirectoryAuthorityHost: env.ActiveDirectoryEndpoint,
+		Services: map[cloud.ServiceName]cloud.ServiceConfiguration{
+			cloud.ResourceManager: {
+				Audience: TokenAudience(env),
+				Endpoint: env.ResourceManagerEndpoint,
+			},
+		},
+	}
+}
+
+// TokenAudience returns the audience of the ARM tokens, custom environment files may leave it out in which case the
+// resource manager endpoint is used
+func TokenAudience(env *azure.Environment) string {
+	if env.TokenAudience != "" {
+		return env.TokenAudience
+	}
+	return env.ResourceManagerEndpoint
+}
@@ -0,0 +1,124 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnvironment(t *testing.T) {
+	stackFile := filepath.Join(t.TempDir(), "azurestackcloud.json")
+	assert.NoError(t, os.WriteFile(stackFile, []byte(`{
+		"name": "AzureStackCloud",
+		"resourceManagerEndpoint": "https://management.local.azurestack.external/",
+		"activeDirectoryEndpoint": "https://login.microsoftonline.com/"
+	}`), 0600))
+
+	tests := []struct {
+		name                string
+		cloud               string
+		envFile             string
+		expectedEnvironment string
+		expectedEndpoint    string
+		expectedErr         bool
+	}{
+		{
+			name:                "defaults to the public cloud",
+			expectedEnvironment: azure.PublicCloud.Name,
+			expectedEndpoint:    azure.PublicCloud.ResourceManagerEndpoint,
+		},
+		{
+			name:                "public cloud",
+			cloud:               AzurePublicCloud,
+			expectedEnvironment: azure.PublicCloud.Name,
+			expectedEndpoint:    azure.PublicCloud.ResourceManagerEndpoint,
+		},
+		{
+			name:                "china cloud",
+			cloud:               AzureChinaCloud,
+			expectedEnvironment: azure.ChinaCloud.Name,
+			expectedEndpoint:    azure.ChinaCloud.ResourceManagerEndpoint,
+		},
+		{
+			name:                "us government cloud by its autorest name",
+			cloud:               "AzureUSGovernmentCloud",
+			expectedEnvironment: azure.USGovernmentCloud.Name,
+			expectedEndpoint:    azure.USGovernmentCloud.ResourceManagerEndpoint,
+		},
+		{
+			name:                "azure stack reads the environment file",
+			cloud:               AzureStackCloud,
+			envFile:             stackFile,
+			expectedEnvironment: "AzureStackCloud",
+			expectedEndpoint:    "https://management.local.azurestack.external/",
+		},
+		{
+			name:                "environment file without a cloud name",
+			envFile:             stackFile,
+			expectedEnvironment: "AzureStackCloud",
+			expectedEndpoint:    "https://management.local.azurestack.external/",
+		},
+		{
+			name:        "azure stack without an environment file",
+			cloud:       AzureStackCloud,
+			expectedErr: true,
+		},
+		{
+			name:        "missing environment file",
+			cloud:       AzureStackCloud,
+			envFile:     filepath.Join(t.TempDir(), "missing.json"),
+			expectedErr: true,
+		},
+		{
+			name:        "unknown cloud",
+			cloud:       "AzureMoon",
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{Cloud: tc.cloud, CloudEnvironmentFile: tc.envFile}
+			env, err := cfg.Environment()
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedEnvironment, env.Name)
+			assert.Equal(t, tc.expectedEndpoint, env.ResourceManagerEndpoint)
+		})
+	}
+}
+
+func TestCloudConfiguration(t *testing.T) {
+	config := CloudConfiguration(&azure.USGovernmentCloud)
+	assert.Equal(t, azure.USGovernmentCloud.ActiveDirectoryEndpoint, config.ActiveDirectoryAuthorityHost)
+	assert.Equal(t, cloud.ServiceConfiguration{
+		Audience: azure.USGovernmentCloud.TokenAudience,
+		Endpoint: azure.USGovernmentCloud.ResourceManagerEndpoint,
+	}, config.Services[cloud.ResourceManager])
+
+	// custom environments without a token audience use the resource manager endpoint
+	config = CloudConfiguration(&azure.Environment{ResourceManagerEndpoint: "https://management.local.azurestack.external/"})
+	assert.Equal(t, "https://management.local.azurestack.external/", config.Services[cloud.ResourceManager].Audience)
+}
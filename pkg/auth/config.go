@@ -18,12 +18,16 @@ package auth
 import (
 	"fmt"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
 )
 
 const (
@@ -43,6 +47,11 @@ type ClientConfig struct {
 
 // Config holds the configuration parsed from the --cloud-config flag
 type Config struct {
+	// Cloud is the name of the Azure cloud, see Environment
+	Cloud string `json:"cloud,omitempty" yaml:"cloud,omitempty"`
+	// CloudEnvironmentFile is the path of a custom environment, e.g. for Azure Stack
+	CloudEnvironmentFile string `json:"cloudEnvironmentFile,omitempty" yaml:"cloudEnvironmentFile,omitempty"`
+
 	Location       string `json:"location" yaml:"location"`
 	TenantID       string `json:"tenantId" yaml:"tenantId"`
 	SubscriptionID string `json:"subscriptionId" yaml:"subscriptionId"`
@@ -50,6 +59,15 @@ type Config struct {
 
 	UserAssignedIdentityID string `json:"userAssignedIdentityID" yaml:"userAssignedIdentityID"`
 
+	// CredentialMode selects how tokens are acquired, see the CredentialMode constants
+	CredentialMode string `json:"credentialMode,omitempty" yaml:"credentialMode,omitempty"`
+	// ClientSecret is the secret of the service principal in UserAssignedIdentityID for the ServicePrincipal mode
+	ClientSecret string `json:"clientSecret,omitempty" yaml:"clientSecret,omitempty"`
+	// ClientCertificatePath is the certificate of the service principal for the ClientCertificate mode
+	ClientCertificatePath string `json:"clientCertificatePath,omitempty" yaml:"clientCertificatePath,omitempty"`
+	// ClientCertificatePassword decrypts the certificate, if it is encrypted
+	ClientCertificatePassword string `json:"clientCertificatePassword,omitempty" yaml:"clientCertificatePassword,omitempty"`
+
 	//Configs only for AKS
 	ClusterName string `json:"clusterName" yaml:"clusterName"`
 	//Config only for AKS
@@ -60,6 +78,9 @@ type Config struct {
 	// EnableDetailedCSEMessage defines whether to emit error messages in the CSE error body info
 	EnableDetailedCSEMessage bool `json:"enableDetailedCSEMessage,omitempty" yaml:"enableDetailedCSEMessage,omitempty"`
 
+	// The settings below are shared with the cloud config of the cluster autoscaler. They are accepted so the same file
+	// can be mounted, but they tune scale set calls the provisioner does not make and are ignored with a warning.
+
 	// EnableForceDelete defines whether to enable force deletion on the APIs
 	EnableForceDelete bool `json:"enableForceDelete,omitempty" yaml:"enableForceDelete,omitempty"`
 
@@ -74,29 +95,62 @@ type Config struct {
 	EnablePartialScaling bool `json:"enablePartialScaling,omitempty" yaml:"enablePartialScaling,omitempty"`
 }
 
+// BaseVars overrides the config with the environment variables that are set
 func (cfg *Config) BaseVars() {
-	cfg.Location = os.Getenv("LOCATION")
-	cfg.ResourceGroup = os.Getenv("ARM_RESOURCE_GROUP")
-	cfg.TenantID = os.Getenv("AZURE_TENANT_ID")
-	cfg.UserAssignedIdentityID = os.Getenv("AZURE_CLIENT_ID")
-	cfg.ClusterName = os.Getenv("AZURE_CLUSTER_NAME")
-	cfg.NodeResourceGroup = os.Getenv("AZURE_NODE_RESOURCE_GROUP")
-	cfg.SubscriptionID = os.Getenv("ARM_SUBSCRIPTION_ID")
+	overrideFromEnv(&cfg.Cloud, "ARM_CLOUD")
+	overrideFromEnv(&cfg.CloudEnvironmentFile, azure.EnvironmentFilepathName)
+	overrideFromEnv(&cfg.Location, "LOCATION")
+	overrideFromEnv(&cfg.ResourceGroup, "ARM_RESOURCE_GROUP")
+	overrideFromEnv(&cfg.TenantID, "AZURE_TENANT_ID")
+	overrideFromEnv(&cfg.UserAssignedIdentityID, "AZURE_CLIENT_ID")
+	overrideFromEnv(&cfg.CredentialMode, "AZURE_CREDENTIAL_MODE")
+	overrideFromEnv(&cfg.ClientSecret, "AZURE_CLIENT_SECRET")
+	overrideFromEnv(&cfg.ClientCertificatePath, "AZURE_CLIENT_CERTIFICATE_PATH")
+	overrideFromEnv(&cfg.ClientCertificatePassword, "AZURE_CLIENT_CERTIFICATE_PASSWORD")
+	overrideFromEnv(&cfg.ClusterName, "AZURE_CLUSTER_NAME")
+	overrideFromEnv(&cfg.NodeResourceGroup, "AZURE_NODE_RESOURCE_GROUP")
+	overrideFromEnv(&cfg.SubscriptionID, "ARM_SUBSCRIPTION_ID")
+}
+
+func overrideFromEnv(value *string, key string) {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		*value = v
+	}
 }
 
-// BuildAzureConfig returns a Config object for the Azure clients
+// BuildAzureConfig returns a Config object for the Azure clients. The config is read from the JSON or YAML cloud config
+// file, if one is given, and the environment variables that are set take precedence over the file.
 // nolint: gocyclo
-func BuildAzureConfig() (*Config, error) {
+func BuildAzureConfig(cloudConfigPath string) (*Config, error) {
 	var err error
-	cfg := &Config{}
+	cfg := &Config{EnableDynamicSKUCache: dynamicSKUCacheDefault}
+	if cloudConfigPath != "" {
+		data, err := os.ReadFile(cloudConfigPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading cloud config, %w", err)
+		}
+		// JSON is valid YAML. The azure.json of AKS nodes carries many fields for the cloud provider of the kubelet, so
+		// unknown fields are logged rather than rejected, a typo still shows up in the logs.
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing cloud config %s, %w", cloudConfigPath, err)
+		}
+		unknown, err := unknownFields(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cloud config %s, %w", cloudConfigPath, err)
+		}
+		if len(unknown) > 0 {
+			klog.Warningf("ignoring unknown fields %v of cloud config %s", unknown, cloudConfigPath)
+		}
+		if ignored := cfg.ignoredSettings(); len(ignored) > 0 {
+			klog.Warningf("ignoring settings %v of cloud config %s, they are not supported by the provisioner", ignored, cloudConfigPath)
+		}
+	}
 	cfg.BaseVars()
 	if enableDynamicSKUCache := os.Getenv("AZURE_ENABLE_DYNAMIC_SKU_CACHE"); enableDynamicSKUCache != "" {
 		cfg.EnableDynamicSKUCache, err = strconv.ParseBool(enableDynamicSKUCache)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse AZURE_ENABLE_DYNAMIC_SKU_CACHE %q: %w", enableDynamicSKUCache, err)
 		}
-	} else {
-		cfg.EnableDynamicSKUCache = dynamicSKUCacheDefault
 	}
 
 	cfg.TrimSpace()
@@ -107,8 +161,48 @@ func BuildAzureConfig() (*Config, error) {
 	return cfg, nil
 }
 
+// unknownFields returns the sorted top level fields of the cloud config that are not fields of Config
+func unknownFields(data []byte) ([]string, error) {
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		known[strings.Split(configType.Field(i).Tag.Get("json"), ",")[0]] = true
+	}
+	var unknown []string
+	for field := range raw {
+		if !known[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// ignoredSettings returns the cluster autoscaler settings that are set, the provisioner does not support them
+func (cfg *Config) ignoredSettings() []string {
+	var ignored []string
+	if cfg.EnableForceDelete {
+		ignored = append(ignored, "enableForceDelete")
+	}
+	if cfg.EnableGetVmss {
+		ignored = append(ignored, "enableGetVmss")
+	}
+	if cfg.GetVmssSizeRefreshPeriod != 0 {
+		ignored = append(ignored, "getVmssSizeRefreshPeriod")
+	}
+	if cfg.EnablePartialScaling {
+		ignored = append(ignored, "enablePartialScaling")
+	}
+	return ignored
+}
+
 func (cfg *Config) GetAzureClientConfig(authorizer autorest.Authorizer, env *azure.Environment) *ClientConfig {
 	azClientConfig := &ClientConfig{
+		CloudName:               env.Name,
 		Location:                cfg.Location,
 		SubscriptionID:          cfg.SubscriptionID,
 		ResourceManagerEndpoint: env.ResourceManagerEndpoint,
@@ -120,6 +214,10 @@ func (cfg *Config) GetAzureClientConfig(authorizer autorest.Authorizer, env *azu
 
 // TrimSpace removes all leading and trailing white spaces.
 func (cfg *Config) TrimSpace() {
+	cfg.Cloud = strings.TrimSpace(cfg.Cloud)
+	cfg.CredentialMode = strings.TrimSpace(cfg.CredentialMode)
+	cfg.UserAssignedIdentityID = strings.TrimSpace(cfg.UserAssignedIdentityID)
+	cfg.Location = strings.TrimSpace(cfg.Location)
 	cfg.TenantID = strings.TrimSpace(cfg.TenantID)
 	cfg.SubscriptionID = strings.TrimSpace(cfg.SubscriptionID)
 	cfg.ResourceGroup = strings.TrimSpace(cfg.ResourceGroup)
@@ -137,9 +235,44 @@ func (cfg *Config) validate() error {
 		return fmt.Errorf("tenant ID not set")
 	}
 
+	if cfg.Location == "" {
+		return fmt.Errorf("location is not set")
+	}
+	if cfg.ResourceGroup == "" {
+		return fmt.Errorf("resource group is not set")
+	}
+	if cfg.ClusterName == "" {
+		return fmt.Errorf("cluster name is not set")
+	}
 	if cfg.NodeResourceGroup == "" {
 		return fmt.Errorf("node resource group is not set")
 	}
+	if cfg.GetVmssSizeRefreshPeriod < 0 {
+		return fmt.Errorf("getVmssSizeRefreshPeriod must not be negative")
+	}
+
+	if _, err := cfg.Environment(); err != nil {
+		return err
+	}
+
+	return cfg.validateCredential()
+}
+
+// validateCredential checks the settings the credential mode requires
+func (cfg *Config) validateCredential() error {
+	switch cfg.CredentialMode {
+	case "", CredentialModeWorkloadIdentity, CredentialModeManagedIdentity, CredentialModeAzureCLI:
+	case CredentialModeServicePrincipal:
+		if cfg.UserAssignedIdentityID == "" || cfg.ClientSecret == "" {
+			return fmt.Errorf("credential mode %s requires AZURE_CLIENT_ID and AZURE_CLIENT_SECRET", cfg.CredentialMode)
+		}
+	case CredentialModeClientCertificate:
+		if cfg.UserAssignedIdentityID == "" || cfg.ClientCertificatePath == "" {
+			return fmt.Errorf("credential mode %s requires AZURE_CLIENT_ID and AZURE_CLIENT_CERTIFICATE_PATH", cfg.CredentialMode)
+		}
+	default:
+		return fmt.Errorf("unknown credential mode %s", cfg.CredentialMode)
+	}
 
 	return nil
 }
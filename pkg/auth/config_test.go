@@ -0,0 +1,228 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const yamlCloudConfig = `
+location: eastus
+tenantId: tenant
+subscriptionId: subscription
+resourceGroup: rg
+clusterName: cluster
+nodeResourceGroup: mc_rg
+userAssignedIdentityID: client
+enableDetailedCSEMessage: true
+`
+
+const jsonCloudConfig = `{
+	"location": "westus2",
+	"tenantId": "tenant",
+	"subscriptionId": "subscription",
+	"resourceGroup": "rg",
+	"clusterName": "cluster",
+	"nodeResourceGroup": "mc_rg",
+	"credentialMode": "ServicePrincipal",
+	"userAssignedIdentityID": "client",
+	"clientSecret": "secret"
+}`
+
+// aksAzureJSON is the /etc/kubernetes/azure.json of an AKS node, the cluster settings are passed as environment variables
+const aksAzureJSON = `{
+    "cloud": "AzurePublicCloud",
+    "tenantId": "tenant",
+    "subscriptionId": "subscription",
+    "aadClientId": "msi",
+    "aadClientSecret": "msi",
+    "resourceGroup": "MC_rg_cluster_eastus",
+    "location": "eastus",
+    "vmType": "vmss",
+    "subnetName": "aks-subnet",
+    "securityGroupName": "aks-agentpool-20562481-nsg",
+    "vnetName": "aks-vnet-20562481",
+    "vnetResourceGroup": "",
+    "routeTableName": "aks-agentpool-20562481-routetable",
+    "primaryAvailabilitySetName": "",
+    "primaryScaleSetName": "aks-nodepool1-20562481-vmss",
+    "cloudProviderBackoffMode": "v2",
+    "cloudProviderBackoff": true,
+    "cloudProviderBackoffRetries": 6,
+    "cloudProviderBackoffDuration": 5,
+    "cloudProviderRateLimit": true,
+    "cloudProviderRateLimitQPS": 10,
+    "cloudProviderRateLimitBucket": 100,
+    "cloudProviderRateLimitQPSWrite": 10,
+    "cloudProviderRateLimitBucketWrite": 100,
+    "useManagedIdentityExtension": true,
+    "userAssignedIdentityID": "client",
+    "useInstanceMetadata": true,
+    "loadBalancerSku": "Standard",
+    "disableOutboundSNAT": false,
+    "excludeMasterFromStandardLB": true,
+    "providerVaultName": "",
+    "maximumLoadBalancerRuleCount": 250,
+    "providerKeyName": "k8s",
+    "providerKeyVersion": ""
+}`
+
+func TestBuildAzureConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		env         map[string]string
+		expected    func(*testing.T, *Config)
+		expectedErr string
+	}{
+		{
+			name:    "yaml",
+			content: yamlCloudConfig,
+			expected: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "eastus", cfg.Location)
+				assert.Equal(t, "subscription", cfg.SubscriptionID)
+				assert.Equal(t, "mc_rg", cfg.NodeResourceGroup)
+				assert.True(t, cfg.EnableDetailedCSEMessage)
+			},
+		},
+		{
+			name:    "json",
+			content: jsonCloudConfig,
+			expected: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "westus2", cfg.Location)
+				assert.Equal(t, CredentialModeServicePrincipal, cfg.CredentialMode)
+				assert.Equal(t, "secret", cfg.ClientSecret)
+			},
+		},
+		{
+			name:    "environment variables override the file",
+			content: yamlCloudConfig,
+			env: map[string]string{
+				"ARM_SUBSCRIPTION_ID":            "other-subscription",
+				"AZURE_ENABLE_DYNAMIC_SKU_CACHE": "true",
+			},
+			expected: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "other-subscription", cfg.SubscriptionID)
+				assert.Equal(t, "eastus", cfg.Location)
+				assert.True(t, cfg.EnableDynamicSKUCache)
+			},
+		},
+		{
+			name: "environment variables only",
+			env: map[string]string{
+				"LOCATION":                  "eastus",
+				"AZURE_TENANT_ID":           "tenant",
+				"ARM_SUBSCRIPTION_ID":       "subscription",
+				"ARM_RESOURCE_GROUP":        "rg",
+				"AZURE_CLUSTER_NAME":        "cluster",
+				"AZURE_NODE_RESOURCE_GROUP": "mc_rg",
+			},
+			expected: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "eastus", cfg.Location)
+				assert.Equal(t, "cluster", cfg.ClusterName)
+			},
+		},
+		{
+			name:    "azure.json of an AKS node",
+			content: aksAzureJSON,
+			env: map[string]string{
+				"ARM_RESOURCE_GROUP":        "rg",
+				"AZURE_CLUSTER_NAME":        "cluster",
+				"AZURE_NODE_RESOURCE_GROUP": "MC_rg_cluster_eastus",
+			},
+			expected: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "AzurePublicCloud", cfg.Cloud)
+				assert.Equal(t, "eastus", cfg.Location)
+				assert.Equal(t, "tenant", cfg.TenantID)
+				assert.Equal(t, "subscription", cfg.SubscriptionID)
+				assert.Equal(t, "rg", cfg.ResourceGroup)
+				assert.Equal(t, "client", cfg.UserAssignedIdentityID)
+				assert.Equal(t, "MC_rg_cluster_eastus", cfg.NodeResourceGroup)
+			},
+		},
+		{
+			name:    "unknown field is ignored",
+			content: yamlCloudConfig + "enablePartialScale: true\n",
+			expected: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "eastus", cfg.Location)
+				assert.False(t, cfg.EnablePartialScaling)
+			},
+		},
+		{
+			name:    "cluster autoscaler settings are accepted",
+			content: yamlCloudConfig + "enableForceDelete: true\nenableGetVmss: true\ngetVmssSizeRefreshPeriod: 30000000000\nenablePartialScaling: true\n",
+			expected: func(t *testing.T, cfg *Config) {
+				assert.True(t, cfg.EnableForceDelete)
+				assert.True(t, cfg.EnableGetVmss)
+				assert.Equal(t, 30*time.Second, cfg.GetVmssSizeRefreshPeriod)
+				assert.True(t, cfg.EnablePartialScaling)
+				assert.Equal(t, []string{"enableForceDelete", "enableGetVmss", "getVmssSizeRefreshPeriod", "enablePartialScaling"}, cfg.ignoredSettings())
+			},
+		},
+		{
+			name:        "negative vmss refresh period",
+			content:     yamlCloudConfig + "getVmssSizeRefreshPeriod: -1\n",
+			expectedErr: "getVmssSizeRefreshPeriod must not be negative",
+		},
+		{
+			name:        "missing required field",
+			content:     "location: eastus\ntenantId: tenant\nsubscriptionId: subscription\n",
+			expectedErr: "resource group is not set",
+		},
+		{
+			name:        "invalid credential mode",
+			content:     yamlCloudConfig + "credentialMode: Password\n",
+			expectedErr: "unknown credential mode",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, key := range []string{"ARM_CLOUD", "LOCATION", "ARM_RESOURCE_GROUP", "AZURE_TENANT_ID", "AZURE_CLIENT_ID",
+				"AZURE_CREDENTIAL_MODE", "AZURE_CLIENT_SECRET", "AZURE_CLUSTER_NAME", "AZURE_NODE_RESOURCE_GROUP",
+				"ARM_SUBSCRIPTION_ID", "AZURE_ENABLE_DYNAMIC_SKU_CACHE"} {
+				t.Setenv(key, tc.env[key])
+			}
+			path := ""
+			if tc.content != "" {
+				path = filepath.Join(t.TempDir(), "cloud-config")
+				assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0600))
+			}
+
+			cfg, err := BuildAzureConfig(path)
+			if tc.expectedErr != "" {
+				assert.ErrorContains(t, err, tc.expectedErr)
+				return
+			}
+			assert.NoError(t, err)
+			tc.expected(t, cfg)
+		})
+	}
+}
+
+func TestUnknownFields(t *testing.T) {
+	unknown, err := unknownFields([]byte(aksAzureJSON))
+	assert.NoError(t, err)
+	assert.Contains(t, unknown, "vmType")
+	assert.Contains(t, unknown, "aadClientId")
+	assert.NotContains(t, unknown, "userAssignedIdentityID")
+	assert.NotContains(t, unknown, "location")
+}
@@ -22,12 +22,15 @@ import (
 	"encoding/pem"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/services/keyvault/2016-10-01/keyvault"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/AzureAD/microsoft-authentication-library-for-go/apps/confidential"
 	"github.com/azure/gpu-provisioner/pkg/utils"
@@ -43,15 +46,76 @@ const (
 type ClientAssertionCredential struct {
 	assertion, file string
 	client          confidential.Client
-	lastRead        time.Time
+
+	// mu guards the assertion, the credential is shared by the track 1 authorizer and the track 2 clients
+	mu       sync.Mutex
+	lastRead time.Time
 }
 
-// NewCredential provides a token credential for msi and service principal auth
-func NewCredential(cfg *Config, authorizer autorest.Authorizer) (azcore.TokenCredential, error) {
+// Credential modes selected with AZURE_CREDENTIAL_MODE
+const (
+	// CredentialModeWorkloadIdentity exchanges the service account token projected by the Azure AD Workload Identity
+	// webhook, it is the default
+	CredentialModeWorkloadIdentity = "WorkloadIdentity"
+	// CredentialModeManagedIdentity uses the managed identity of the node from IMDS, AZURE_CLIENT_ID selects a user
+	// assigned identity
+	CredentialModeManagedIdentity = "ManagedIdentity"
+	// CredentialModeServicePrincipal uses the client secret in AZURE_CLIENT_SECRET
+	CredentialModeServicePrincipal = "ServicePrincipal"
+	// CredentialModeClientCertificate uses the PEM or PKCS12 certificate in AZURE_CLIENT_CERTIFICATE_PATH
+	CredentialModeClientCertificate = "ClientCertificate"
+	// CredentialModeAzureCLI uses the account logged in with the Azure CLI, for local development
+	CredentialModeAzureCLI = "AzureCLI"
+)
+
+// NewCredential provides a token credential for the track 2 clients using the configured credential mode
+func NewCredential(cfg *Config, env *azure.Environment, authorizer autorest.Authorizer) (azcore.TokenCredential, error) {
 	if cfg == nil {
 		return nil, fmt.Errorf("failed to create credential, nil config provided")
 	}
 
+	isE2E := utils.WithDefaultBool("E2E_TEST_MODE", false)
+	if !isE2E {
+		return newTokenCredential(cfg, env)
+	}
+	return newE2ECredential(cfg, authorizer)
+}
+
+// newTokenCredential returns the credential of the configured credential mode, both the track 1 authorizer and the
+// track 2 clients get their tokens from it
+func newTokenCredential(cfg *Config, env *azure.Environment) (azcore.TokenCredential, error) {
+	clientOptions := azcore.ClientOptions{Cloud: CloudConfiguration(env)}
+	switch cfg.CredentialMode {
+	case "", CredentialModeWorkloadIdentity:
+		return newClientAssertionCredential(cfg)
+	case CredentialModeManagedIdentity:
+		opts := &azidentity.ManagedIdentityCredentialOptions{ClientOptions: clientOptions}
+		if cfg.UserAssignedIdentityID != "" {
+			opts.ID = azidentity.ClientID(cfg.UserAssignedIdentityID)
+		}
+		return azidentity.NewManagedIdentityCredential(opts)
+	case CredentialModeServicePrincipal:
+		return azidentity.NewClientSecretCredential(cfg.TenantID, cfg.UserAssignedIdentityID, cfg.ClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: clientOptions})
+	case CredentialModeClientCertificate:
+		data, err := os.ReadFile(cfg.ClientCertificatePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading client certificate, %w", err)
+		}
+		certs, key, err := azidentity.ParseCertificates(data, []byte(cfg.ClientCertificatePassword))
+		if err != nil {
+			return nil, fmt.Errorf("parsing client certificate %s, %w", cfg.ClientCertificatePath, err)
+		}
+		return azidentity.NewClientCertificateCredential(cfg.TenantID, cfg.UserAssignedIdentityID, certs, key,
+			&azidentity.ClientCertificateCredentialOptions{ClientOptions: clientOptions})
+	case CredentialModeAzureCLI:
+		return azidentity.NewAzureCLICredential(&azidentity.AzureCLICredentialOptions{TenantID: cfg.TenantID})
+	}
+	return nil, fmt.Errorf("unknown credential mode %s", cfg.CredentialMode)
+}
+
+// newClientAssertionCredential returns a credential exchanging the service account token for an AAD token
+func newClientAssertionCredential(cfg *Config) (*ClientAssertionCredential, error) {
 	// Azure AD Workload Identity webhook will inject the following env vars:
 	// 	AZURE_FEDERATED_TOKEN_FILE is the service account token path
 	// 	AZURE_AUTHORITY_HOST is the AAD authority hostname
@@ -63,35 +127,51 @@ func NewCredential(cfg *Config, authorizer autorest.Authorizer) (azcore.TokenCre
 		return nil, fmt.Errorf("required environment variables not set, AZURE_FEDERATED_TOKEN_FILE: %s, AZURE_AUTHORITY_HOST: %s", tokenFilePath, authority)
 	}
 	c := &ClientAssertionCredential{file: tokenFilePath}
+	cred := confidential.NewCredFromAssertionCallback(
+		func(ctx context.Context, _ confidential.AssertionRequestOptions) (string, error) {
+			return c.readJWTFromFS()
+		},
+	)
 
-	var cred confidential.Credential
-	isE2E := utils.WithDefaultBool("E2E_TEST_MODE", false)
-	if isE2E {
-		armClientCert, err := getE2ETestingCert(authorizer)
-		if err != nil {
-			return nil, err
-		}
-		certPEM, keyPEM := splitPEMBlock([]byte(to.String(armClientCert)))
-		if len(certPEM) == 0 {
-			return nil, errors.New("malformed cert pem format")
-		}
+	// create the confidential client to request an AAD token
+	confidentialClientApp, err := confidential.New(
+		fmt.Sprintf("%s%s/oauth2/token", authority, cfg.TenantID),
+		cfg.UserAssignedIdentityID,
+		cred)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create confidential client app: %w", err)
+	}
+	c.client = confidentialClientApp
 
-		// Load client cert
-		cert, err := tls.X509KeyPair(certPEM, keyPEM)
-		if err != nil {
-			return nil, err
-		}
-		leafCert := []tls.Certificate{cert}
-		cred, err = confidential.NewCredFromCert([]*x509.Certificate{leafCert[0].Leaf}, keyPEM)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		cred = confidential.NewCredFromAssertionCallback(
-			func(ctx context.Context, _ confidential.AssertionRequestOptions) (string, error) {
-				return c.readJWTFromFS()
-			},
-		)
+	return c, nil
+}
+
+// newE2ECredential returns a credential using the ARM client certificate of the e2e environment
+func newE2ECredential(cfg *Config, authorizer autorest.Authorizer) (*ClientAssertionCredential, error) {
+	authority := os.Getenv("AZURE_AUTHORITY_HOST")
+	if authority == "" {
+		return nil, fmt.Errorf("required environment variables not set, AZURE_AUTHORITY_HOST: %s", authority)
+	}
+	c := &ClientAssertionCredential{}
+
+	armClientCert, err := getE2ETestingCert(authorizer)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, keyPEM := splitPEMBlock([]byte(to.String(armClientCert)))
+	if len(certPEM) == 0 {
+		return nil, errors.New("malformed cert pem format")
+	}
+
+	// Load client cert
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	leafCert := []tls.Certificate{cert}
+	cred, err := confidential.NewCredFromCert([]*x509.Certificate{leafCert[0].Leaf}, keyPEM)
+	if err != nil {
+		return nil, err
 	}
 
 	// create the confidential client to request an AAD token
@@ -124,6 +204,8 @@ func (c *ClientAssertionCredential) GetToken(ctx context.Context, opts policy.To
 // readJWTFromFS reads the jwt from file system
 // Source: https://github.com/Azure/azure-workload-identity/blob/d126293e3c7c669378b225ad1b1f29cf6af4e56d/examples/msal-go/token_credential.go#L88
 func (c *ClientAssertionCredential) readJWTFromFS() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if now := time.Now(); c.lastRead.Add(5 * time.Minute).Before(now) {
 		content, err := os.ReadFile(c.file)
 		if err != nil {
@@ -0,0 +1,156 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTokenCredential(t *testing.T) {
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(tokenFile, []byte("service-account-token"), 0600))
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	t.Setenv("AZURE_AUTHORITY_HOST", "https://login.microsoftonline.com/")
+	certFile := writeTestCertificate(t, dir)
+
+	tests := []struct {
+		name         string
+		cfg          *Config
+		expectedType any
+		expectedErr  bool
+	}{
+		{
+			name:         "defaults to workload identity",
+			cfg:          &Config{TenantID: "tenant", UserAssignedIdentityID: "client"},
+			expectedType: &ClientAssertionCredential{},
+		},
+		{
+			name:         "managed identity",
+			cfg:          &Config{CredentialMode: CredentialModeManagedIdentity, UserAssignedIdentityID: "client"},
+			expectedType: &azidentity.ManagedIdentityCredential{},
+		},
+		{
+			name:         "service principal",
+			cfg:          &Config{CredentialMode: CredentialModeServicePrincipal, TenantID: "tenant", UserAssignedIdentityID: "client", ClientSecret: "secret"},
+			expectedType: &azidentity.ClientSecretCredential{},
+		},
+		{
+			name:         "client certificate",
+			cfg:          &Config{CredentialMode: CredentialModeClientCertificate, TenantID: "tenant", UserAssignedIdentityID: "client", ClientCertificatePath: certFile},
+			expectedType: &azidentity.ClientCertificateCredential{},
+		},
+		{
+			name:        "client certificate that does not exist",
+			cfg:         &Config{CredentialMode: CredentialModeClientCertificate, TenantID: "tenant", UserAssignedIdentityID: "client", ClientCertificatePath: filepath.Join(dir, "missing.pem")},
+			expectedErr: true,
+		},
+		{
+			name:        "client certificate that is not a certificate",
+			cfg:         &Config{CredentialMode: CredentialModeClientCertificate, TenantID: "tenant", UserAssignedIdentityID: "client", ClientCertificatePath: tokenFile},
+			expectedErr: true,
+		},
+		{
+			name:         "azure cli",
+			cfg:          &Config{CredentialMode: CredentialModeAzureCLI, TenantID: "tenant"},
+			expectedType: &azidentity.AzureCLICredential{},
+		},
+		{
+			name:        "unknown mode",
+			cfg:         &Config{CredentialMode: "Password"},
+			expectedErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cred, err := newTokenCredential(tc.cfg, &azure.PublicCloud)
+			if tc.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.IsType(t, tc.expectedType, cred)
+		})
+	}
+}
+
+func TestNewTokenCredentialWorkloadIdentityWithoutWebhook(t *testing.T) {
+	t.Setenv("AZURE_FEDERATED_TOKEN_FILE", "")
+	t.Setenv("AZURE_AUTHORITY_HOST", "")
+	_, err := newTokenCredential(&Config{TenantID: "tenant"}, &azure.PublicCloud)
+	assert.Error(t, err)
+}
+
+func TestValidateCredential(t *testing.T) {
+	tests := []struct {
+		name        string
+		cfg         *Config
+		expectedErr bool
+	}{
+		{name: "default mode", cfg: &Config{}},
+		{name: "managed identity", cfg: &Config{CredentialMode: CredentialModeManagedIdentity}},
+		{name: "service principal", cfg: &Config{CredentialMode: CredentialModeServicePrincipal, UserAssignedIdentityID: "client", ClientSecret: "secret"}},
+		{name: "service principal without secret", cfg: &Config{CredentialMode: CredentialModeServicePrincipal, UserAssignedIdentityID: "client"}, expectedErr: true},
+		{name: "client certificate without path", cfg: &Config{CredentialMode: CredentialModeClientCertificate, UserAssignedIdentityID: "client"}, expectedErr: true},
+		{name: "unknown mode", cfg: &Config{CredentialMode: "Password"}, expectedErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.cfg.validateCredential()
+			if tc.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// writeTestCertificate writes a self signed certificate and its RSA key as PEM, AAD only accepts RSA keys
+func writeTestCertificate(t *testing.T, dir string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "gpu-provisioner"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	path := filepath.Join(dir, "cert.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	return path
+}
@@ -44,9 +44,13 @@ func NewUnavailableOfferings() *UnavailableOfferings {
 	}
 }
 
-// IsUnavailable returns true if the offering appears in the cache
+// IsUnavailable returns true if the offering appears in the cache. An offering marked unavailable without a zone
+// is unavailable in every zone of the region.
 func (u *UnavailableOfferings) IsUnavailable(instanceType, zone, capacityType string) bool {
 	_, found := u.cache.Get(u.key(instanceType, zone, capacityType))
+	if !found && zone != "" {
+		_, found = u.cache.Get(u.key(instanceType, "", capacityType))
+	}
 	return found
 }
 
@@ -61,3 +61,22 @@ func TestUnavailableOfferings_KeyGeneration(t *testing.T) {
 		t.Errorf("Expected key to be %s, but got %s", expectedKey, key)
 	}
 }
+
+func TestUnavailableOfferings_Regional(t *testing.T) {
+	c := cache.New(time.Minute, time.Minute)
+	u := NewUnavailableOfferingsWithCache(c)
+
+	u.MarkUnavailable(context.TODO(), "test reason", "NV16as_v4", "westus-1", "spot")
+	if u.IsUnavailable("NV16as_v4", "westus-2", "spot") {
+		t.Error("Offering should only be marked as unavailable in the marked zone")
+	}
+
+	// an offering marked without a zone is unavailable in every zone
+	u.MarkUnavailable(context.TODO(), "test reason", "NV16as_v4", "", "spot")
+	if !u.IsUnavailable("NV16as_v4", "westus-2", "spot") {
+		t.Error("Offering should be marked as unavailable in every zone after being marked without a zone")
+	}
+	if u.IsUnavailable("NV16as_v4", "westus-2", "on-demand") {
+		t.Error("Offering should not be marked as unavailable for another capacity type")
+	}
+}
@@ -27,10 +27,12 @@ import (
 	"github.com/azure/gpu-provisioner/pkg/providers/instance"
 	"github.com/azure/gpu-provisioner/pkg/providers/instancetype"
 	"github.com/samber/lo"
+	"knative.dev/pkg/logging"
 
 	coreapis "github.com/aws/karpenter-core/pkg/apis"
 	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
 	"github.com/aws/karpenter-core/pkg/cloudprovider"
+	"github.com/aws/karpenter-core/pkg/scheduling"
 )
 
 func init() {
@@ -61,9 +63,8 @@ func (c *CloudProvider) Create(ctx context.Context, machine *v1alpha5.Machine) (
 	if err != nil {
 		return nil, fmt.Errorf("creating instance, %w", err)
 	}
-	m := c.instanceToMachine(ctx, instance)
-	m.Labels = lo.Assign(m.Labels, instance.Labels)
-	return m, nil
+	instanceTypes := c.instanceTypesByName(ctx, machine.Spec.Kubelet)
+	return c.instanceToMachine(ctx, instance, instanceTypes[lo.FromPtr(instance.Type)]), nil
 }
 
 func (c *CloudProvider) List(ctx context.Context) ([]*v1alpha5.Machine, error) {
@@ -73,8 +74,9 @@ func (c *CloudProvider) List(ctx context.Context) ([]*v1alpha5.Machine, error) {
 		return nil, err
 	}
 
+	instanceTypes := c.instanceTypesByName(ctx, nil)
 	for index := range instances {
-		machines = append(machines, c.instanceToMachine(ctx, instances[index]))
+		machines = append(machines, c.instanceToMachine(ctx, instances[index], instanceTypes[lo.FromPtr(instances[index].Type)]))
 	}
 	return machines, nil
 }
@@ -84,12 +86,10 @@ func (c *CloudProvider) Get(ctx context.Context, providerID string) (*v1alpha5.M
 
 	instance, err := c.instanceProvider.Get(ctx, providerID)
 	if err != nil {
-		return nil, fmt.Errorf("getting instance , %w", err)
+		return nil, fmt.Errorf("getting instance, %w", err)
 	}
-	if instance == nil {
-		return nil, fmt.Errorf("cannot find a ready instance , %w", err)
-	}
-	return c.instanceToMachine(ctx, instance), err
+	instanceTypes := c.instanceTypesByName(ctx, nil)
+	return c.instanceToMachine(ctx, instance, instanceTypes[lo.FromPtr(instance.Type)]), nil
 }
 
 func (c *CloudProvider) LivenessProbe(req *http.Request) error {
@@ -98,19 +98,41 @@ func (c *CloudProvider) LivenessProbe(req *http.Request) error {
 
 func (c *CloudProvider) Delete(ctx context.Context, machine *v1alpha5.Machine) error {
 	klog.InfoS("Delete", "machine", klog.KObj(machine))
-	return c.instanceProvider.Delete(ctx, machine.Status.ProviderID)
+	if err := c.instanceProvider.Delete(ctx, machine.Status.ProviderID); err != nil {
+		return fmt.Errorf("deleting instance, %w", err)
+	}
+	return nil
 }
 
 func (c *CloudProvider) IsMachineDrifted(ctx context.Context, machine *v1alpha5.Machine) (bool, error) {
 	klog.InfoS("IsMachineDrifted", "machine", klog.KObj(machine))
-	return false, nil
+	reason, err := c.isDrifted(ctx, machine)
+	if err != nil {
+		return false, fmt.Errorf("checking drift, %w", err)
+	}
+	if reason != noDrift {
+		logging.FromContext(ctx).With("machine", machine.Name, "reason", reason).Infof("machine has drifted")
+	}
+	return reason != noDrift, nil
 }
 
+// GetInstanceTypes returns the instance types known to the instance type provider that are compatible with the
+// provisioner's requirements, with capacity and overhead computed from the provisioner's kubelet configuration.
 func (c *CloudProvider) GetInstanceTypes(ctx context.Context, provisioner *v1alpha5.Provisioner) ([]*cloudprovider.InstanceType, error) {
+	var kc *v1alpha5.KubeletConfiguration
+	requirements := scheduling.NewRequirements()
+	if provisioner != nil {
+		kc = provisioner.Spec.KubeletConfiguration
+		requirements = scheduling.NewNodeSelectorRequirements(provisioner.Spec.Requirements...)
+	}
 
-	instanceTypes := []*cloudprovider.InstanceType{}
-
-	return instanceTypes, nil
+	instanceTypes, err := c.instanceTypeProvider.List(ctx, kc)
+	if err != nil {
+		return nil, fmt.Errorf("listing instance types, %w", err)
+	}
+	return lo.Filter(instanceTypes, func(it *cloudprovider.InstanceType, _ int) bool {
+		return requirements.Intersects(it.Requirements) == nil
+	}), nil
 }
 
 // Name returns the CloudProvider implementation name.
@@ -0,0 +1,496 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	//nolint SA1019 - deprecated package
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	corecloudprovider "github.com/aws/karpenter-core/pkg/cloudprovider"
+	"github.com/patrickmn/go-cache"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
+	azurecache "github.com/azure/gpu-provisioner/pkg/cache"
+	"github.com/azure/gpu-provisioner/pkg/fake"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+	"github.com/azure/gpu-provisioner/pkg/providers/instancetype"
+	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
+	"github.com/azure/gpu-provisioner/pkg/tests"
+	"github.com/azure/gpu-provisioner/pkg/utils"
+)
+
+func TestGetInstanceTypes(t *testing.T) {
+	testCases := []struct {
+		name          string
+		provisioner   *v1alpha5.Provisioner
+		expectedNames []string
+		expectedPods  string
+	}{
+		{
+			name:          "All instance types are returned without a provisioner",
+			expectedNames: lo.Map(fake.ResourceSkus, func(sku compute.ResourceSku, _ int) string { return lo.FromPtr(sku.Name) }),
+			expectedPods:  "110",
+		},
+		{
+			name: "Instance types are filtered by provisioner requirements",
+			provisioner: &v1alpha5.Provisioner{
+				Spec: v1alpha5.ProvisionerSpec{
+					Requirements: []v1.NodeSelectorRequirement{
+						{
+							Key:      v1.LabelInstanceTypeStable,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{"Standard_NC24ads_A100_v4", "Standard_D2s_v3"},
+						},
+					},
+				},
+			},
+			expectedNames: []string{"Standard_D2s_v3", "Standard_NC24ads_A100_v4"},
+			expectedPods:  "110",
+		},
+		{
+			name: "Instance types are filtered by spot capacity type",
+			provisioner: &v1alpha5.Provisioner{
+				Spec: v1alpha5.ProvisionerSpec{
+					Requirements: []v1.NodeSelectorRequirement{
+						{
+							Key:      v1.LabelInstanceTypeStable,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{"Standard_NC24ads_A100_v4"},
+						},
+						{
+							Key:      v1alpha5.LabelCapacityType,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{v1alpha5.CapacityTypeSpot},
+						},
+					},
+				},
+			},
+			expectedNames: []string{"Standard_NC24ads_A100_v4"},
+			expectedPods:  "110",
+		},
+		{
+			name: "Instance types are filtered by availability zone",
+			provisioner: &v1alpha5.Provisioner{
+				Spec: v1alpha5.ProvisionerSpec{
+					Requirements: []v1.NodeSelectorRequirement{
+						{
+							Key:      v1.LabelTopologyZone,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{utils.MakeZone("", "1")},
+						},
+					},
+				},
+			},
+			// Standard_NC24ads_A100_v4 is only available in zone 3
+			expectedNames: []string{"Standard_D2s_v3", "Standard_D2_v2", "Standard_D2_v3", "Standard_D2_v5", "Standard_DS2_v2", "Standard_F16s_v2"},
+			expectedPods:  "110",
+		},
+		{
+			name: "Capacity honors the provisioner kubelet configuration",
+			provisioner: &v1alpha5.Provisioner{
+				Spec: v1alpha5.ProvisionerSpec{
+					KubeletConfiguration: &v1alpha5.KubeletConfiguration{MaxPods: lo.ToPtr(int32(30))},
+					Requirements: []v1.NodeSelectorRequirement{
+						{
+							Key:      v1.LabelInstanceTypeStable,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{"Standard_NC24ads_A100_v4"},
+						},
+					},
+				},
+			},
+			expectedNames: []string{"Standard_NC24ads_A100_v4"},
+			expectedPods:  "30",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			pricingProvider := pricing.NewProvider(ctx, &fake.PricingAPI{}, "", make(chan struct{}))
+			instanceTypeProvider := instancetype.NewProvider("", cache.New(instancetype.InstanceTypesCacheTTL, azurecache.DefaultCleanupInterval),
+				&fake.ResourceSKUsAPI{}, pricingProvider, azurecache.NewUnavailableOfferings())
+			c := New(instanceTypeProvider, nil, nil)
+
+			instanceTypes, err := c.GetInstanceTypes(ctx, tc.provisioner)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, tc.expectedNames, lo.Map(instanceTypes, func(it *corecloudprovider.InstanceType, _ int) string { return it.Name }))
+			for _, it := range instanceTypes {
+				assert.True(t, resource.MustParse(tc.expectedPods).Equal(it.Capacity[v1.ResourcePods]), "unexpected pods capacity for %s", it.Name)
+			}
+		})
+	}
+}
+
+func TestSpecDrift(t *testing.T) {
+	machine := func() *v1alpha5.Machine {
+		return tests.GetMachineObj("agentpool0", map[string]string{"test": "test", v1.LabelInstanceTypeStable: "Standard_NC6s_v3"},
+			[]v1.Taint{{Key: "sku", Value: "gpu", Effect: v1.TaintEffectNoSchedule}},
+			v1alpha5.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("30Gi")}},
+			[]v1.NodeSelectorRequirement{{Key: v1.LabelInstanceTypeStable, Operator: v1.NodeSelectorOpIn, Values: []string{"Standard_NC6s_v3", "Standard_NC12s_v3"}}})
+	}
+	instanceObj := func() *instance.Instance {
+		return &instance.Instance{
+			Type:         lo.ToPtr("Standard_NC12s_v3"),
+			Labels:       map[string]string{"test": "test", instance.LabelMachineType: "gpu"},
+			Taints:       []string{"sku=gpu:NoSchedule"},
+			OSDiskSizeGB: lo.ToPtr(int32(30)),
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		mutate   func(m *v1alpha5.Machine, i *instance.Instance)
+		expected DriftReason
+	}{
+		{
+			name:     "Agent pool matching the machine is not drifted",
+			mutate:   func(*v1alpha5.Machine, *instance.Instance) {},
+			expected: noDrift,
+		},
+		{
+			name:     "VM size outside the machine requirements is drifted",
+			mutate:   func(_ *v1alpha5.Machine, i *instance.Instance) { i.Type = lo.ToPtr("Standard_NC24s_v3") },
+			expected: VMSizeDrift,
+		},
+		{
+			name:     "Changed label value is drifted",
+			mutate:   func(m *v1alpha5.Machine, _ *instance.Instance) { m.Labels["test"] = "changed" },
+			expected: LabelsDrift,
+		},
+		{
+			name:     "Added label is drifted",
+			mutate:   func(m *v1alpha5.Machine, _ *instance.Instance) { m.Labels["new"] = "label" },
+			expected: LabelsDrift,
+		},
+		{
+			name:     "Added taint is drifted",
+			mutate:   func(_ *v1alpha5.Machine, i *instance.Instance) { i.Taints = append(i.Taints, "extra=:NoExecute") },
+			expected: TaintsDrift,
+		},
+		{
+			name:     "Spot taint added by AKS is not drifted",
+			mutate:   func(_ *v1alpha5.Machine, i *instance.Instance) { i.Taints = append(i.Taints, instance.SpotTaint) },
+			expected: noDrift,
+		},
+		{
+			name:     "Different OS disk size is drifted",
+			mutate:   func(_ *v1alpha5.Machine, i *instance.Instance) { i.OSDiskSizeGB = lo.ToPtr(int32(128)) },
+			expected: OSDiskSizeDrift,
+		},
+		{
+			name: "Gi storage request matching the OS disk size is not drifted",
+			mutate: func(m *v1alpha5.Machine, i *instance.Instance) {
+				m.Spec.Resources.Requests[v1.ResourceStorage] = resource.MustParse("128Gi")
+				i.OSDiskSizeGB = lo.ToPtr(int32(128))
+			},
+			expected: noDrift,
+		},
+		{
+			name: "OS disk size is ignored without a storage request",
+			mutate: func(m *v1alpha5.Machine, i *instance.Instance) {
+				m.Spec.Resources.Requests = v1.ResourceList{}
+				i.OSDiskSizeGB = lo.ToPtr(int32(128))
+			},
+			expected: noDrift,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, i := machine(), instanceObj()
+			tc.mutate(m, i)
+			assert.Equal(t, tc.expected, specDrift(m, i))
+		})
+	}
+}
+
+func TestIsMachineDrifted(t *testing.T) {
+	const (
+		image      = "AKSUbuntu-2204gen2containerd-202401.09.0"
+		otherImage = "AKSUbuntu-2204gen2containerd-202312.06.0"
+	)
+	testCases := []struct {
+		name                string
+		nodeImageVersion    string
+		currentK8sVersion   string
+		annotations         map[string]string
+		expected            bool
+		expectedAnnotations map[string]string
+	}{
+		{
+			name:              "Agent pool on the recorded versions is not drifted",
+			nodeImageVersion:  image,
+			currentK8sVersion: "1.27.7",
+			annotations: map[string]string{
+				v1alpha1.AgentPoolNodeImageVersionAnnotationKey:  image,
+				v1alpha1.AgentPoolKubernetesVersionAnnotationKey: "1.27.7",
+			},
+		},
+		{
+			name:              "Versions of a newly provisioned agent pool are recorded without drift",
+			nodeImageVersion:  image,
+			currentK8sVersion: "1.27.7",
+			expectedAnnotations: map[string]string{
+				v1alpha1.AgentPoolNodeImageVersionAnnotationKey:  image,
+				v1alpha1.AgentPoolKubernetesVersionAnnotationKey: "1.27.7",
+			},
+		},
+		{
+			name:              "Agent pool running another node image than recorded is drifted",
+			nodeImageVersion:  otherImage,
+			currentK8sVersion: "1.27.7",
+			annotations: map[string]string{
+				v1alpha1.AgentPoolNodeImageVersionAnnotationKey:  image,
+				v1alpha1.AgentPoolKubernetesVersionAnnotationKey: "1.27.7",
+			},
+			expected: true,
+		},
+		{
+			name:              "Agent pool running another kubernetes version than targeted is drifted",
+			nodeImageVersion:  image,
+			currentK8sVersion: "1.27.7",
+			annotations: map[string]string{
+				v1alpha1.AgentPoolNodeImageVersionAnnotationKey:  image,
+				v1alpha1.AgentPoolKubernetesVersionAnnotationKey: "1.28.3",
+			},
+			expected: true,
+		},
+		{
+			name:              "Agent pool running a patch of the targeted minor version is not drifted",
+			nodeImageVersion:  image,
+			currentK8sVersion: "1.27.7",
+			annotations: map[string]string{
+				v1alpha1.AgentPoolNodeImageVersionAnnotationKey:  image,
+				v1alpha1.AgentPoolKubernetesVersionAnnotationKey: "1.27",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+			ap.Properties.NodeImageVersion = lo.ToPtr(tc.nodeImageVersion)
+			ap.Properties.CurrentOrchestratorVersion = lo.ToPtr(tc.currentK8sVersion)
+			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+			agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool0", gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{AgentPool: ap}, nil)
+
+			mockK8sClient := fake.NewClient()
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+			nodeList := tests.GetNodeList([]v1.Node{tests.ReadyNode})
+			relevantMap := mockK8sClient.CreateMapWithType(nodeList)
+			for _, obj := range nodeList.Items {
+				n := obj
+				relevantMap[client.ObjectKeyFromObject(&n)] = &n
+			}
+			mockK8sClient.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+			if tc.expectedAnnotations != nil {
+				mockK8sClient.On("Patch", mock.Anything, mock.MatchedBy(func(m *v1alpha5.Machine) bool {
+					return lo.Every(lo.Entries(m.Annotations), lo.Entries(tc.expectedAnnotations))
+				}), mock.Anything, mock.Anything).Return(nil).Once()
+			}
+
+			ctx := context.Background()
+			instanceProvider := instance.NewProvider(instance.NewAZClientFromAPI(agentPoolMocks, nil), mockK8sClient, nil,
+				pricing.NewProvider(ctx, &fake.PricingAPI{}, "eastus", make(chan struct{})), azurecache.NewUnavailableOfferings(),
+				"eastus", "testRG", "nodeRG", "testCluster")
+			c := New(nil, instanceProvider, mockK8sClient)
+
+			machine := tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{},
+				[]v1.NodeSelectorRequirement{{Key: v1.LabelInstanceTypeStable, Operator: v1.NodeSelectorOpIn, Values: []string{"Standard_NC6s_v3"}}})
+			machine.Annotations = tc.annotations
+			machine.Status.ProviderID = "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0"
+
+			drifted, err := c.IsMachineDrifted(ctx, machine)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, drifted)
+			mockK8sClient.AssertNumberOfCalls(t, "Patch", lo.Ternary(tc.expectedAnnotations != nil, 1, 0))
+		})
+	}
+}
+
+func TestGetMachineNotFound(t *testing.T) {
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0"
+	testCases := []struct {
+		name        string
+		mockGetResp func(ap armcontainerservice.AgentPool) (armcontainerservice.AgentPoolsClientGetResponse, error)
+	}{
+		{
+			name: "Agent pool is not found",
+			mockGetResp: func(_ armcontainerservice.AgentPool) (armcontainerservice.AgentPoolsClientGetResponse, error) {
+				return armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError()
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+			agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool0", gomock.Any()).Return(tc.mockGetResp(ap))
+
+			mockK8sClient := fake.NewClient()
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+			mockK8sClient.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+
+			ctx := context.Background()
+			instanceProvider := instance.NewProvider(instance.NewAZClientFromAPI(agentPoolMocks, nil), mockK8sClient, nil,
+				pricing.NewProvider(ctx, &fake.PricingAPI{}, "eastus", make(chan struct{})), azurecache.NewUnavailableOfferings(),
+				"eastus", "testRG", "nodeRG", "testCluster")
+			c := New(nil, instanceProvider, nil)
+
+			machine, err := c.Get(ctx, providerID)
+			assert.Nil(t, machine)
+			assert.True(t, corecloudprovider.IsMachineNotFoundError(err), "Expected a MachineNotFound error, got %v", err)
+		})
+	}
+}
+
+func TestGetWithoutInstanceTypes(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0"
+	ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool0", gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{AgentPool: ap}, nil)
+
+	mockK8sClient := fake.NewClient()
+	node := tests.ReadyNode
+	mockK8sClient.CreateMapWithType(&v1.NodeList{})[client.ObjectKeyFromObject(&node)] = &node
+	mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+	mockK8sClient.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+
+	ctx := context.Background()
+	pricingProvider := pricing.NewProvider(ctx, &fake.PricingAPI{}, "eastus", make(chan struct{}))
+	// the SKU catalog cannot be listed
+	instanceTypeProvider := instancetype.NewProvider("eastus", cache.New(instancetype.InstanceTypesCacheTTL, azurecache.DefaultCleanupInterval),
+		&fake.ResourceSKUsAPI{Error: errors.New("resource skus are throttled")}, pricingProvider, azurecache.NewUnavailableOfferings())
+	instanceProvider := instance.NewProvider(instance.NewAZClientFromAPI(agentPoolMocks, nil), mockK8sClient, nil, pricingProvider,
+		azurecache.NewUnavailableOfferings(), "eastus", "testRG", "nodeRG", "testCluster")
+	c := New(instanceTypeProvider, instanceProvider, nil)
+
+	machine, err := c.Get(ctx, providerID)
+	assert.NoError(t, err)
+	assert.Equal(t, providerID, machine.Status.ProviderID)
+	assert.Equal(t, "agentpool0", machine.Annotations[v1alpha1.AgentPoolNameAnnotationKey])
+	assert.Empty(t, machine.Status.Capacity)
+}
+
+func TestInstanceToMachine(t *testing.T) {
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-works4gx2ma-20562481-vmss/virtualMachines/0"
+	testCases := []struct {
+		name              string
+		tags              map[string]*string
+		nodeCount         int32
+		nodeIDs           []string
+		expectedName      string
+		expectedNodeCount string
+		expectedNodeIDs   string
+	}{
+		{
+			name:         "Machine name is read from the agent pool tags",
+			tags:         map[string]*string{instance.MachineNameTagKey: lo.ToPtr("workspace-falcon-7b")},
+			expectedName: "workspace-falcon-7b",
+		},
+		{
+			name:         "Agent pool without the tag is named after its machine",
+			expectedName: "works4gx2ma",
+		},
+		{
+			name:              "Node count of a multi-node agent pool is recorded on the machine",
+			nodeCount:         4,
+			expectedName:      "works4gx2ma",
+			expectedNodeCount: "4",
+		},
+		{
+			name:              "Provider ids of the nodes of a multi-node agent pool are recorded on the machine",
+			nodeCount:         2,
+			nodeIDs:           []string{providerID, strings.TrimSuffix(providerID, "0") + "1"},
+			expectedName:      "works4gx2ma",
+			expectedNodeCount: "2",
+			expectedNodeIDs:   providerID + "," + strings.TrimSuffix(providerID, "0") + "1",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := New(nil, nil, nil)
+			machine := c.instanceToMachine(context.Background(), &instance.Instance{
+				Name:      lo.ToPtr("works4gx2ma"),
+				ID:        lo.ToPtr(providerID),
+				Tags:      tc.tags,
+				Labels:    map[string]string{},
+				NodeCount: lo.ToPtr(lo.Ternary(tc.nodeCount == 0, int32(1), tc.nodeCount)),
+				NodeIDs:   tc.nodeIDs,
+			}, nil)
+			assert.Equal(t, tc.expectedName, machine.Name)
+			assert.Equal(t, tc.expectedNodeCount, machine.Annotations[v1alpha1.AgentPoolNodeCountAnnotationKey])
+			assert.Equal(t, tc.expectedNodeIDs, machine.Annotations[v1alpha1.AgentPoolNodeProviderIDsAnnotationKey])
+			assert.Equal(t, "works4gx2ma", machine.Annotations[v1alpha1.AgentPoolNameAnnotationKey])
+			assert.Equal(t, providerID, machine.Status.ProviderID)
+		})
+	}
+}
+
+func TestInstanceToMachineFromInstanceType(t *testing.T) {
+	ctx := context.Background()
+	pricingProvider := pricing.NewProvider(ctx, &fake.PricingAPI{}, "", make(chan struct{}))
+	instanceTypeProvider := instancetype.NewProvider("", cache.New(instancetype.InstanceTypesCacheTTL, azurecache.DefaultCleanupInterval),
+		&fake.ResourceSKUsAPI{}, pricingProvider, azurecache.NewUnavailableOfferings())
+	c := New(instanceTypeProvider, nil, nil)
+	instanceTypes := c.instanceTypesByName(ctx, nil)
+
+	machine := c.instanceToMachine(ctx, &instance.Instance{
+		Name:         lo.ToPtr("works4gx2ma"),
+		ID:           lo.ToPtr("azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-works4gx2ma-20562481-vmss/virtualMachines/0"),
+		Type:         lo.ToPtr("Standard_NC24ads_A100_v4"),
+		CapacityType: lo.ToPtr(v1alpha5.CapacityTypeSpot),
+		Zones:        []string{utils.MakeZone("", "3")},
+		Labels:       map[string]string{"kaito.sh/workspace": "falcon-7b"},
+	}, instanceTypes["Standard_NC24ads_A100_v4"])
+
+	assert.Equal(t, "Standard_NC24ads_A100_v4", machine.Labels[v1.LabelInstanceTypeStable])
+	assert.Equal(t, "amd64", machine.Labels[v1.LabelArchStable])
+	assert.Equal(t, "linux", machine.Labels[v1.LabelOSStable])
+	assert.Equal(t, "1", machine.Labels[v1alpha1.LabelSKUGPUCount])
+	assert.Equal(t, v1alpha5.CapacityTypeSpot, machine.Labels[v1alpha5.LabelCapacityType])
+	assert.Equal(t, utils.MakeZone("", "3"), machine.Labels[v1.LabelTopologyZone])
+	assert.Equal(t, "falcon-7b", machine.Labels["kaito.sh/workspace"])
+
+	assert.True(t, resource.MustParse("24").Equal(machine.Status.Capacity[v1.ResourceCPU]))
+	assert.True(t, resource.MustParse("1").Equal(machine.Status.Capacity["nvidia.com/gpu"]))
+	assert.Equal(t, -1, machine.Status.Allocatable.Cpu().Cmp(*machine.Status.Capacity.Cpu()), "allocatable cpu should be reduced by the overhead")
+}
@@ -0,0 +1,139 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cloudprovider
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/cloudprovider"
+	"github.com/aws/karpenter-core/pkg/scheduling"
+	"github.com/samber/lo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+// DriftReason describes why the agent pool backing a machine no longer matches it
+type DriftReason string
+
+const (
+	VMSizeDrift            DriftReason = "VMSizeDrift"
+	LabelsDrift            DriftReason = "LabelsDrift"
+	TaintsDrift            DriftReason = "TaintsDrift"
+	OSDiskSizeDrift        DriftReason = "OSDiskSizeDrift"
+	NodeImageVersionDrift  DriftReason = "NodeImageVersionDrift"
+	KubernetesVersionDrift DriftReason = "KubernetesVersionDrift"
+	noDrift                DriftReason = ""
+)
+
+// isDrifted compares the live agent pool with the machine spec and the versions it was provisioned with. It returns
+// the first drift reason found, or an empty reason if the agent pool is up to date.
+func (c *CloudProvider) isDrifted(ctx context.Context, machine *v1alpha5.Machine) (DriftReason, error) {
+	instanceObj, err := c.instanceProvider.Get(ctx, machine.Status.ProviderID)
+	if cloudprovider.IsMachineNotFoundError(err) {
+		// the agent pool is gone, garbage collection takes care of the machine
+		return noDrift, nil
+	}
+	if err != nil {
+		return noDrift, fmt.Errorf("getting instance, %w", err)
+	}
+	if instanceObj == nil || lo.FromPtr(instanceObj.State) == instance.ProvisioningStateCreating {
+		// the node is not ready yet, there is nothing to compare against
+		return noDrift, nil
+	}
+
+	if reason := specDrift(machine, instanceObj); reason != noDrift {
+		return reason, nil
+	}
+
+	// a new node image or a control plane upgrade does not drift the machine, only a change of the versions the agent
+	// pool runs compared with the ones it was provisioned with
+	versions := map[string]*string{
+		v1alpha1.AgentPoolNodeImageVersionAnnotationKey:  instanceObj.ImageID,
+		v1alpha1.AgentPoolKubernetesVersionAnnotationKey: instanceObj.OrchestratorVersion,
+	}
+	if err := c.recordVersions(ctx, machine, versions); err != nil {
+		return noDrift, err
+	}
+	if lo.FromPtr(instanceObj.ImageID) != machine.Annotations[v1alpha1.AgentPoolNodeImageVersionAnnotationKey] {
+		return NodeImageVersionDrift, nil
+	}
+	if !kubernetesVersionMatches(machine.Annotations[v1alpha1.AgentPoolKubernetesVersionAnnotationKey], lo.FromPtr(instanceObj.OrchestratorVersion)) {
+		return KubernetesVersionDrift, nil
+	}
+	return noDrift, nil
+}
+
+// recordVersions annotates the machine with the versions of its agent pool that are not recorded yet, the first
+// drift check after the agent pool is provisioned records the versions it was provisioned with
+func (c *CloudProvider) recordVersions(ctx context.Context, machine *v1alpha5.Machine, versions map[string]*string) error {
+	missing := lo.OmitBy(versions, func(k string, v *string) bool {
+		return machine.Annotations[k] != "" || v == nil
+	})
+	if len(missing) == 0 {
+		return nil
+	}
+	stored := machine.DeepCopy()
+	machine.Annotations = lo.Assign(machine.Annotations, lo.MapValues(missing, func(v *string, _ string) string { return *v }))
+	if err := c.kubeClient.Patch(ctx, machine, client.MergeFrom(stored)); client.IgnoreNotFound(err) != nil {
+		return fmt.Errorf("recording agent pool versions of machine %s, %w", machine.Name, err)
+	}
+	return nil
+}
+
+// kubernetesVersionMatches tells if the version the agent pool runs is the targeted one, a major.minor target such as
+// 1.27 matches any patch of it
+func kubernetesVersionMatches(target, current string) bool {
+	return current == target || strings.HasPrefix(current, target+".")
+}
+
+// specDrift compares the fields of the agent pool that were derived from the machine when it was created
+func specDrift(machine *v1alpha5.Machine, instanceObj *instance.Instance) DriftReason {
+	instanceTypes := scheduling.NewNodeSelectorRequirements(machine.Spec.Requirements...).Get(v1.LabelInstanceTypeStable)
+	if !instanceTypes.Has(lo.FromPtr(instanceObj.Type)) {
+		return VMSizeDrift
+	}
+
+	// karpenter-core adds well known and requirement labels to the machine after launch, only the user defined
+	// labels are passed to the agent pool
+	for k, v := range machine.Labels {
+		if v1alpha5.IsRestrictedNodeLabel(k) {
+			continue
+		}
+		if apValue, ok := instanceObj.Labels[k]; !ok || apValue != v {
+			return LabelsDrift
+		}
+	}
+
+	taints := sets.NewString(lo.Map(machine.Spec.Taints, func(t v1.Taint, _ int) string { return instance.FormatTaint(t) })...)
+	if !taints.Equal(sets.NewString(instanceObj.Taints...).Delete(instance.SpotTaint)) {
+		return TaintsDrift
+	}
+
+	// without a storage request the agent pool gets the AKS default OS disk size
+	if storage, ok := machine.Spec.Resources.Requests[v1.ResourceStorage]; ok {
+		if instance.ToOSDiskSizeGB(storage) != lo.FromPtr(instanceObj.OSDiskSizeGB) {
+			return OSDiskSizeDrift
+		}
+	}
+	return noDrift
+}
@@ -17,28 +17,79 @@ package cloudprovider
 
 import (
 	"context"
+	"strconv"
+	"strings"
 
 	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/cloudprovider"
+	"github.com/aws/karpenter-core/pkg/utils/resources"
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
 	"github.com/azure/gpu-provisioner/pkg/providers/instance"
 	"github.com/samber/lo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"knative.dev/pkg/logging"
 )
 
-func (c *CloudProvider) instanceToMachine(ctx context.Context, instanceObj *instance.Instance) *v1alpha5.Machine {
+// instanceTypesByName returns the instance types of the SKU catalog by name, the instance types are cached by the
+// instance type provider. The catalog only fills in the details of the machines, so if it cannot be listed the error is
+// logged and no instance types are returned.
+func (c *CloudProvider) instanceTypesByName(ctx context.Context, kc *v1alpha5.KubeletConfiguration) map[string]*cloudprovider.InstanceType {
+	instanceTypes, err := c.instanceTypeProvider.List(ctx, kc)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("listing instance types, %s", err)
+		return nil
+	}
+	return lo.KeyBy(instanceTypes, func(it *cloudprovider.InstanceType) string { return it.Name })
+}
+
+// instanceToMachine returns the machine of the instance. The capacity, allocatable and the labels that have a single
+// value are taken from the instance type, which is nil if the SKU of the instance is not in the catalog. The labels,
+// capacity type and zone of the agent pool take precedence.
+func (c *CloudProvider) instanceToMachine(ctx context.Context, instanceObj *instance.Instance, instanceType *cloudprovider.InstanceType) *v1alpha5.Machine {
 	machine := &v1alpha5.Machine{}
-	labels := instanceObj.Labels
+	labels := map[string]string{}
 	annotations := map[string]string{}
 
-	machine.Name = lo.FromPtr(instanceObj.Name)
+	if instanceType != nil {
+		for key, req := range instanceType.Requirements {
+			if req.Len() == 1 {
+				labels[key] = req.Values()[0]
+			}
+		}
+		machine.Status.Capacity = lo.PickBy(instanceType.Capacity, func(_ v1.ResourceName, v resource.Quantity) bool { return !resources.IsZero(v) })
+		machine.Status.Allocatable = lo.PickBy(instanceType.Allocatable(), func(_ v1.ResourceName, v resource.Quantity) bool { return !resources.IsZero(v) })
+	} else {
+		logging.FromContext(ctx).Warnf("instance type %s of agent pool %s not found in the SKU catalog", lo.FromPtr(instanceObj.Type), lo.FromPtr(instanceObj.Name))
+	}
+	labels = lo.Assign(labels, instanceObj.Labels)
+	if len(instanceObj.Zones) == 1 {
+		labels[v1.LabelTopologyZone] = instanceObj.Zones[0]
+	}
+
+	machine.Name = instanceObj.MachineName()
+	annotations[v1alpha1.AgentPoolNameAnnotationKey] = lo.FromPtr(instanceObj.Name)
+	if instanceObj.CreateResumeToken != nil {
+		annotations[v1alpha1.AgentPoolCreateResumeTokenAnnotationKey] = *instanceObj.CreateResumeToken
+	}
+	if instanceObj.OSSKU != nil {
+		annotations[v1alpha1.AgentPoolOSSKUAnnotationKey] = *instanceObj.OSSKU
+	}
+	if nodeCount := lo.FromPtr(instanceObj.NodeCount); nodeCount > 1 {
+		annotations[v1alpha1.AgentPoolNodeCountAnnotationKey] = strconv.Itoa(int(nodeCount))
+		if len(instanceObj.NodeIDs) > 0 {
+			annotations[v1alpha1.AgentPoolNodeProviderIDsAnnotationKey] = strings.Join(instanceObj.NodeIDs, ",")
+		}
+	}
 
 	if instanceObj.CapacityType != nil {
 		labels[v1alpha5.LabelCapacityType] = *instanceObj.CapacityType
 	}
 
-	if v, ok := instanceObj.Tags[v1alpha5.ProvisionerNameLabelKey]; ok {
+	if v, ok := instanceObj.Tags[instance.ProvisionerNameTagKey]; ok {
 		labels[v1alpha5.ProvisionerNameLabelKey] = *v
 	}
-	if v, ok := instanceObj.Tags[v1alpha5.MachineManagedByAnnotationKey]; ok {
+	if v, ok := instanceObj.Tags[instance.ManagedByTagKey]; ok {
 		annotations[v1alpha5.MachineManagedByAnnotationKey] = *v
 	}
 
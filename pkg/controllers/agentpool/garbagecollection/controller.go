@@ -0,0 +1,137 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollection
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/cloudprovider"
+	"github.com/aws/karpenter-core/pkg/events"
+	"github.com/aws/karpenter-core/pkg/metrics"
+	corecontroller "github.com/aws/karpenter-core/pkg/operator/controller"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samber/lo"
+	"go.uber.org/multierr"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
+	"knative.dev/pkg/logging"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+const (
+	// orphanGracePeriod is how long an owned agent pool has to be seen without its machine before it is deleted. It
+	// covers a stale machine cache and machines whose deletion of the agent pool is still in flight.
+	orphanGracePeriod = 5 * time.Minute
+
+	provisioningStateDeleting = "Deleting"
+)
+
+// Controller deletes the agent pools owned by the controller whose machine no longer exists. Such agent pools are
+// left behind when the controller restarts or the deletion fails after the machine is gone, and would keep their GPU
+// nodes running forever.
+type Controller struct {
+	clock            clock.Clock
+	kubeClient       client.Client
+	instanceProvider *instance.Provider
+	recorder         events.Recorder
+
+	// orphanedSince records when each agent pool was first seen without its machine, only the singleton reconciler
+	// accesses it
+	orphanedSince map[string]time.Time
+}
+
+func NewController(clk clock.Clock, kubeClient client.Client, instanceProvider *instance.Provider, recorder events.Recorder) *Controller {
+	return &Controller{
+		clock:            clk,
+		kubeClient:       kubeClient,
+		instanceProvider: instanceProvider,
+		recorder:         recorder,
+		orphanedSince:    map[string]time.Time{},
+	}
+}
+
+func (c *Controller) Name() string {
+	return "agentpool.garbagecollection"
+}
+
+func (c *Controller) Reconcile(ctx context.Context, _ reconcile.Request) (reconcile.Result, error) {
+	machineList := &v1alpha5.MachineList{}
+	if err := c.kubeClient.List(ctx, machineList); err != nil {
+		return reconcile.Result{}, fmt.Errorf("listing machines, %w", err)
+	}
+	machines := lo.KeyBy(machineList.Items, func(m v1alpha5.Machine) string { return m.Name })
+	instances, err := c.instanceProvider.ListOwned(ctx)
+	if err != nil {
+		return reconcile.Result{}, fmt.Errorf("listing agent pools, %w", err)
+	}
+
+	now := c.clock.Now()
+	orphanedSince := map[string]time.Time{}
+	var orphans []*instance.Instance
+	for _, inst := range lo.Filter(instances, func(inst *instance.Instance, _ int) bool { return isOrphaned(inst, machines) }) {
+		since, ok := c.orphanedSince[lo.FromPtr(inst.Name)]
+		if !ok {
+			since = now
+		}
+		orphanedSince[lo.FromPtr(inst.Name)] = since
+		if now.Sub(since) >= orphanGracePeriod {
+			orphans = append(orphans, inst)
+		}
+	}
+	c.orphanedSince = orphanedSince
+
+	errs := make([]error, len(orphans))
+	workqueue.ParallelizeUntil(ctx, 20, len(orphans), func(i int) {
+		if err := c.instanceProvider.DeleteAgentPool(ctx, lo.FromPtr(orphans[i].Name)); err != nil {
+			errs[i] = cloudprovider.IgnoreMachineNotFoundError(err)
+			return
+		}
+		logging.FromContext(ctx).
+			With("agentpool", lo.FromPtr(orphans[i].Name), "machine", orphans[i].MachineName()).
+			Infof("garbage collected agent pool with no machine")
+		c.recorder.Publish(AgentPoolGarbageCollectedEvent(orphans[i]))
+		AgentPoolsGarbageCollectedCounter.With(prometheus.Labels{
+			metrics.ProvisionerLabel: lo.FromPtr(orphans[i].Tags[instance.ProvisionerNameTagKey]),
+		}).Inc()
+	})
+	return reconcile.Result{RequeueAfter: time.Minute}, multierr.Combine(errs...)
+}
+
+func (c *Controller) Builder(_ context.Context, m manager.Manager) corecontroller.Builder {
+	return corecontroller.NewSingletonManagedBy(m)
+}
+
+// isOrphaned returns true if the machine the agent pool was created for no longer exists. A machine that is being
+// deleted still owns its agent pool, its termination deletes it.
+func isOrphaned(inst *instance.Instance, machines map[string]v1alpha5.Machine) bool {
+	if lo.FromPtr(inst.State) == provisioningStateDeleting {
+		return false
+	}
+	machine, ok := machines[inst.MachineName()]
+	if !ok {
+		return true
+	}
+	// a machine recreated with the same name does not own the agent pool of the machine it replaced
+	uid := lo.FromPtr(inst.Tags[instance.MachineUIDTagKey])
+	return uid != "" && uid != string(machine.UID)
+}
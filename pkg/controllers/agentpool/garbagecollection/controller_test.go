@@ -0,0 +1,159 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollection
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/events"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/mock/gomock"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/azure/gpu-provisioner/pkg/cache"
+	"github.com/azure/gpu-provisioner/pkg/fake"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+	"github.com/azure/gpu-provisioner/pkg/tests"
+)
+
+func TestReconcile(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	agentPools := []*armcontainerservice.AgentPool{
+		// owned by an existing machine
+		agentPool("kept", map[string]*string{instance.MachineNameTagKey: to.Ptr("kept"), instance.MachineUIDTagKey: to.Ptr("kept-uid")}, ""),
+		// its machine was deleted
+		agentPool("orphan", map[string]*string{instance.MachineNameTagKey: to.Ptr("deleted-machine"), instance.MachineUIDTagKey: to.Ptr("deleted-uid")}, ""),
+		// its machine was recreated with the same name
+		agentPool("replaced", map[string]*string{instance.MachineNameTagKey: to.Ptr("replaced"), instance.MachineUIDTagKey: to.Ptr("old-uid")}, ""),
+		// its machine was deleted and the agent pool is already being deleted
+		agentPool("deleting", map[string]*string{instance.MachineNameTagKey: to.Ptr("deleting")}, provisioningStateDeleting),
+		// not created by the controller
+		{Name: to.Ptr("nodepool1"), Properties: &armcontainerservice.ManagedClusterAgentPoolProfileProperties{}},
+		// labelled like the agent pools created before the ownership tags existed, but without a machine
+		legacyAgentPool("labelled"),
+		// created before the ownership tags existed for an existing machine
+		legacyAgentPool("legacy"),
+	}
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().NewListPager(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(_, _ string, _ *armcontainerservice.AgentPoolsClientListOptions) *runtime.Pager[armcontainerservice.AgentPoolsClientListResponse] {
+			return runtime.NewPager(runtime.PagingHandler[armcontainerservice.AgentPoolsClientListResponse]{
+				More: func(armcontainerservice.AgentPoolsClientListResponse) bool { return false },
+				Fetcher: func(context.Context, *armcontainerservice.AgentPoolsClientListResponse) (armcontainerservice.AgentPoolsClientListResponse, error) {
+					return armcontainerservice.AgentPoolsClientListResponse{AgentPoolListResult: armcontainerservice.AgentPoolListResult{Value: agentPools}}, nil
+				},
+			})
+		}).AnyTimes()
+	for _, apName := range []string{"orphan", "replaced"} {
+		agentPoolMocks.EXPECT().BeginDelete(gomock.Any(), gomock.Any(), gomock.Any(), apName, gomock.Any()).DoAndReturn(
+			func(_ context.Context, _, _, _ string, _ *armcontainerservice.AgentPoolsClientBeginDeleteOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientDeleteResponse], error) {
+				mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientDeleteResponse](mockCtrl)
+				mockHandler.EXPECT().Done().Return(true).AnyTimes()
+				mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(nil)
+				return runtime.NewPoller(&http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil),
+					&runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientDeleteResponse]{Handler: mockHandler, Response: &armcontainerservice.AgentPoolsClientDeleteResponse{}})
+			})
+	}
+
+	// the legacy agent pool of the existing machine is tagged once
+	agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), "legacy", gomock.Any(), gomock.Any()).Return(nil, nil)
+
+	mockK8sClient := fake.NewClient()
+	machines := mockK8sClient.CreateMapWithType(&v1alpha5.MachineList{})
+	for name, uid := range map[string]string{"kept": "kept-uid", "replaced": "new-uid", "legacy": "legacy-uid"} {
+		machine := &v1alpha5.Machine{ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID(uid)}}
+		machines[types.NamespacedName{Name: name}] = machine
+		mockK8sClient.CreateOrUpdateObjectInMap(machine)
+	}
+	mockK8sClient.On("List", mock.Anything, mock.IsType(&v1alpha5.MachineList{}), mock.Anything).Return(nil)
+	mockK8sClient.On("Get", mock.Anything, types.NamespacedName{Name: "legacy"}, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+	mockK8sClient.On("Get", mock.Anything, types.NamespacedName{Name: "labelled"}, mock.IsType(&v1alpha5.Machine{}), mock.Anything).
+		Return(apierrors.NewNotFound(schema.GroupResource{Resource: "machines"}, "labelled"))
+
+	clk := clocktesting.NewFakeClock(time.Now())
+	recorder := &eventRecorder{}
+	instanceProvider := instance.NewProvider(instance.NewAZClientFromAPI(agentPoolMocks, nil), mockK8sClient, nil, nil, cache.NewUnavailableOfferings(), "eastus", "testRG", "nodeRG", "testCluster")
+	c := NewController(clk, mockK8sClient, instanceProvider, recorder)
+
+	// the orphaned agent pools are only deleted once the grace period passed
+	_, err := c.Reconcile(context.Background(), reconcile.Request{})
+	assert.NoError(t, err)
+	assert.Empty(t, recorder.reasons())
+	assert.Len(t, c.orphanedSince, 2)
+
+	clk.Step(orphanGracePeriod)
+	before := testutil.ToFloat64(AgentPoolsGarbageCollectedCounter.WithLabelValues("default"))
+	_, err = c.Reconcile(context.Background(), reconcile.Request{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"AgentPoolGarbageCollected", "AgentPoolGarbageCollected"}, recorder.reasons())
+	assert.Equal(t, before+2, testutil.ToFloat64(AgentPoolsGarbageCollectedCounter.WithLabelValues("default")))
+}
+
+func agentPool(name string, tags map[string]*string, state string) *armcontainerservice.AgentPool {
+	ap := tests.GetAgentPoolObjWithName(name, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-"+name+"-20562481-vmss", "Standard_NC6s_v3")
+	ap.Properties.Tags = tags
+	ap.Properties.Tags[instance.ManagedByTagKey] = to.Ptr("testCluster")
+	ap.Properties.Tags[instance.ProvisionerNameTagKey] = to.Ptr("default")
+	if state != "" {
+		ap.Properties.ProvisioningState = to.Ptr(state)
+	}
+	return &ap
+}
+
+func legacyAgentPool(name string) *armcontainerservice.AgentPool {
+	ap := tests.GetAgentPoolObjWithName(name, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-"+name+"-20562481-vmss", "Standard_NC6s_v3")
+	ap.Properties.NodeLabels[v1alpha5.ProvisionerNameLabelKey] = to.Ptr("default")
+	return &ap
+}
+
+// eventRecorder records the reasons of the published events
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []events.Event
+}
+
+func (r *eventRecorder) Publish(evts ...events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, evts...)
+}
+
+func (r *eventRecorder) reasons() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var reasons []string
+	for _, evt := range r.events {
+		reasons = append(reasons, evt.Reason)
+	}
+	return reasons
+}
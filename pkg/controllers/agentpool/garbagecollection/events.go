@@ -0,0 +1,44 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollection
+
+import (
+	"fmt"
+
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/events"
+	"github.com/samber/lo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+// AgentPoolGarbageCollectedEvent is published for the machine the deleted agent pool was created for. The machine no
+// longer exists, the event is still listed for its name.
+func AgentPoolGarbageCollectedEvent(inst *instance.Instance) events.Event {
+	return events.Event{
+		InvolvedObject: &v1alpha5.Machine{ObjectMeta: metav1.ObjectMeta{
+			Name: inst.MachineName(),
+			UID:  types.UID(lo.FromPtr(inst.Tags[instance.MachineUIDTagKey])),
+		}},
+		Type:         v1.EventTypeNormal,
+		Reason:       "AgentPoolGarbageCollected",
+		Message:      fmt.Sprintf("Deleted agent pool %s that has no machine", lo.FromPtr(inst.Name)),
+		DedupeValues: []string{lo.FromPtr(inst.Name)},
+	}
+}
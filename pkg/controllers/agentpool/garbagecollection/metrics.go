@@ -0,0 +1,38 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package garbagecollection
+
+import (
+	"github.com/aws/karpenter-core/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	crmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var AgentPoolsGarbageCollectedCounter = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "agentpools",
+		Name:      "garbage_collected",
+		Help:      "Number of agent pools deleted because their machine no longer exists. Labeled by the provisioner of the machine.",
+	},
+	[]string{
+		metrics.ProvisionerLabel,
+	},
+)
+
+func init() {
+	crmetrics.Registry.MustRegister(AgentPoolsGarbageCollectedCounter)
+}
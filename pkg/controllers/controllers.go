@@ -0,0 +1,35 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"github.com/aws/karpenter-core/pkg/events"
+	"github.com/aws/karpenter-core/pkg/operator/controller"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/azure/gpu-provisioner/pkg/controllers/agentpool/garbagecollection"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+// NewControllers returns the Azure specific controllers, they run next to the karpenter-core controllers
+func NewControllers(ctx context.Context, clk clock.Clock, kubeClient client.Client, recorder events.Recorder, instanceProvider *instance.Provider) []controller.Controller {
+	return []controller.Controller{
+		garbagecollection.NewController(clk, kubeClient, instanceProvider, recorder),
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"reflect"
 
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
 	"github.com/stretchr/testify/mock"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
@@ -115,6 +116,14 @@ func (m *MockClient) getObjectListFromMap(list k8sClient.ObjectList) k8sClient.O
 			}
 		}
 		return nodeList
+	case *v1alpha5.MachineList:
+		machineList := &v1alpha5.MachineList{}
+		for _, obj := range relevantMap {
+			if machine, ok := obj.(*v1alpha5.Machine); ok {
+				machineList.Items = append(machineList.Items, *machine)
+			}
+		}
+		return machineList
 	}
 	//add additional object lists as needed
 	return nil
@@ -18,6 +18,7 @@ package fake
 import (
 	"context"
 	"errors"
+	"strings"
 
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing/client"
 )
@@ -29,14 +30,17 @@ type PricingAPI struct {
 type PricingBehavior struct {
 	NextError         AtomicError
 	ProductsPricePage AtomicPtr[client.ProductsPricePage]
+	FiltersInput      AtomicPtrStack[[]*client.Filter]
 }
 
 func (p *PricingAPI) Reset() {
 	p.NextError.Reset()
 	p.ProductsPricePage.Reset()
+	p.FiltersInput.Reset()
 }
 
-func (p *PricingAPI) GetProductsPricePages(_ context.Context, _ []*client.Filter, fn func(output *client.ProductsPricePage)) error {
+func (p *PricingAPI) GetProductsPricePages(_ context.Context, filters []*client.Filter, fn func(output *client.ProductsPricePage)) error {
+	p.FiltersInput.Add(&filters)
 	if !p.NextError.IsNil() {
 		return p.NextError.Get()
 	}
@@ -52,5 +56,33 @@ func NewProductPrice(instanceType string, price float64) client.Item {
 	return client.Item{
 		ArmSkuName:  instanceType,
 		RetailPrice: price,
+		Type:        "Consumption",
+	}
+}
+
+func NewReservationProductPrice(instanceType string, term string, price float64) client.Item {
+	return client.Item{
+		ArmSkuName:      instanceType,
+		RetailPrice:     price,
+		Type:            "Reservation",
+		ReservationTerm: term,
+	}
+}
+
+func NewSavingsPlanProductPrice(instanceType string, price float64, oneYearPrice float64) client.Item {
+	item := NewProductPrice(instanceType, price)
+	item.SavingsPlan = []client.SavingsPlan{
+		{RetailPrice: oneYearPrice, UnitPrice: oneYearPrice, Term: "1 Year"},
+		{RetailPrice: oneYearPrice / 2, UnitPrice: oneYearPrice / 2, Term: "3 Years"},
+	}
+	return item
+}
+
+func NewSpotProductPrice(instanceType string, price float64) client.Item {
+	return client.Item{
+		ArmSkuName:  instanceType,
+		SkuName:     strings.TrimPrefix(instanceType, "Standard_") + " Spot",
+		RetailPrice: price,
+		Type:        "Consumption",
 	}
 }
@@ -30,6 +30,9 @@ var _ skewer.ResourceClient = &ResourceSKUsAPI{}
 
 type ResourceSKUsAPI struct {
 	// skewer.ResourceClient
+
+	// Error is returned by ListComplete instead of the SKUs if it is set
+	Error error
 }
 
 // Reset must be called between tests otherwise tests will pollute each other.
@@ -38,6 +41,9 @@ func (s *ResourceSKUsAPI) Reset() {
 }
 
 func (s *ResourceSKUsAPI) ListComplete(_ context.Context, _, _ string) (compute.ResourceSkusResultIterator, error) {
+	if s.Error != nil {
+		return compute.ResourceSkusResultIterator{}, s.Error
+	}
 	return compute.NewResourceSkusResultIterator(
 		compute.NewResourceSkusResultPage(
 			// cur
@@ -0,0 +1,145 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"knative.dev/pkg/logging"
+
+	"github.com/azure/gpu-provisioner/pkg/auth"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+// azClientBackoff spaces out the attempts to build the Azure clients after a failed startup
+var azClientBackoff = wait.Backoff{
+	Duration: 5 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    math.MaxInt32,
+	Cap:      5 * time.Minute,
+}
+
+// azClientBuilder builds the Azure clients in the background until it succeeds, so an invalid config or a transient
+// AAD outage at startup is reported by the cloud-provider readiness check instead of crashing the controller
+type azClientBuilder struct {
+	cloudConfigPath string
+	// config is the config the providers were created with, nil if it was invalid at startup
+	config *auth.Config
+	// azClient is the reloadable client handed to the providers
+	azClient    *instance.AZClient
+	newAZClient func(*auth.Config) (*instance.AZClient, error)
+	// configure points the providers at the config once a config that was invalid at startup has been fixed
+	configure func(*auth.Config) error
+	backoff   wait.Backoff
+
+	mu  sync.RWMutex
+	err error
+}
+
+func newAZClientBuilder(cloudConfigPath string, config *auth.Config, azClient *instance.AZClient) *azClientBuilder {
+	return &azClientBuilder{
+		cloudConfigPath: cloudConfigPath,
+		config:          config,
+		azClient:        azClient,
+		newAZClient:     instance.CreateAzClient,
+		configure:       func(*auth.Config) error { return nil },
+		backoff:         azClientBackoff,
+		err:             instance.ErrAZClientNotReady,
+	}
+}
+
+// Start builds the Azure clients, retrying with backoff until it succeeds, then watches the cloud config file for
+// changes if one was passed
+func (b *azClientBuilder) Start(ctx context.Context) {
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).Named("azure-client"))
+	go func() {
+		backoff := b.backoff
+		for {
+			err := b.build()
+			if err == nil {
+				break
+			}
+			delay := backoff.Step()
+			logging.FromContext(ctx).Errorf("building Azure client, retrying in %s, %s", delay.Round(time.Second), err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+		}
+		logging.FromContext(ctx).Infof("built Azure client")
+		if b.cloudConfigPath != "" {
+			newCloudConfigWatcher(b.cloudConfigPath, b.config, b.azClient).Start(ctx)
+		}
+	}()
+}
+
+// build makes one attempt at building the Azure clients, the error is kept for the health check
+func (b *azClientBuilder) build() error {
+	err := b.tryBuild()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+	return err
+}
+
+func (b *azClientBuilder) tryBuild() error {
+	config, err := GetAzConfig(b.cloudConfigPath)
+	if err != nil {
+		return fmt.Errorf("creating Azure config, %w", err)
+	}
+	// the providers were created with the location and resource groups of the startup config
+	if b.config != nil {
+		if fields := restartRequired(b.config, config); len(fields) > 0 {
+			return fmt.Errorf("changes to %s require a restart of the controller", strings.Join(fields, ", "))
+		}
+	}
+	azClient, err := b.newAZClient(config)
+	if err != nil {
+		err = fmt.Errorf("creating Azure client, %w", err)
+		if config.CredentialMode == "" || config.CredentialMode == auth.CredentialModeWorkloadIdentity {
+			err = fmt.Errorf("%w, ensure the federated credential has been created for identity %s", err, config.UserAssignedIdentityID)
+		}
+		return err
+	}
+	if b.config == nil {
+		// the providers were created from an invalid config, they are pointed at the fixed one before the clients
+		// become available to them
+		if err := b.configure(config); err != nil {
+			return err
+		}
+	}
+	if err := b.azClient.Reload(azClient); err != nil {
+		return err
+	}
+	b.config = config
+	return nil
+}
+
+// ReadinessProbe fails with the reason of the last attempt until the Azure clients have been built
+func (b *azClientBuilder) ReadinessProbe(_ *http.Request) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.err
+}
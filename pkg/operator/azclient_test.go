@@ -0,0 +1,115 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"github.com/azure/gpu-provisioner/pkg/auth"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+func TestAZClientBuilder(t *testing.T) {
+	for _, key := range []string{"LOCATION", "ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "AZURE_TENANT_ID", "AZURE_CLUSTER_NAME", "AZURE_NODE_RESOURCE_GROUP"} {
+		t.Setenv(key, "")
+	}
+	path := filepath.Join(t.TempDir(), "cloud-config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(cloudConfig), 0600))
+	config, err := auth.BuildAzureConfig(path)
+	assert.NoError(t, err)
+
+	azClient := instance.NewReloadableAZClient(nil)
+	_, err = azClient.SKUClient.ListComplete(context.Background(), "", "")
+	assert.ErrorIs(t, err, instance.ErrAZClientNotReady)
+
+	builder := newAZClientBuilder(path, config, azClient)
+	builder.backoff = wait.Backoff{Duration: time.Millisecond, Steps: 1}
+	assert.ErrorIs(t, builder.ReadinessProbe(nil), instance.ErrAZClientNotReady)
+
+	skuClient := &countingSKUClient{}
+	attempts := make(chan int, 3)
+	builder.newAZClient = func(cfg *auth.Config) (*instance.AZClient, error) {
+		attempts <- len(attempts)
+		if len(attempts) < 3 {
+			return nil, errors.New("aad is down")
+		}
+		return instance.NewAZClientFromAPI(nil, skuClient), nil
+	}
+
+	// the first attempts fail and are reported by the health check
+	assert.ErrorContains(t, builder.build(), "aad is down")
+	assert.ErrorContains(t, builder.ReadinessProbe(nil), "ensure the federated credential has been created")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	builder.Start(ctx)
+	assert.Eventually(t, func() bool { return builder.ReadinessProbe(nil) == nil }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = azClient.SKUClient.ListComplete(context.Background(), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, skuClient.calls)
+}
+
+func TestAZClientBuilderInvalidStartupConfig(t *testing.T) {
+	for _, key := range []string{"LOCATION", "ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "AZURE_TENANT_ID", "AZURE_CLUSTER_NAME", "AZURE_NODE_RESOURCE_GROUP"} {
+		t.Setenv(key, "")
+	}
+	path := filepath.Join(t.TempDir(), "cloud-config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("location: eastus\n"), 0600))
+	_, err := auth.BuildAzureConfig(path)
+	assert.Error(t, err)
+
+	skuClient := &countingSKUClient{}
+	azClient := instance.NewReloadableAZClient(nil)
+	builder := newAZClientBuilder(path, nil, azClient)
+	builder.newAZClient = func(cfg *auth.Config) (*instance.AZClient, error) {
+		return instance.NewAZClientFromAPI(nil, skuClient), nil
+	}
+	var configured []*auth.Config
+	builder.configure = func(cfg *auth.Config) error {
+		configured = append(configured, cfg)
+		return nil
+	}
+	assert.ErrorContains(t, builder.build(), "creating Azure config")
+	assert.ErrorContains(t, builder.ReadinessProbe(nil), "creating Azure config")
+	assert.Empty(t, configured)
+
+	// the providers were created without a location, they are pointed at the fixed config
+	assert.NoError(t, os.WriteFile(path, []byte(cloudConfig), 0600))
+	assert.NoError(t, builder.build())
+	assert.NoError(t, builder.ReadinessProbe(nil))
+	assert.Len(t, configured, 1)
+	assert.Equal(t, "eastus", configured[0].Location)
+	assert.Equal(t, "eastus", builder.config.Location)
+
+	_, err = azClient.SKUClient.ListComplete(context.Background(), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, skuClient.calls)
+
+	// once configured, the location is again only read at startup
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Replace(cloudConfig, "location: eastus", "location: westus", 1)), 0600))
+	assert.ErrorContains(t, builder.build(), "changes to location require a restart")
+	assert.Len(t, configured, 1)
+}
@@ -0,0 +1,167 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"knative.dev/pkg/logging"
+
+	"github.com/azure/gpu-provisioner/pkg/auth"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+const (
+	cloudConfigFlag = "cloud-config"
+	// cloudConfigEnv is used when the flag is not passed
+	cloudConfigEnv = "AZURE_CLOUD_CONFIG"
+	// cloudConfigPollPeriod is how often the cloud config file is checked for changes, the kubelet takes about a
+	// minute to update a mounted secret
+	cloudConfigPollPeriod = 30 * time.Second
+)
+
+// ExtractCloudConfigFlag returns the path passed with --cloud-config and removes the flag from os.Args. It has to be
+// called before karpenter-core parses its flags, which fails on flags it does not know.
+func ExtractCloudConfigFlag() string {
+	path, args := extractFlag(os.Args[1:], cloudConfigFlag)
+	os.Args = append(os.Args[:1], args...)
+	if path == "" {
+		path = os.Getenv(cloudConfigEnv)
+	}
+	return path
+}
+
+// extractFlag returns the value of the flag, in any of the -flag=value, --flag=value, -flag value and --flag value
+// forms, and the remaining args
+func extractFlag(args []string, name string) (string, []string) {
+	var value string
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i:]...)
+			break
+		}
+		flagName := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		switch {
+		case flagName == name && i+1 < len(args):
+			value = args[i+1]
+			i++
+		case strings.HasPrefix(flagName, name+"=") && flagName != arg:
+			value = strings.TrimPrefix(flagName, name+"=")
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	return value, rest
+}
+
+// cloudConfigWatcher rebuilds the Azure clients when the content of the cloud config file changes, so the subscription
+// and identity settings can be rotated by updating the mounted secret
+type cloudConfigWatcher struct {
+	path        string
+	config      *auth.Config
+	content     []byte
+	azClient    *instance.AZClient
+	newAZClient func(*auth.Config) (*instance.AZClient, error)
+}
+
+func newCloudConfigWatcher(path string, config *auth.Config, azClient *instance.AZClient) *cloudConfigWatcher {
+	content, _ := os.ReadFile(path)
+	return &cloudConfigWatcher{
+		path:        path,
+		config:      config,
+		content:     content,
+		azClient:    azClient,
+		newAZClient: instance.CreateAzClient,
+	}
+}
+
+func (w *cloudConfigWatcher) Start(ctx context.Context) {
+	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).Named("cloud-config"))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(cloudConfigPollPeriod):
+				if err := w.reload(ctx); err != nil {
+					logging.FromContext(ctx).Errorf("reloading cloud config %s, %s", w.path, err)
+				}
+			}
+		}
+	}()
+}
+
+// reload rebuilds the Azure clients if the cloud config file changed. The location, cluster and resource groups are
+// passed to the providers at startup, changing them requires a restart.
+func (w *cloudConfigWatcher) reload(ctx context.Context) error {
+	content, err := os.ReadFile(w.path)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(content, w.content) {
+		return nil
+	}
+	// an invalid config is only reported once, the clients keep using the previous config
+	w.content = content
+
+	config, err := auth.BuildAzureConfig(w.path)
+	if err != nil {
+		return err
+	}
+	if fields := restartRequired(w.config, config); len(fields) > 0 {
+		// the clients keep using the previous config, rebuilding them from part of the new one would mix both
+		logging.FromContext(ctx).Errorf("cloud config changes to %s require a restart and are ignored until then", strings.Join(fields, ", "))
+		return nil
+	}
+	azClient, err := w.newAZClient(config)
+	if err != nil {
+		return fmt.Errorf("creating Azure client, %w", err)
+	}
+	if err := w.azClient.Reload(azClient); err != nil {
+		return err
+	}
+	w.config = config
+	logging.FromContext(ctx).Infof("reloaded cloud config %s", w.path)
+	return nil
+}
+
+// restartRequired returns the fields that changed but are only read at startup
+func restartRequired(old, new *auth.Config) []string {
+	var fields []string
+	if old.Location != new.Location {
+		fields = append(fields, "location")
+	}
+	if old.ResourceGroup != new.ResourceGroup {
+		fields = append(fields, "resourceGroup")
+	}
+	if old.ClusterName != new.ClusterName {
+		fields = append(fields, "clusterName")
+	}
+	if old.NodeResourceGroup != new.NodeResourceGroup {
+		fields = append(fields, "nodeResourceGroup")
+	}
+	if old.Cloud != new.Cloud || old.CloudEnvironmentFile != new.CloudEnvironmentFile {
+		fields = append(fields, "cloud")
+	}
+	return fields
+}
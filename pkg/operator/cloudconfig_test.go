@@ -0,0 +1,175 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package operator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	//nolint SA1019 - deprecated package
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/azure/gpu-provisioner/pkg/auth"
+	"github.com/azure/gpu-provisioner/pkg/providers/instance"
+)
+
+func TestExtractFlag(t *testing.T) {
+	tests := []struct {
+		name          string
+		args          []string
+		expectedValue string
+		expectedArgs  []string
+	}{
+		{
+			name:         "not set",
+			args:         []string{"--leader-elect=false"},
+			expectedArgs: []string{"--leader-elect=false"},
+		},
+		{
+			name:          "separate value",
+			args:          []string{"--cloud-config", "/etc/azure/config.yaml", "--leader-elect=false"},
+			expectedValue: "/etc/azure/config.yaml",
+			expectedArgs:  []string{"--leader-elect=false"},
+		},
+		{
+			name:          "single dash with equals",
+			args:          []string{"--leader-elect=false", "-cloud-config=/etc/azure/config.json"},
+			expectedValue: "/etc/azure/config.json",
+			expectedArgs:  []string{"--leader-elect=false"},
+		},
+		{
+			name:         "after the terminator",
+			args:         []string{"--", "--cloud-config=/etc/azure/config.json"},
+			expectedArgs: []string{"--", "--cloud-config=/etc/azure/config.json"},
+		},
+		{
+			name:         "other flag with the same prefix",
+			args:         []string{"--cloud-config-dir=/etc/azure"},
+			expectedArgs: []string{"--cloud-config-dir=/etc/azure"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, args := extractFlag(tc.args, cloudConfigFlag)
+			assert.Equal(t, tc.expectedValue, value)
+			assert.Equal(t, tc.expectedArgs, args)
+		})
+	}
+}
+
+// countingSKUClient counts the SKU list calls to tell which client a reloadable client delegates to
+type countingSKUClient struct {
+	calls int
+}
+
+func (c *countingSKUClient) ListComplete(_ context.Context, _, _ string) (compute.ResourceSkusResultIterator, error) {
+	c.calls++
+	return compute.ResourceSkusResultIterator{}, nil
+}
+
+const cloudConfig = `
+location: eastus
+tenantId: tenant
+subscriptionId: subscription
+resourceGroup: rg
+clusterName: cluster
+nodeResourceGroup: mc_rg
+`
+
+func TestCloudConfigWatcherReload(t *testing.T) {
+	for _, key := range []string{"LOCATION", "ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "AZURE_TENANT_ID", "AZURE_CLUSTER_NAME", "AZURE_NODE_RESOURCE_GROUP"} {
+		t.Setenv(key, "")
+	}
+	path := filepath.Join(t.TempDir(), "cloud-config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(cloudConfig), 0600))
+	config, err := auth.BuildAzureConfig(path)
+	assert.NoError(t, err)
+
+	original := &countingSKUClient{}
+	azClient := instance.NewReloadableAZClient(instance.NewAZClientFromAPI(nil, original))
+	watcher := newCloudConfigWatcher(path, config, azClient)
+	var reloadedConfigs []*auth.Config
+	rotated := &countingSKUClient{}
+	watcher.newAZClient = func(cfg *auth.Config) (*instance.AZClient, error) {
+		reloadedConfigs = append(reloadedConfigs, cfg)
+		return instance.NewAZClientFromAPI(nil, rotated), nil
+	}
+
+	// nothing changed
+	assert.NoError(t, watcher.reload(context.Background()))
+	assert.Empty(t, reloadedConfigs)
+
+	// an invalid config keeps the previous clients
+	assert.NoError(t, os.WriteFile(path, []byte(cloudConfig+"credentialMode: Password\n"), 0600))
+	assert.Error(t, watcher.reload(context.Background()))
+	assert.Empty(t, reloadedConfigs)
+	assert.Equal(t, "subscription", watcher.config.SubscriptionID)
+
+	// a rotated subscription rebuilds the clients
+	rotatedConfig := strings.Replace(cloudConfig, "subscriptionId: subscription", "subscriptionId: rotated", 1)
+	assert.NoError(t, os.WriteFile(path, []byte(rotatedConfig), 0600))
+	assert.NoError(t, watcher.reload(context.Background()))
+	assert.Len(t, reloadedConfigs, 1)
+	assert.Equal(t, "rotated", watcher.config.SubscriptionID)
+
+	_, err = azClient.SKUClient.ListComplete(context.Background(), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, original.calls)
+	assert.Equal(t, 1, rotated.calls)
+}
+
+func TestCloudConfigWatcherReloadRestartRequired(t *testing.T) {
+	for _, key := range []string{"LOCATION", "ARM_SUBSCRIPTION_ID", "ARM_RESOURCE_GROUP", "AZURE_TENANT_ID", "AZURE_CLUSTER_NAME", "AZURE_NODE_RESOURCE_GROUP"} {
+		t.Setenv(key, "")
+	}
+	path := filepath.Join(t.TempDir(), "cloud-config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(cloudConfig), 0600))
+	config, err := auth.BuildAzureConfig(path)
+	assert.NoError(t, err)
+
+	original := &countingSKUClient{}
+	azClient := instance.NewReloadableAZClient(instance.NewAZClientFromAPI(nil, original))
+	watcher := newCloudConfigWatcher(path, config, azClient)
+	var reloadedConfigs []*auth.Config
+	watcher.newAZClient = func(cfg *auth.Config) (*instance.AZClient, error) {
+		reloadedConfigs = append(reloadedConfigs, cfg)
+		return instance.NewAZClientFromAPI(nil, &countingSKUClient{}), nil
+	}
+
+	// a new location together with a rotated subscription is ignored as a whole until the restart
+	movedConfig := strings.Replace(cloudConfig, "location: eastus", "location: westus", 1)
+	movedConfig = strings.Replace(movedConfig, "subscriptionId: subscription", "subscriptionId: rotated", 1)
+	assert.NoError(t, os.WriteFile(path, []byte(movedConfig), 0600))
+	assert.NoError(t, watcher.reload(context.Background()))
+	assert.Empty(t, reloadedConfigs)
+	assert.Equal(t, "eastus", watcher.config.Location)
+	assert.Equal(t, "subscription", watcher.config.SubscriptionID)
+
+	_, err = azClient.SKUClient.ListComplete(context.Background(), "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, original.calls)
+}
+
+func TestRestartRequired(t *testing.T) {
+	old := &auth.Config{Location: "eastus", ClusterName: "cluster", SubscriptionID: "sub"}
+	assert.Empty(t, restartRequired(old, &auth.Config{Location: "eastus", ClusterName: "cluster", SubscriptionID: "rotated"}))
+	assert.Equal(t, []string{"location", "clusterName"}, restartRequired(old, &auth.Config{Location: "westus", ClusterName: "other", SubscriptionID: "sub"}))
+}
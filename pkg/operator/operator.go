@@ -18,16 +18,22 @@ package operator
 import (
 	"context"
 	"fmt"
-	"os"
+	"net/http"
 
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/aws/karpenter-core/pkg/operator"
+	"github.com/azure/gpu-provisioner/pkg/apis/settings"
 	"github.com/azure/gpu-provisioner/pkg/auth"
 	azurecache "github.com/azure/gpu-provisioner/pkg/cache"
 	"github.com/azure/gpu-provisioner/pkg/providers/instance"
 	"github.com/azure/gpu-provisioner/pkg/providers/instancetype"
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
 	"github.com/patrickmn/go-cache"
+	"github.com/samber/lo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
 	"knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
 )
 
 // Operator is injected into the AWS CloudProvider's factories
@@ -39,28 +45,37 @@ type Operator struct {
 	PricingProvider       *pricing.Provider
 	InstanceTypesProvider *instancetype.Provider
 	InstanceProvider      *instance.Provider
+
+	azClientBuilder *azClientBuilder
 }
 
-func NewOperator(ctx context.Context, operator *operator.Operator) (context.Context, *Operator) {
-	azConfig, err := GetAzConfig()
+// NewOperator creates the Azure providers. The Azure clients are rebuilt whenever the cloud config file changes.
+func NewOperator(ctx context.Context, operator *operator.Operator, cloudConfigPath string) (context.Context, *Operator) {
+	azConfig, err := GetAzConfig(cloudConfigPath)
 	if err != nil {
 		logging.FromContext(ctx).Errorf("creating Azure config, %s", err)
 	}
+	// the Azure clients are built in the background so the controller keeps running, and reports why through the
+	// cloud-provider health check, while AAD or the config are broken
+	azClient := instance.NewReloadableAZClient(nil)
+	azClientBuilder := newAZClientBuilder(cloudConfigPath, azConfig, azClient)
+	if azConfig == nil {
+		azConfig = &auth.Config{}
+	}
 
-	azClient, err := instance.CreateAzClient(azConfig)
+	env, err := azConfig.Environment()
 	if err != nil {
-		logging.FromContext(ctx).Errorf("creating Azure client, %s", err)
-		// Let us panic here, instead of crashing in the following code.
-		// TODO: move this to an init container
-		panic(fmt.Sprintf("Configure azure client fails. Please ensure federatedcredential has been created for identity %s.", os.Getenv("AZURE_CLIENT_ID")))
+		logging.FromContext(ctx).Errorf("resolving Azure cloud environment, %s", err)
+		env = &azure.PublicCloud
 	}
 
 	unavailableOfferingsCache := azurecache.NewUnavailableOfferings()
 	pricingProvider := pricing.NewProvider(
 		ctx,
-		pricing.NewAPI(),
+		pricing.NewAPI(env),
 		azConfig.Location,
 		operator.Elected(),
+		pricingStores(ctx, operator.KubernetesInterface)...,
 	)
 
 	instanceTypeProvider := instancetype.NewProvider(
@@ -74,23 +89,67 @@ func NewOperator(ctx context.Context, operator *operator.Operator) (context.Cont
 		azClient,
 		operator.GetClient(),
 		instanceTypeProvider,
+		pricingProvider,
 		unavailableOfferingsCache,
+		azConfig.Location,
 		azConfig.ResourceGroup,
 		azConfig.NodeResourceGroup,
 		azConfig.ClusterName,
 	)
 
+	// the instance provider looks up the node of every agent pool it lists, the index serves those lookups from the
+	// informer cache
+	lo.Must0(operator.GetFieldIndexer().IndexField(ctx, &v1.Node{}, instance.NodeAgentPoolIndex, instance.NodeAgentPoolIndexFunc),
+		"failed to setup node agent pool indexer")
+
+	azClientBuilder.configure = func(config *auth.Config) error {
+		configEnv, err := config.Environment()
+		if err != nil {
+			return err
+		}
+		// the pricing API was picked for the cloud of the startup config
+		if configEnv.Name != env.Name {
+			return fmt.Errorf("changes to cloud require a restart of the controller")
+		}
+		pricingProvider.SetRegion(ctx, config.Location)
+		instanceTypeProvider.SetRegion(config.Location)
+		instanceProvider.SetCluster(config.Location, config.ResourceGroup, config.NodeResourceGroup, config.ClusterName)
+		logging.FromContext(ctx).Infof("applied the fixed Azure config for cluster %s in %s", config.ClusterName, config.Location)
+		return nil
+	}
+	azClientBuilder.Start(ctx)
+
 	return ctx, &Operator{
 		Operator:                  operator,
 		UnavailableOfferingsCache: unavailableOfferingsCache,
 		PricingProvider:           pricingProvider,
 		InstanceTypesProvider:     instanceTypeProvider,
 		InstanceProvider:          instanceProvider,
+		azClientBuilder:           azClientBuilder,
+	}
+}
+
+// ReadinessProbe fails with the reason the Azure clients could not be built until they are
+func (o *Operator) ReadinessProbe(req *http.Request) error {
+	return o.azClientBuilder.ReadinessProbe(req)
+}
+
+// pricingStores returns the stores configured in the settings, the operator provided price file is loaded before the
+// prices persisted by the leader so the newer of the two wins
+func pricingStores(ctx context.Context, kubeClient kubernetes.Interface) []pricing.Store {
+	var stores []pricing.Store
+	s := settings.FromContext(ctx)
+	if s.PriceFile != "" {
+		stores = append(stores, pricing.NewFileStore(s.PriceFile))
+	}
+	if s.PriceConfigMap != "" {
+		stores = append(stores, pricing.NewConfigMapStore(kubeClient, system.Namespace(), s.PriceConfigMap))
 	}
+	return stores
 }
 
-func GetAzConfig() (*auth.Config, error) {
-	cfg, err := auth.BuildAzureConfig()
+func GetAzConfig(cloudConfigPath string) (*auth.Config, error) {
+	cfg, err := auth.BuildAzureConfig(cloudConfigPath)
 	if err != nil {
 		return nil, err
 	}
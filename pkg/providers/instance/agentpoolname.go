@@ -0,0 +1,61 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxAgentPoolNameLength is the longest agent pool name accepted for Linux agent pools, see
+	// https://learn.microsoft.com/en-us/troubleshoot/azure/azure-kubernetes/aks-common-issues-faq#what-naming-restrictions-are-enforced-for-aks-resources-and-parameters-
+	maxAgentPoolNameLength = 11
+	// agentPoolNameHashLength is the length of the hash suffix of a mapped name, 32^6 names keep collisions unlikely
+	// for the number of agent pools a cluster can have
+	agentPoolNameHashLength = 6
+)
+
+var (
+	validAgentPoolName = regexp.MustCompile(`^[a-z][a-z0-9]{0,10}$`)
+	invalidNameChars   = regexp.MustCompile(`[^a-z0-9]`)
+	// hashEncoding only uses lowercase letters and digits, which are valid in agent pool names
+	hashEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+)
+
+// AgentPoolName maps a Machine name to the name of its agent pool. Names that are valid agent pool names are used as
+// they are, which keeps the agent pools created before the mapping existed. Any other name maps to a readable prefix
+// of the name followed by a hash of the full name, e.g. workspace-falcon-7b maps to works followed by 6 hash
+// characters. The mapping is deterministic so the agent pool of a Machine can always be found again.
+func AgentPoolName(machineName string) string {
+	if validAgentPoolName.MatchString(machineName) {
+		return machineName
+	}
+	sum := sha256.Sum256([]byte(machineName))
+	hash := hashEncoding.EncodeToString(sum[:])[:agentPoolNameHashLength]
+
+	prefix := invalidNameChars.ReplaceAllString(strings.ToLower(machineName), "")
+	if prefix == "" || prefix[0] < 'a' || prefix[0] > 'z' {
+		// agent pool names have to start with a letter
+		prefix = "m" + prefix
+	}
+	if len(prefix) > maxAgentPoolNameLength-agentPoolNameHashLength {
+		prefix = prefix[:maxAgentPoolNameLength-agentPoolNameHashLength]
+	}
+	return prefix + hash
+}
@@ -0,0 +1,79 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAgentPoolName(t *testing.T) {
+	testCases := []struct {
+		name           string
+		machineName    string
+		expectedPrefix string
+	}{
+		{
+			name:           "Valid agent pool name is kept",
+			machineName:    "agentpool0",
+			expectedPrefix: "agentpool0",
+		},
+		{
+			name:           "Longest valid agent pool name is kept",
+			machineName:    "gpupool1234",
+			expectedPrefix: "gpupool1234",
+		},
+		{
+			name:           "Long name is shortened",
+			machineName:    "workspace-falcon-7b",
+			expectedPrefix: "works",
+		},
+		{
+			name:           "Uppercase characters are lowered",
+			machineName:    "GPU",
+			expectedPrefix: "gpu",
+		},
+		{
+			name:           "Name starting with a digit gets a letter prefix",
+			machineName:    "7b-workspace",
+			expectedPrefix: "m7bwo",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			apName := AgentPoolName(tc.machineName)
+			assert.Regexp(t, validAgentPoolName, apName)
+			assert.Equal(t, apName, AgentPoolName(tc.machineName), "mapping should be deterministic")
+			assert.Equal(t, tc.expectedPrefix, apName[:len(tc.expectedPrefix)])
+			if tc.expectedPrefix != tc.machineName {
+				assert.Len(t, apName, len(tc.expectedPrefix)+agentPoolNameHashLength)
+			}
+		})
+	}
+}
+
+func TestAgentPoolNameCollisions(t *testing.T) {
+	apNames := map[string]string{}
+	for i := 0; i < 10000; i++ {
+		machineName := fmt.Sprintf("workspace-%d", i)
+		apName := AgentPoolName(machineName)
+		assert.NotContains(t, apNames, apName, "%s and %s map to the same agent pool name", machineName, apNames[apName])
+		apNames[apName] = machineName
+	}
+}
@@ -17,43 +17,26 @@ package instance
 
 import (
 	"context"
+	"net/http"
 
 	sdkerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
 	"k8s.io/klog/v2"
 )
 
-func createAgentPool(ctx context.Context, client AgentPoolsAPI, rg, apName, clusterName string, ap armcontainerservice.AgentPool) (*armcontainerservice.AgentPool, error) {
-	klog.InfoS("createAgentPool", "agentpool", apName)
-
-	poller, err := client.BeginCreateOrUpdate(ctx, rg, clusterName, apName, ap, nil)
-	if err != nil {
-		return nil, err
-	}
-	res, err := poller.PollUntilDone(ctx, nil)
-	if err != nil {
-		return nil, err
-	}
-	return &res.AgentPool, nil
+func beginCreateAgentPool(ctx context.Context, client AgentPoolsAPI, rg, apName, clusterName string, ap armcontainerservice.AgentPool) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
+	klog.InfoS("beginCreateAgentPool", "agentpool", apName)
+	return client.BeginCreateOrUpdate(ctx, rg, clusterName, apName, ap, nil)
 }
 
 func deleteAgentPool(ctx context.Context, client AgentPoolsAPI, rg, apName, clusterName string) error {
 	klog.InfoS("deleteAgentPool", "agentpool", apName)
 	poller, err := client.BeginDelete(ctx, rg, clusterName, apName, nil)
 	if err != nil {
-		azErr := sdkerrors.IsResponseError(err)
-		if azErr != nil && azErr.ErrorCode == "NotFound" {
-			return nil
-		}
 		return err
 	}
 	_, err = poller.PollUntilDone(ctx, nil)
-	if err != nil {
-		azErr := sdkerrors.IsResponseError(err)
-		if azErr != nil && azErr.ErrorCode == "NotFound" {
-			return nil
-		}
-	}
 	return err
 }
 
@@ -78,3 +61,12 @@ func listAgentPools(ctx context.Context, client AgentPoolsAPI, rg, clusterName s
 	}
 	return apList, nil
 }
+
+// isNotFoundErr returns true if ARM reports that the agent pool does not exist
+func isNotFoundErr(err error) bool {
+	azErr := sdkerrors.IsResponseError(err)
+	if azErr == nil {
+		return false
+	}
+	return azErr.ErrorCode == "NotFound" || azErr.ErrorCode == sdkerrors.ResourceNotFound || azErr.StatusCode == http.StatusNotFound
+}
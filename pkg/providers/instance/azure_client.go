@@ -19,6 +19,7 @@ import (
 	"context"
 	"maps"
 	"net/http"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
@@ -67,11 +68,12 @@ func NewAZClientFromAPI(
 }
 
 func CreateAzClient(cfg *auth.Config) (*AZClient, error) {
-	// Defaulting env to Azure Public Cloud.
-	env := azure.PublicCloud
-	var err error
+	env, err := cfg.Environment()
+	if err != nil {
+		return nil, err
+	}
 
-	azClient, err := NewAZClient(cfg, &env)
+	azClient, err := NewAZClient(cfg, env)
 	if err != nil {
 		return nil, err
 	}
@@ -87,7 +89,7 @@ func NewAZClient(cfg *auth.Config, env *azure.Environment) (*AZClient, error) {
 
 	azClientConfig := cfg.GetAzureClientConfig(authorizer, env)
 	azClientConfig.UserAgent = auth.GetUserAgentExtension()
-	cred, err := auth.NewCredential(cfg, azClientConfig.Authorizer)
+	cred, err := auth.NewCredential(cfg, env, azClientConfig.Authorizer)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +97,7 @@ func NewAZClient(cfg *auth.Config, env *azure.Environment) (*AZClient, error) {
 	isE2E := utils.WithDefaultBool("E2E_TEST_MODE", false)
 	//	If not E2E, we use the default options
 	opts := armopts.DefaultArmOpts()
+	opts.Cloud = auth.CloudConfiguration(env)
 	if isE2E {
 		opts = setArmClientOptions()
 	}
@@ -116,7 +119,7 @@ func NewAZClient(cfg *auth.Config, env *azure.Environment) (*AZClient, error) {
 
 	// TODO: this one is not enabled for rate limiting / throttling ...
 	// TODO Move this over to track 2 when skewer is migrated
-	skuClient := compute.NewResourceSkusClient(cfg.SubscriptionID)
+	skuClient := compute.NewResourceSkusClientWithBaseURI(strings.TrimSuffix(env.ResourceManagerEndpoint, "/"), cfg.SubscriptionID)
 	skuClient.Authorizer = azClientConfig.Authorizer
 	klog.V(5).Infof("Created sku client with authorizer: %v", skuClient)
 
@@ -0,0 +1,278 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/samber/lo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"knative.dev/pkg/logging"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
+	"github.com/azure/gpu-provisioner/pkg/utils"
+)
+
+const (
+	// ProvisioningStateCreating is the provisioning state of an agent pool while AKS creates it
+	ProvisioningStateCreating = "Creating"
+	// ProvisioningStateFailed is the provisioning state of an agent pool whose last operation failed
+	ProvisioningStateFailed = "Failed"
+	// ProvisioningStateSucceeded is the provisioning state of an agent pool whose last operation succeeded
+	ProvisioningStateSucceeded = "Succeeded"
+)
+
+type createPoller = runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]
+
+// firstScaleSetInstanceID is the instance id of the first vm of a new scale set
+const firstScaleSetInstanceID = "0"
+
+// errNoScaleSetNode is returned when the provider id of an agent pool cannot be predicted because no node of an AKS
+// scale set is found
+var errNoScaleSetNode = errors.New("no node of an AKS scale set found to predict the provider id")
+
+var (
+	// scaleSetProviderID matches the provider ID of a node in an AKS scale set named aks-<agentpool>-<hash>-vmss
+	scaleSetProviderID = regexp.MustCompile(`(?i)^azure:///subscriptions/([^/]+)/resourceGroups/[^/]+/providers/Microsoft.Compute/virtualMachineScaleSets/aks-[a-z0-9]+-([0-9]+)-vmss/virtualMachines/`)
+	// scaleSetInstanceID matches the provider ID of a node in a scale set, capturing the scale set name and the
+	// instance id of the vm
+	scaleSetInstanceID = regexp.MustCompile(`(?i)/virtualMachineScaleSets/([^/]+)/virtualMachines/([0-9]+)$`)
+)
+
+// setCreatePoller remembers the create operation of the agent pool until it reaches a terminal state
+func (p *Provider) setCreatePoller(apName string, poller *createPoller) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.createPollers[apName] = poller
+}
+
+// createPoller returns the poller of the create operation of the agent pool if it is in progress. After a restart
+// the poller is resumed from the token recorded on the machine.
+func (p *Provider) createPoller(ctx context.Context, apObj *armcontainerservice.AgentPool) (*createPoller, error) {
+	apName := lo.FromPtr(apObj.Name)
+	p.mu.Lock()
+	poller, ok := p.createPollers[apName]
+	p.mu.Unlock()
+	if ok {
+		return poller, nil
+	}
+	if apObj.Properties == nil || lo.FromPtr(apObj.Properties.ProvisioningState) != ProvisioningStateCreating {
+		return nil, nil
+	}
+
+	machine, err := p.machineForAgentPool(ctx, apObj)
+	if err != nil || machine == nil {
+		return nil, err
+	}
+	token, ok := machine.Annotations[v1alpha1.AgentPoolCreateResumeTokenAnnotationKey]
+	if !ok {
+		return nil, nil
+	}
+	poller, err = p.azClient.agentPoolsClient.BeginCreateOrUpdate(ctx, p.cluster().resourceGroup, p.cluster().clusterName, apName, armcontainerservice.AgentPool{},
+		&armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions{ResumeToken: token})
+	if err != nil {
+		return nil, fmt.Errorf("resuming creation of agent pool %q, %w", apName, err)
+	}
+	logging.FromContext(ctx).Debugf("resumed polling the creation of agent pool %s", apName)
+	p.setCreatePoller(apName, poller)
+	return poller, nil
+}
+
+// pollCreate moves the create operation of the agent pool forward by polling it once. Once the operation reaches a
+// terminal state it is forgotten and the resume token is removed from the machine. It returns the error the operation
+// failed with, a failure for lack of capacity is also remembered until the agent pool is deleted.
+func (p *Provider) pollCreate(ctx context.Context, apObj *armcontainerservice.AgentPool) error {
+	apName := lo.FromPtr(apObj.Name)
+	poller, err := p.createPoller(ctx, apObj)
+	if err != nil {
+		// AKS keeps creating the agent pool, the next call tries again
+		logging.FromContext(ctx).Errorf("getting the create operation of agent pool %s, %s", apName, err)
+		return nil
+	}
+	if poller == nil {
+		return nil
+	}
+	if _, err := poller.Poll(ctx); err != nil {
+		logging.FromContext(ctx).Errorf("polling the creation of agent pool %s, %s", apName, err)
+		return nil
+	}
+	if !poller.Done() {
+		return nil
+	}
+
+	p.mu.Lock()
+	delete(p.createPollers, apName)
+	p.mu.Unlock()
+	if err := p.removeCreateResumeToken(ctx, apObj); err != nil {
+		logging.FromContext(ctx).Errorf("removing the create resume token of agent pool %s, %s", apName, err)
+	}
+	if _, err := poller.Result(ctx); err != nil {
+		err = classifyCreateError(err, lo.FromPtr(apObj.Properties.VMSize))
+		if IsOfferingUnavailableError(err) {
+			capacityType := capacityTypeFromPriority(apObj.Properties.ScaleSetPriority)
+			for _, zone := range agentPoolZones(p.cluster().region, apObj) {
+				p.unavailableOfferings.MarkUnavailable(ctx, unavailableReason(err), lo.FromPtr(apObj.Properties.VMSize), zone, capacityType)
+			}
+			p.mu.Lock()
+			p.capacityFailures[apName] = err
+			p.mu.Unlock()
+		}
+		return fmt.Errorf("creating agent pool %q, %w", apName, err)
+	}
+	logging.FromContext(ctx).Debugf("created agent pool %s", apName)
+	return nil
+}
+
+// machineForAgentPool returns the machine the agent pool was created for, or nil if it no longer exists
+func (p *Provider) machineForAgentPool(ctx context.Context, apObj *armcontainerservice.AgentPool) (*v1alpha5.Machine, error) {
+	var tags map[string]*string
+	if apObj.Properties != nil {
+		tags = apObj.Properties.Tags
+	}
+	machine := &v1alpha5.Machine{}
+	if err := p.kubeClient.Get(ctx, types.NamespacedName{Name: machineName(apObj.Name, tags)}, machine); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return machine, nil
+}
+
+// removeCreateResumeToken removes the resume token of a finished create operation from the machine
+func (p *Provider) removeCreateResumeToken(ctx context.Context, apObj *armcontainerservice.AgentPool) error {
+	machine, err := p.machineForAgentPool(ctx, apObj)
+	if err != nil || machine == nil {
+		return err
+	}
+	if _, ok := machine.Annotations[v1alpha1.AgentPoolCreateResumeTokenAnnotationKey]; !ok {
+		return nil
+	}
+	stored := machine.DeepCopy()
+	delete(machine.Annotations, v1alpha1.AgentPoolCreateResumeTokenAnnotationKey)
+	return client.IgnoreNotFound(p.kubeClient.Patch(ctx, machine, client.MergeFrom(stored)))
+}
+
+// predictProviderID returns the provider ID the first node of an agent pool that is still being created will have.
+// AKS names the scale sets of all the agent pools of a cluster aks-<agentpool>-<hash>-vmss with the same hash, which
+// is read from the provider ID of any node of the cluster.
+func (p *Provider) predictProviderID(ctx context.Context, apName string) (string, error) {
+	nodeList := &v1.NodeList{}
+	if err := p.kubeClient.List(ctx, nodeList, client.HasLabels{AgentPoolLabelKey}); err != nil {
+		return "", fmt.Errorf("listing nodes, %w", err)
+	}
+	for _, node := range nodeList.Items {
+		if matches := scaleSetProviderID.FindStringSubmatch(node.Spec.ProviderID); matches != nil {
+			scaleSetName := fmt.Sprintf("aks-%s-%s-vmss", apName, matches[2])
+			return fmt.Sprint("azure://", p.getVMSSNodeProviderID(matches[1], scaleSetName, firstScaleSetInstanceID)), nil
+		}
+	}
+	return "", fmt.Errorf("%w of agent pool %q", errNoScaleSetNode, apName)
+}
+
+// existingAgentPool returns the agent pool that was already created for the machine, or nil if there is none. An agent
+// pool with the same name that is not owned by the machine is never touched, and an owned agent pool that failed to
+// provision is deleted so it can be created again. The creation of an owned agent pool is polled first, so an offering
+// it failed to get capacity for is marked unavailable before the agent pool is created again.
+func (p *Provider) existingAgentPool(ctx context.Context, apName string, machine *v1alpha5.Machine) (*armcontainerservice.AgentPool, error) {
+	apObj, err := getAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, apName, p.cluster().clusterName)
+	if err != nil {
+		if isNotFoundErr(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("agentPool.Get for %q failed: %w", apName, err)
+	}
+	var uid string
+	if apObj.Properties != nil {
+		uid = lo.FromPtr(apObj.Properties.Tags[MachineUIDTagKey])
+	}
+	if uid == "" || uid != string(machine.UID) {
+		return nil, fmt.Errorf("agent pool %q already exists and is not owned by machine %s", apName, machine.Name)
+	}
+	state := lo.FromPtr(apObj.Properties.ProvisioningState)
+	if err := p.pollCreate(ctx, apObj); err != nil {
+		logging.FromContext(ctx).Errorf("%s", err)
+		state = ProvisioningStateFailed
+	}
+	if state == ProvisioningStateFailed || p.capacityFailure(apName) != nil {
+		logging.FromContext(ctx).Infof("deleting agent pool %s of machine %s that failed to provision", apName, machine.Name)
+		p.mu.Lock()
+		delete(p.createPollers, apName)
+		delete(p.capacityFailures, apName)
+		p.mu.Unlock()
+		if err := deleteAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, apName, p.cluster().clusterName); err != nil && !isNotFoundErr(err) {
+			return nil, fmt.Errorf("cleaning up failed agent pool %q: %w", apName, err)
+		}
+		return nil, nil
+	}
+	return apObj, nil
+}
+
+// adoptAgentPool returns the instance of an agent pool that was already created for the machine. If its creation is
+// still polled by this controller the resume token is handed out again.
+func (p *Provider) adoptAgentPool(apObj *armcontainerservice.AgentPool, id string) (*Instance, error) {
+	instance := p.agentPoolToInstance(apObj, id)
+	p.mu.Lock()
+	poller, ok := p.createPollers[lo.FromPtr(apObj.Name)]
+	p.mu.Unlock()
+	if ok && !poller.Done() {
+		token, err := poller.ResumeToken()
+		if err != nil {
+			return nil, fmt.Errorf("getting resume token of agent pool %q creation, %w", lo.FromPtr(apObj.Name), err)
+		}
+		instance.CreateResumeToken = to.Ptr(token)
+	}
+	return instance, nil
+}
+
+// agentPoolMatches returns an error describing how the existing agent pool differs from what the machine requests
+func agentPoolMatches(region string, apObj *armcontainerservice.AgentPool, instanceTypes []string, capacityType string, zones []string, nodeCount int32, osSKU *armcontainerservice.OSSKU) error {
+	vmSize := lo.FromPtr(apObj.Properties.VMSize)
+	if !lo.ContainsBy(instanceTypes, func(instanceType string) bool { return strings.EqualFold(instanceType, vmSize) }) {
+		return fmt.Errorf("vm size %s is not one of the requested instance types %v", vmSize, instanceTypes)
+	}
+	if apCapacityType := capacityTypeFromPriority(apObj.Properties.ScaleSetPriority); apCapacityType != capacityType {
+		return fmt.Errorf("capacity type %s is not the requested capacity type %s", apCapacityType, capacityType)
+	}
+	if apNodeCount := lo.FromPtr(apObj.Properties.Count); apNodeCount != nodeCount {
+		return fmt.Errorf("node count %d is not the requested node count %d", apNodeCount, nodeCount)
+	}
+	// agent pools without an OS SKU run the Linux default, which is Ubuntu
+	if apOSSKU, requested := lo.FromPtrOr(apObj.Properties.OSSKU, armcontainerservice.OSSKUUbuntu), lo.FromPtrOr(osSKU, armcontainerservice.OSSKUUbuntu); apOSSKU != requested {
+		return fmt.Errorf("os sku %s is not the requested os sku %s", apOSSKU, requested)
+	}
+	if requested := lo.Without(zones, ""); len(requested) > 0 {
+		if apZones := agentPoolZones(region, apObj); !lo.Every(requested, apZones) {
+			return fmt.Errorf("zones %v are not within the requested zones %v", apZones, requested)
+		}
+	}
+	return nil
+}
+
+// agentPoolZones returns the zones the agent pool was pinned to, or a single empty zone if it is regional
+func agentPoolZones(region string, apObj *armcontainerservice.AgentPool) []string {
+	if len(apObj.Properties.AvailabilityZones) == 0 {
+		return []string{""}
+	}
+	return lo.Map(apObj.Properties.AvailabilityZones, func(zone *string, _ int) string { return utils.MakeZone(region, lo.FromPtr(zone)) })
+}
@@ -0,0 +1,156 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
+	"github.com/azure/gpu-provisioner/pkg/fake"
+	"github.com/azure/gpu-provisioner/pkg/tests"
+)
+
+func TestPollCreate(t *testing.T) {
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-works4gx2ma-20562481-vmss/virtualMachines/0"
+	testCases := []struct {
+		name string
+		// restarted drops the in memory poller, the create is resumed from the token on the machine
+		restarted           bool
+		mockHandler         func(h *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse])
+		expectedState       string
+		expectedPoller      bool
+		expectedTokenPatch  bool
+		expectedUnavailable bool
+	}{
+		{
+			name: "Creation in progress",
+			mockHandler: func(h *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) {
+				h.EXPECT().Done().Return(false).AnyTimes()
+				h.EXPECT().Poll(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil)
+			},
+			expectedState:  ProvisioningStateCreating,
+			expectedPoller: true,
+		},
+		{
+			name:      "Creation in progress is resumed after a restart",
+			restarted: true,
+			mockHandler: func(h *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) {
+				h.EXPECT().Done().Return(false).AnyTimes()
+				h.EXPECT().Poll(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil)
+			},
+			expectedState:  ProvisioningStateCreating,
+			expectedPoller: true,
+		},
+		{
+			name: "Creation finished",
+			mockHandler: func(h *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) {
+				gomock.InOrder(
+					h.EXPECT().Done().Return(false),
+					h.EXPECT().Poll(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil),
+					h.EXPECT().Done().Return(true).AnyTimes(),
+				)
+				h.EXPECT().Result(gomock.Any(), gomock.Any()).Return(nil)
+			},
+			// the agent pool was fetched before the creation finished
+			expectedState:      ProvisioningStateCreating,
+			expectedTokenPatch: true,
+		},
+		{
+			name: "Creation failed for lack of capacity",
+			mockHandler: func(h *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) {
+				gomock.InOrder(
+					h.EXPECT().Done().Return(false),
+					h.EXPECT().Poll(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil),
+					h.EXPECT().Done().Return(true).AnyTimes(),
+				)
+				h.EXPECT().Result(gomock.Any(), gomock.Any()).Return(tests.AzErrorWithCode(AllocationFailed))
+			},
+			expectedState:       ProvisioningStateFailed,
+			expectedTokenPatch:  true,
+			expectedUnavailable: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			ap := tests.GetAgentPoolObjWithName("works4gx2ma", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-works4gx2ma-20562481-vmss", "Standard_NC6s_v3")
+			ap.Properties.ProvisioningState = to.Ptr(ProvisioningStateCreating)
+			ap.Properties.Tags = map[string]*string{MachineNameTagKey: to.Ptr("workspace-falcon-7b")}
+
+			mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
+			tc.mockHandler(mockHandler)
+			poller := newCreatePoller(t, mockHandler)
+			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+			if tc.restarted {
+				agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), "works4gx2ma", gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, _, _, _ string, _ armcontainerservice.AgentPool, options *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*createPoller, error) {
+						assert.Equal(t, "token", options.ResumeToken)
+						return poller, nil
+					})
+			}
+
+			// the node of the agent pool joined but is not ready yet
+			mockK8sClient := fake.NewClient()
+			node := tests.ReadyNode
+			node.Name = "aks-works4gx2ma-20562481-vmss_0"
+			node.Spec.ProviderID = providerID
+			node.Labels = map[string]string{"agentpool": "works4gx2ma", AgentPoolLabelKey: "works4gx2ma"}
+			node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+			mockK8sClient.CreateMapWithType(&v1.NodeList{})[client.ObjectKeyFromObject(&node)] = &node
+			mockK8sClient.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+			mockK8sClient.CreateOrUpdateObjectInMap(&v1alpha5.Machine{ObjectMeta: metav1.ObjectMeta{
+				Name:        "workspace-falcon-7b",
+				Annotations: map[string]string{v1alpha1.AgentPoolCreateResumeTokenAnnotationKey: "token"},
+			}})
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+			if tc.expectedTokenPatch {
+				mockK8sClient.On("Patch", mock.Anything, mock.MatchedBy(func(m *v1alpha5.Machine) bool {
+					_, ok := m.Annotations[v1alpha1.AgentPoolCreateResumeTokenAnnotationKey]
+					return !ok
+				}), mock.Anything, mock.Anything).Return(nil).Once()
+			}
+
+			p := createTestProvider(agentPoolMocks, mockK8sClient)
+			if !tc.restarted {
+				p.setCreatePoller("works4gx2ma", poller)
+			}
+
+			instance, err := p.fromAgentPoolToInstance(context.Background(), &ap)
+			assert.NoError(t, err)
+			assert.Equal(t, providerID, lo.FromPtr(instance.ID))
+			assert.Equal(t, tc.expectedState, lo.FromPtr(instance.State))
+			assert.Equal(t, tc.expectedPoller, p.createPollers["works4gx2ma"] != nil)
+			assert.Equal(t, tc.expectedUnavailable, p.unavailableOfferings.IsUnavailable("Standard_NC6s_v3", "", v1alpha5.CapacityTypeOnDemand))
+			mockK8sClient.AssertNumberOfCalls(t, "Patch", lo.Ternary(tc.expectedTokenPatch, 1, 0))
+		})
+	}
+}
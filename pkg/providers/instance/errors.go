@@ -0,0 +1,115 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"errors"
+	"fmt"
+
+	sdkerrors "github.com/Azure/azure-sdk-for-go-extensions/pkg/errors"
+)
+
+// ARM error codes returned when an agent pool cannot be created because of the chosen offering
+const (
+	AllocationFailed                 = "AllocationFailed"
+	ZonalAllocationFailed            = "ZonalAllocationFailed"
+	OverconstrainedAllocationRequest = "OverconstrainedAllocationRequest"
+	SKUNotAvailable                  = "SkuNotAvailable"
+	QuotaExceeded                    = "QuotaExceeded"
+	OperationNotAllowed              = sdkerrors.OperationNotAllowed
+)
+
+// AllocationFailedError is returned when Azure has no capacity left for the VM size.
+type AllocationFailedError struct {
+	VMSize string
+	err    error
+}
+
+func (e *AllocationFailedError) Error() string {
+	return fmt.Sprintf("allocation failed for %s, %s", e.VMSize, e.err)
+}
+
+func (e *AllocationFailedError) Unwrap() error {
+	return e.err
+}
+
+// SKUNotAvailableError is returned when the VM size is restricted for the subscription or location.
+type SKUNotAvailableError struct {
+	VMSize string
+	err    error
+}
+
+func (e *SKUNotAvailableError) Error() string {
+	return fmt.Sprintf("sku %s is not available, %s", e.VMSize, e.err)
+}
+
+func (e *SKUNotAvailableError) Unwrap() error {
+	return e.err
+}
+
+// QuotaExceededError is returned when creating the VM size would exceed the subscription or regional core quota.
+type QuotaExceededError struct {
+	VMSize string
+	err    error
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("quota exceeded for %s, %s", e.VMSize, e.err)
+}
+
+func (e *QuotaExceededError) Unwrap() error {
+	return e.err
+}
+
+// classifyCreateError maps the ARM error returned by an agent pool create to one of the typed errors above.
+// Errors that are not caused by the chosen offering are returned unchanged.
+func classifyCreateError(err error, vmSize string) error {
+	azErr := sdkerrors.IsResponseError(err)
+	if azErr == nil {
+		return err
+	}
+	switch azErr.ErrorCode {
+	case AllocationFailed, ZonalAllocationFailed, OverconstrainedAllocationRequest:
+		return &AllocationFailedError{VMSize: vmSize, err: err}
+	case SKUNotAvailable:
+		return &SKUNotAvailableError{VMSize: vmSize, err: err}
+	case QuotaExceeded:
+		return &QuotaExceededError{VMSize: vmSize, err: err}
+	case OperationNotAllowed:
+		// OperationNotAllowed is also used for unrelated failures, only the quota ones are about the offering
+		if sdkerrors.SubscriptionQuotaHasBeenReached(err) || sdkerrors.RegionalQuotaHasBeenReached(err) {
+			return &QuotaExceededError{VMSize: vmSize, err: err}
+		}
+	}
+	return err
+}
+
+// IsOfferingUnavailableError returns true if the error means the offering cannot be used right now,
+// so another VM size may still succeed.
+func IsOfferingUnavailableError(err error) bool {
+	var allocationErr *AllocationFailedError
+	var skuErr *SKUNotAvailableError
+	var quotaErr *QuotaExceededError
+	return errors.As(err, &allocationErr) || errors.As(err, &skuErr) || errors.As(err, &quotaErr)
+}
+
+// unavailableReason returns the ARM error code for logging why an offering was marked unavailable
+func unavailableReason(err error) string {
+	if azErr := sdkerrors.IsResponseError(err); azErr != nil {
+		return azErr.ErrorCode
+	}
+	return err.Error()
+}
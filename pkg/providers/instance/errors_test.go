@@ -0,0 +1,90 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/azure/gpu-provisioner/pkg/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyCreateError(t *testing.T) {
+	testCases := []struct {
+		name        string
+		err         error
+		expected    any
+		unavailable bool
+	}{
+		{
+			name:        "AllocationFailed is an allocation failure",
+			err:         tests.AzErrorWithCode(AllocationFailed),
+			expected:    &AllocationFailedError{},
+			unavailable: true,
+		},
+		{
+			name:        "OverconstrainedAllocationRequest is an allocation failure",
+			err:         fmt.Errorf("polling: %w", tests.AzErrorWithCode(OverconstrainedAllocationRequest)),
+			expected:    &AllocationFailedError{},
+			unavailable: true,
+		},
+		{
+			name:        "SkuNotAvailable is a sku failure",
+			err:         tests.AzErrorWithCode(SKUNotAvailable),
+			expected:    &SKUNotAvailableError{},
+			unavailable: true,
+		},
+		{
+			name:        "QuotaExceeded is a quota failure",
+			err:         tests.AzErrorWithCode(QuotaExceeded),
+			expected:    &QuotaExceededError{},
+			unavailable: true,
+		},
+		{
+			name:        "OperationNotAllowed with a regional quota message is a quota failure",
+			err:         tests.AzErrorWithMessage(OperationNotAllowed, "Operation could not be completed as it results in exceeding approved Total Regional Cores quota."),
+			expected:    &QuotaExceededError{},
+			unavailable: true,
+		},
+		{
+			name: "OperationNotAllowed for other reasons is not classified",
+			err:  tests.AzErrorWithMessage(OperationNotAllowed, "Another operation is in progress."),
+		},
+		{
+			name: "Unknown error codes are not classified",
+			err:  tests.AzErrorWithCode("InvalidParameter"),
+		},
+		{
+			name: "Non ARM errors are not classified",
+			err:  errors.New("connection reset"),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := classifyCreateError(tc.err, "Standard_NC6s_v3")
+			assert.Equal(t, tc.unavailable, IsOfferingUnavailableError(err))
+			if tc.expected != nil {
+				assert.IsType(t, tc.expected, err)
+				assert.ErrorIs(t, err, tc.err, "the ARM error should stay in the chain")
+			} else {
+				assert.Equal(t, tc.err, err)
+			}
+		})
+	}
+}
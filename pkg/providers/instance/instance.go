@@ -17,27 +17,34 @@ package instance
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
 	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/klog/v2"
 
 	"github.com/azure/gpu-provisioner/pkg/utils"
 	"github.com/samber/lo"
+	"go.uber.org/multierr"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/client-go/util/retry"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"knative.dev/pkg/logging"
 
 	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/cloudprovider"
 	"github.com/aws/karpenter-core/pkg/scheduling"
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
 	"github.com/azure/gpu-provisioner/pkg/cache"
 	"github.com/azure/gpu-provisioner/pkg/providers/instancetype"
+	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	nodeutil "github.com/aws/karpenter-core/pkg/utils/node"
@@ -45,114 +52,247 @@ import (
 
 const (
 	LabelMachineType = "kaito.sh/machine-type"
+
+	// AgentPoolLabelKey is the label AKS puts on every node with the name of its agent pool
+	AgentPoolLabelKey = "kubernetes.azure.com/agentpool"
+	// NodeAgentPoolIndex is the field index of the nodes in the informer cache by the name of their agent pool, so
+	// the node of an agent pool is found without listing all the nodes
+	NodeAgentPoolIndex = "metadata.labels.agentpool"
+
+	// SpotTaint is added by AKS to every node of a spot agent pool, workloads scheduled to spot machines must tolerate it
+	SpotTaint = "kubernetes.azure.com/scalesetpriority=spot:NoSchedule"
+
+	// spotMaxPrice of -1 means the spot vm is only evicted for capacity, never for price, and is capped at the
+	// on-demand price
+	spotMaxPrice = float32(-1)
+
+	// maxAgentPoolNodeCount is the most nodes a virtual machine scale set agent pool can have
+	maxAgentPoolNodeCount = 1000
 )
 
+// linuxOSSKUs are the OS SKUs a Machine can select for its agent pool. The Ubuntu version follows the Kubernetes version
+// of the agent pool.
+var linuxOSSKUs = []armcontainerservice.OSSKU{
+	armcontainerservice.OSSKUUbuntu,
+	armcontainerservice.OSSKUAzureLinux,
+	armcontainerservice.OSSKUCBLMariner,
+}
+
 type Provider struct {
 	azClient             *AZClient
 	kubeClient           client.Client
 	instanceTypeProvider *instancetype.Provider
-	resourceGroup        string
-	nodeResourceGroup    string
-	clusterName          string
+	pricingProvider      *pricing.Provider
+	clusterConfig        atomic.Pointer[clusterConfig]
 	unavailableOfferings *cache.UnavailableOfferings
+
+	mu sync.Mutex
+	// createPollers tracks the agent pools being created by name, Get and List poll them to move the creation forward
+	createPollers map[string]*createPoller
+	// capacityFailures tracks the agent pools whose creation failed for lack of capacity by name, until they are deleted
+	capacityFailures map[string]error
 }
 
 func NewProvider(
 	azClient *AZClient,
 	kubeClient client.Client,
 	instanceTypeProvider *instancetype.Provider,
+	pricingProvider *pricing.Provider,
 	offeringsCache *cache.UnavailableOfferings,
 
+	region string,
 	resourceGroup string,
 	nodeResourceGroup string,
 	clusterName string,
 ) *Provider {
-	return &Provider{
+	p := &Provider{
 		azClient:             azClient,
 		kubeClient:           kubeClient,
 		instanceTypeProvider: instanceTypeProvider,
-		resourceGroup:        resourceGroup,
-		nodeResourceGroup:    nodeResourceGroup,
-		clusterName:          clusterName,
+		pricingProvider:      pricingProvider,
 		unavailableOfferings: offeringsCache,
+		createPollers:        map[string]*createPoller{},
+		capacityFailures:     map[string]error{},
 	}
+	p.SetCluster(region, resourceGroup, nodeResourceGroup, clusterName)
+	return p
+}
+
+// clusterConfig locates the AKS cluster the agent pools are created in
+type clusterConfig struct {
+	region            string
+	resourceGroup     string
+	nodeResourceGroup string
+	clusterName       string
 }
 
-// Create an instance given the constraints.
+// SetCluster points the provider at the cluster, it is called again once a cloud config that was invalid at startup
+// has been fixed
+func (p *Provider) SetCluster(region, resourceGroup, nodeResourceGroup, clusterName string) {
+	p.clusterConfig.Store(&clusterConfig{
+		region:            region,
+		resourceGroup:     resourceGroup,
+		nodeResourceGroup: nodeResourceGroup,
+		clusterName:       clusterName,
+	})
+}
+
+func (p *Provider) cluster() *clusterConfig {
+	return p.clusterConfig.Load()
+}
+
+// Create an instance given the constraints. It returns as soon as AKS accepts the agent pool, the instance is in the
+// Creating state until Get or List observe that the creation finished.
 // instanceTypes should be sorted by priority for spot capacity type.
 func (p *Provider) Create(ctx context.Context, machine *v1alpha5.Machine) (*Instance, error) {
 	klog.InfoS("Instance.Create", "machine", klog.KObj(machine))
 
-	// We made a strong assumption here. The machine name should be a valid agent pool name without "-".
-	apName := machine.Name
-	if len(apName) > 11 {
-		//https://learn.microsoft.com/en-us/troubleshoot/azure/azure-kubernetes/aks-common-issues-faq#what-naming-restrictions-are-enforced-for-aks-resources-and-parameters-
-		return nil, fmt.Errorf("the length agentpool name should be less than 11, got %d (%s)", len(apName), apName)
+	// the machine name is recorded in the agent pool tags, the agent pool name is recorded in the machine annotations
+	apName := AgentPoolName(machine.Name)
+
+	instanceTypes := scheduling.NewNodeSelectorRequirements(machine.Spec.Requirements...).Get("node.kubernetes.io/instance-type").Values()
+	if len(instanceTypes) == 0 {
+		return nil, fmt.Errorf("machine spec has no requirement for instance type")
+	}
+	nodeCount, err := getNodeCount(machine)
+	if err != nil {
+		return nil, err
+	}
+	osSKU, err := getOSSKU(machine)
+	if err != nil {
+		return nil, err
+	}
+	supported := lo.Filter(instanceTypes, func(instanceType string, _ int) bool { return isOSSKUSupported(osSKU, instanceType) })
+	if len(supported) == 0 {
+		return nil, fmt.Errorf("none of the requested instance types %v is validated for os sku %s", instanceTypes, lo.FromPtr(osSKU))
+	}
+	instanceTypes = supported
+	capacityType := getCapacityType(machine)
+	zones := getZones(machine)
+
+	// the provider id is needed before the node exists, fail before creating anything if it cannot be predicted
+	id, err := p.predictProviderID(ctx, apName)
+	if err != nil {
+		return nil, err
 	}
 
-	var ap *armcontainerservice.AgentPool
-	err := retry.OnError(retry.DefaultBackoff, func(err error) bool {
-		return false
-	}, func() error {
-		instanceTypes := scheduling.NewNodeSelectorRequirements(machine.Spec.Requirements...).Get("node.kubernetes.io/instance-type").Values()
-		if len(instanceTypes) == 0 {
-			return fmt.Errorf("machine spec has no requirement for instance type")
+	// Create is called again for the same machine if the controller restarted before the machine was launched, the
+	// agent pool that was already created for it is adopted instead of being updated
+	existing, err := p.existingAgentPool(ctx, apName, machine)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if err := agentPoolMatches(p.cluster().region, existing, instanceTypes, capacityType, zones, nodeCount, osSKU); err != nil {
+			return nil, fmt.Errorf("agent pool %q of machine %s does not match the machine spec, %w", apName, machine.Name, err)
 		}
+		logging.FromContext(ctx).Infof("adopting existing agent pool %s of machine %s", apName, machine.Name)
+		return p.adoptAgentPool(existing, id)
+	}
+
+	// the offerings an agent pool of the machine failed to get capacity for are marked unavailable by now, so only the
+	// remaining instance types are tried
+	vmSizes := p.orderInstanceTypes(instanceTypes, zones, capacityType)
+	if len(vmSizes) == 0 {
+		return nil, cloudprovider.NewInsufficientCapacityError(fmt.Errorf("all requested instance types %v are currently unavailable as %s in zones %v", instanceTypes, capacityType, zones))
+	}
 
-		vmSize := instanceTypes[0]
-		apObj := newAgentPoolObject(vmSize, machine)
+	var apObj armcontainerservice.AgentPool
+	var poller *createPoller
+	var errs error
+	for i, vmSize := range vmSizes {
+		vmZones := p.availableZones(vmSize, zones, capacityType)
+		apObj = newAgentPoolObject(vmSize, capacityType, vmZones, nodeCount, osSKU, machine)
+		apObj.Properties.Tags = p.ownershipTags(machine)
 
-		logging.FromContext(ctx).Debugf("creating Agent pool %s (%s)", apName, vmSize)
+		logging.FromContext(ctx).Debugf("creating Agent pool %s (%d x %s, %s, zones %v)", apName, nodeCount, vmSize, capacityType, vmZones)
 		var err error
-		ap, err = createAgentPool(ctx, p.azClient.agentPoolsClient, p.resourceGroup, apName, p.clusterName, apObj)
-		if err != nil {
-			return fmt.Errorf("agentPool.BeginCreateOrUpdate for %q failed: %w", apName, err)
+		poller, err = beginCreateAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, apName, p.cluster().clusterName, apObj)
+		if err == nil {
+			logging.FromContext(ctx).Debugf("accepted creation of agent pool %s", apName)
+			break
+		}
+		err = classifyCreateError(err, vmSize)
+		if !IsOfferingUnavailableError(err) {
+			return nil, multierr.Append(errs, fmt.Errorf("agentPool.BeginCreateOrUpdate for %q (%s) failed: %w", apName, vmSize, err))
+		}
+		for _, zone := range vmZones {
+			p.unavailableOfferings.MarkUnavailable(ctx, unavailableReason(err), vmSize, zone, capacityType)
+		}
+		errs = multierr.Append(errs, fmt.Errorf("agentPool.BeginCreateOrUpdate for %q (%s) failed: %w", apName, vmSize, err))
+		if ctx.Err() != nil || i == len(vmSizes)-1 {
+			// every candidate ran out of capacity, let karpenter-core know so it can pick other instance types
+			return nil, cloudprovider.NewInsufficientCapacityError(errs)
 		}
-		logging.FromContext(ctx).Debugf("created agent pool %s", *ap.ID)
-		return nil
 
-	})
-	if err != nil {
-		return nil, err
+		// a failed create may leave the agent pool behind in a failed state, and the vm size of an
+		// existing agent pool cannot be changed, so clean it up before falling back to the next size.
+		logging.FromContext(ctx).Infof("creating agent pool %s with %s failed, falling back to %s: %v", apName, vmSize, vmSizes[i+1], err)
+		if err := deleteAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, apName, p.cluster().clusterName); err != nil && !isNotFoundErr(err) {
+			return nil, multierr.Append(errs, fmt.Errorf("cleaning up agent pool %q after failed create: %w", apName, err))
+		}
 	}
 
-	instance, err := p.fromAgentPoolToInstance(ctx, ap)
-	if instance == nil && err == nil {
-		// means the node object has not been found yet, we wait until the node is created
-		b := wait.Backoff{
-			Steps:    15,
-			Duration: 1 * time.Second,
-			Factor:   1.0,
-			Jitter:   0.1,
+	apObj.Name = to.Ptr(apName)
+	apObj.Properties.ProvisioningState = to.Ptr(ProvisioningStateCreating)
+	instance := p.agentPoolToInstance(&apObj, id)
+	// AKS may finish right away, e.g. when the agent pool already exists
+	if !poller.Done() {
+		token, err := poller.ResumeToken()
+		if err != nil {
+			return nil, fmt.Errorf("getting resume token of agent pool %q creation, %w", apName, err)
 		}
+		p.setCreatePoller(apName, poller)
+		instance.CreateResumeToken = to.Ptr(token)
+	}
+	return instance, nil
+}
 
-		err = retry.OnError(b, func(err error) bool {
-			return true
-		}, func() error {
-			var e error
-			instance, e = p.fromAgentPoolToInstance(ctx, ap)
-			if e != nil {
-				return e
-			}
-			if instance == nil {
-				return fmt.Errorf("fail to find the node object")
-			}
-			return nil
-		})
-		if err != nil {
-			return nil, err
+// orderInstanceTypes drops the instance types whose offering is currently marked as unavailable in all the zones and
+// sorts the rest by the price of the capacity type, cheapest first. Instance types without a known price keep their
+// requested order and go last.
+func (p *Provider) orderInstanceTypes(instanceTypes []string, zones []string, capacityType string) []string {
+	available := lo.Filter(instanceTypes, func(instanceType string, _ int) bool {
+		return len(p.availableZones(instanceType, zones, capacityType)) > 0
+	})
+	sort.SliceStable(available, func(i, j int) bool {
+		iPrice, iOK := p.price(available[i], capacityType)
+		jPrice, jOK := p.price(available[j], capacityType)
+		if iOK != jOK {
+			return iOK
+		}
+		return iPrice < jPrice
+	})
+	return available
+}
+
+// price returns the known price of the instance type for the capacity type. Spot falls back to the on-demand price,
+// which is what a spot vm costs at most.
+func (p *Provider) price(instanceType string, capacityType string) (float64, bool) {
+	if capacityType == v1alpha5.CapacityTypeSpot {
+		// spot prices are regional, all zones share the same price
+		if price, ok := p.pricingProvider.SpotPrice(instanceType, ""); ok {
+			return price, true
 		}
 	}
-	return instance, err
+	return p.pricingProvider.OnDemandPrice(instanceType)
+}
+
+// availableZones returns the zones in which the offering is not currently marked as unavailable
+func (p *Provider) availableZones(instanceType string, zones []string, capacityType string) []string {
+	return lo.Reject(zones, func(zone string, _ int) bool {
+		return p.unavailableOfferings.IsUnavailable(instanceType, zone, capacityType)
+	})
 }
 
-// getVMSSNodeProviderID generates the provider ID for a virtual machine scale set.
-func (p *Provider) getVMSSNodeProviderID(subscriptionID, scaleSetName string) string {
+// getVMSSNodeProviderID generates the provider ID for the instance of a virtual machine scale set.
+func (p *Provider) getVMSSNodeProviderID(subscriptionID, scaleSetName, instanceID string) string {
 	return fmt.Sprintf(
-		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/0", //vm = 0 as ew have the count always 1
+		"/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/%s/virtualMachines/%s",
 		subscriptionID,
-		strings.ToLower(p.nodeResourceGroup),
+		strings.ToLower(p.cluster().nodeResourceGroup),
 		scaleSetName,
+		instanceID,
 	)
 }
 
@@ -161,25 +301,85 @@ func (p *Provider) Get(ctx context.Context, id string) (*Instance, error) {
 	if err != nil {
 		return nil, fmt.Errorf("getting agentpool name, %w", err)
 	}
-	apObj, err := getAgentPool(ctx, p.azClient.agentPoolsClient, p.resourceGroup, apName, p.clusterName)
+	apObj, err := getAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, apName, p.cluster().clusterName)
 	if err != nil {
+		if isNotFoundErr(err) {
+			return nil, cloudprovider.NewMachineNotFoundError(fmt.Errorf("agentPool %q not found, %w", apName, err))
+		}
 		logging.FromContext(ctx).Errorf("Get agentpool %q failed: %v", apName, err)
 		return nil, fmt.Errorf("agentPool.Get for %s failed: %w", apName, err)
 	}
 
-	return p.fromAgentPoolToInstance(ctx, apObj)
+	instance, err := p.fromAgentPoolToInstance(ctx, apObj)
+	if err != nil {
+		return nil, err
+	}
+	// karpenter-core deletes the machine and launches a new one with the remaining instance types
+	if err := p.capacityFailure(apName); err != nil {
+		return nil, cloudprovider.NewInsufficientCapacityError(err)
+	}
+	return instance, nil
+}
+
+// capacityFailure returns the error the creation of the agent pool failed with for lack of capacity, nil if it did not
+func (p *Provider) capacityFailure(apName string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.capacityFailures[apName]
 }
 
+// List returns the instances of the agent pools owned by the controller, system and user agent pools are left out. So
+// are the agent pools whose creation failed for lack of capacity, karpenter-core garbage collects their machines and
+// launches new ones with the remaining instance types. An agent pool whose provider id cannot be told yet is skipped
+// rather than failing the whole list.
 func (p *Provider) List(ctx context.Context) ([]*Instance, error) {
-	apList, err := listAgentPools(ctx, p.azClient.agentPoolsClient, p.resourceGroup, p.clusterName)
+	apList, err := p.listOwnedAgentPools(ctx)
 	if err != nil {
-		logging.FromContext(ctx).Errorf("Listing agentpools failed: %v", err)
-		return nil, fmt.Errorf("agentPool.NewListPager failed: %w", err)
+		return nil, err
 	}
 
 	return p.fromAPListToInstances(ctx, apList)
 }
 
+// ListOwned returns an instance for every agent pool owned by the controller without looking up their nodes, so the
+// instances have no ID. It includes the agent pools whose node never became ready.
+func (p *Provider) ListOwned(ctx context.Context) ([]*Instance, error) {
+	apList, err := p.listOwnedAgentPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return lo.Map(apList, func(apObj *armcontainerservice.AgentPool, _ int) *Instance {
+		instance := p.agentPoolToInstance(apObj, "")
+		instance.ID = nil
+		return instance
+	}), nil
+}
+
+func (p *Provider) listOwnedAgentPools(ctx context.Context) ([]*armcontainerservice.AgentPool, error) {
+	apList, err := listAgentPools(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, p.cluster().clusterName)
+	if err != nil {
+		logging.FromContext(ctx).Errorf("Listing agentpools failed: %v", err)
+		return nil, fmt.Errorf("agentPool.NewListPager failed: %w", err)
+	}
+	var owned []*armcontainerservice.AgentPool
+	for _, apObj := range apList {
+		if isLegacy(apObj) {
+			ok, err := p.migrateLegacyAgentPool(ctx, apObj)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				owned = append(owned, apObj)
+			}
+			continue
+		}
+		if p.isOwned(apObj) {
+			owned = append(owned, apObj)
+		}
+	}
+	return owned, nil
+}
+
 func (p *Provider) Delete(ctx context.Context, id string) error {
 	klog.InfoS("Instance.Delete", "id", id)
 
@@ -187,65 +387,188 @@ func (p *Provider) Delete(ctx context.Context, id string) error {
 	if err != nil {
 		return fmt.Errorf("getting agentpool name, %w", err)
 	}
-	err = deleteAgentPool(ctx, p.azClient.agentPoolsClient, p.resourceGroup, apName, p.clusterName)
+	return p.DeleteAgentPool(ctx, apName)
+}
+
+// DeleteAgentPool deletes the agent pool and waits for the deletion to finish
+func (p *Provider) DeleteAgentPool(ctx context.Context, apName string) error {
+	p.mu.Lock()
+	delete(p.createPollers, apName)
+	delete(p.capacityFailures, apName)
+	p.mu.Unlock()
+	err := deleteAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, apName, p.cluster().clusterName)
 	if err != nil {
+		if isNotFoundErr(err) {
+			return cloudprovider.NewMachineNotFoundError(fmt.Errorf("agentPool %q not found, %w", apName, err))
+		}
 		logging.FromContext(ctx).Errorf("Deleting agentpool %q failed: %v", apName, err)
 		return fmt.Errorf("agentPool.Delete for %q failed: %w", apName, err)
 	}
 	return nil
 }
 
+// fromAgentPoolToInstance returns the instance of the agent pool whatever its state. An agent pool without a ready node
+// is reported with the provider id its node will have, so karpenter-core sees agent pools that are still being created
+// or that failed instead of treating them as nonexistent.
 func (p *Provider) fromAgentPoolToInstance(ctx context.Context, apObj *armcontainerservice.AgentPool) (*Instance, error) {
 	subID, err := utils.ParseSubIDFromID(lo.FromPtr(apObj.ID))
 	if err != nil {
 		return nil, err
 	}
+	createErr := p.pollCreate(ctx, apObj)
+	if createErr != nil {
+		logging.FromContext(ctx).Errorf("%s", createErr)
+	}
 
-	node, err := p.getNodeByName(ctx, lo.FromPtr(apObj.Name))
+	nodes, err := p.getAgentPoolNodes(ctx, lo.FromPtr(apObj.Name))
 	if err != nil {
 		return nil, err
 	}
-	if node == nil || nodeutil.GetCondition(node, v1.NodeReady).Status != v1.ConditionTrue {
-		// node is not found or not ready
-		return nil, nil
+	nodeIDs := p.nodeProviderIDs(lo.FromPtr(subID), nodes)
+	machine, err := p.machineForAgentPool(ctx, apObj)
+	if err != nil {
+		return nil, fmt.Errorf("getting machine of agent pool %q, %w", lo.FromPtr(apObj.Name), err)
 	}
-	tokens := strings.SplitAfter(node.Name, "-vmss") // remove the vm index "0000"
+	id, err := p.launchedProviderID(ctx, apObj, machine, nodeIDs)
+	if err != nil {
+		return nil, err
+	}
+	if lo.FromPtr(apObj.Properties.Count) > 1 {
+		if err := p.recordNodeIDs(ctx, machine, nodeIDs); err != nil {
+			logging.FromContext(ctx).Errorf("recording the node provider ids of agent pool %s, %s", lo.FromPtr(apObj.Name), err)
+		}
+	}
+	instance := p.agentPoolToInstance(apObj, id)
+	instance.NodeIDs = nodeIDs
+	instance.State = to.Ptr(instanceState(apObj, nodes, createErr))
+	return instance, nil
+}
+
+// launchedProviderID returns the provider id the machine of the agent pool was launched with. karpenter-core matches
+// the machine by this id, so it is reported whichever of the nodes joined or was replaced since. That is the id
+// recorded on the machine, or the one predicted for the first node while the machine has none.
+func (p *Provider) launchedProviderID(ctx context.Context, apObj *armcontainerservice.AgentPool, machine *v1alpha5.Machine, nodeIDs []string) (string, error) {
+	if machine != nil && machine.Status.ProviderID != "" {
+		return machine.Status.ProviderID, nil
+	}
+	id, err := p.predictProviderID(ctx, lo.FromPtr(apObj.Name))
+	if err != nil {
+		if len(nodeIDs) == 0 {
+			return "", err
+		}
+		return nodeIDs[0], nil
+	}
+	return id, nil
+}
+
+// recordNodeIDs maps every node of a multi-node agent pool to its machine by recording their provider ids on the
+// machine, karpenter-core only matches the node with the provider id of the machine itself
+func (p *Provider) recordNodeIDs(ctx context.Context, machine *v1alpha5.Machine, nodeIDs []string) error {
+	if machine == nil {
+		return nil
+	}
+	value := strings.Join(nodeIDs, ",")
+	if machine.Annotations[v1alpha1.AgentPoolNodeProviderIDsAnnotationKey] == value {
+		return nil
+	}
+	stored := machine.DeepCopy()
+	machine.Annotations = lo.Assign(machine.Annotations, map[string]string{v1alpha1.AgentPoolNodeProviderIDsAnnotationKey: value})
+	return client.IgnoreNotFound(p.kubeClient.Patch(ctx, machine, client.MergeFrom(stored)))
+}
+
+// nodeProviderIDs returns the provider ids of the nodes ordered by their scale set instance id. The ids are built from
+// the scale set and instance id of the provider id each node reports, nodes that do not report one yet are left out.
+func (p *Provider) nodeProviderIDs(subscriptionID string, nodes []v1.Node) []string {
+	type scaleSetInstance struct {
+		scaleSetName string
+		instanceID   int
+	}
+	var instances []scaleSetInstance
+	for _, node := range nodes {
+		matches := scaleSetInstanceID.FindStringSubmatch(node.Spec.ProviderID)
+		if matches == nil {
+			continue
+		}
+		instanceID, err := strconv.Atoi(matches[2])
+		if err != nil {
+			continue
+		}
+		instances = append(instances, scaleSetInstance{scaleSetName: matches[1], instanceID: instanceID})
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].instanceID < instances[j].instanceID })
+	return lo.Map(instances, func(instance scaleSetInstance, _ int) string {
+		return fmt.Sprint("azure://", p.getVMSSNodeProviderID(subscriptionID, instance.scaleSetName, strconv.Itoa(instance.instanceID)))
+	})
+}
+
+// instanceState returns the provisioning state of the agent pool until it is provisioned, and the readiness of its
+// nodes once it is. The instance is ready once as many nodes as the agent pool has are ready.
+func instanceState(apObj *armcontainerservice.AgentPool, nodes []v1.Node, createErr error) string {
+	if createErr != nil {
+		// the agent pool was fetched before its create operation was seen failing
+		return ProvisioningStateFailed
+	}
+	if state := lo.FromPtr(apObj.Properties.ProvisioningState); state != "" && state != ProvisioningStateSucceeded {
+		return state
+	}
+	ready := lo.CountBy(nodes, func(node v1.Node) bool {
+		return nodeutil.GetCondition(&node, v1.NodeReady).Status == v1.ConditionTrue
+	})
+	if ready > 0 && ready >= int(lo.FromPtr(apObj.Properties.Count)) {
+		return InstanceStateReady
+	}
+	return InstanceStateNotReady
+}
+
+func (p *Provider) agentPoolToInstance(apObj *armcontainerservice.AgentPool, id string) *Instance {
 	instanceLabels := lo.MapValues(apObj.Properties.NodeLabels, func(k *string, _ string) string {
 		return lo.FromPtr(k)
 	})
 	return &Instance{
-		Name:     apObj.Name,
-		ID:       to.Ptr(fmt.Sprint("azure://", p.getVMSSNodeProviderID(lo.FromPtr(subID), tokens[0]))),
-		Type:     apObj.Properties.VMSize,
-		SubnetID: apObj.Properties.VnetSubnetID,
-		Tags:     apObj.Properties.Tags,
-		State:    apObj.Properties.ProvisioningState,
-		Labels:   instanceLabels,
-	}, nil
+		Name:                apObj.Name,
+		ID:                  to.Ptr(id),
+		ImageID:             apObj.Properties.NodeImageVersion,
+		Type:                apObj.Properties.VMSize,
+		SubnetID:            apObj.Properties.VnetSubnetID,
+		Tags:                apObj.Properties.Tags,
+		State:               apObj.Properties.ProvisioningState,
+		Labels:              instanceLabels,
+		Taints:              lo.Map(apObj.Properties.NodeTaints, func(t *string, _ int) string { return lo.FromPtr(t) }),
+		OSDiskSizeGB:        apObj.Properties.OSDiskSizeGB,
+		OrchestratorVersion: apObj.Properties.CurrentOrchestratorVersion,
+		CapacityType:        to.Ptr(capacityTypeFromPriority(apObj.Properties.ScaleSetPriority)),
+		NodeCount:           apObj.Properties.Count,
+		OSSKU:               (*string)(apObj.Properties.OSSKU),
+		Zones:               lo.Without(agentPoolZones(p.cluster().region, apObj), ""),
+	}
 }
 
 func (p *Provider) fromAPListToInstances(ctx context.Context, apList []*armcontainerservice.AgentPool) ([]*Instance, error) {
-	if len(apList) == 0 {
-		return nil, fmt.Errorf("no agentpools found")
-	}
 	instances := []*Instance{}
 	for index := range apList {
 		instance, err := p.fromAgentPoolToInstance(ctx, apList[index])
+		if errors.Is(err, errNoScaleSetNode) {
+			// none of its nodes joined and its machine has no provider id, so there is no machine to match it with yet
+			logging.FromContext(ctx).Errorf("leaving out agent pool %s, %s", lo.FromPtr(apList[index].Name), err)
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
-		if instance != nil { // exclude not found or not ready node
-			instances = append(instances, instance)
+		if err := p.capacityFailure(lo.FromPtr(instance.Name)); err != nil {
+			logging.FromContext(ctx).Debugf("leaving out agent pool %s that failed for lack of capacity, %s", lo.FromPtr(instance.Name), err)
+			continue
 		}
+		instances = append(instances, instance)
 	}
 	return instances, nil
 }
 
-func newAgentPoolObject(vmSize string, machine *v1alpha5.Machine) armcontainerservice.AgentPool {
+func newAgentPoolObject(vmSize, capacityType string, zones []string, nodeCount int32, osSKU *armcontainerservice.OSSKU, machine *v1alpha5.Machine) armcontainerservice.AgentPool {
 	taints := machine.Spec.Taints
 	taintsStr := []*string{}
 	for _, t := range taints {
-		taintsStr = append(taintsStr, to.Ptr(fmt.Sprintf("%s=%s:%s", t.Key, t.Value, t.Effect)))
+		taintsStr = append(taintsStr, to.Ptr(FormatTaint(t)))
 	}
 	scaleSetsType := armcontainerservice.AgentPoolTypeVirtualMachineScaleSets
 	labels := map[string]*string{v1alpha5.ProvisionerNameLabelKey: to.Ptr("default")}
@@ -264,36 +587,134 @@ func newAgentPoolObject(vmSize string, machine *v1alpha5.Machine) armcontainerse
 		storage = machine.Spec.Resources.Requests.Storage()
 	}
 
-	return armcontainerservice.AgentPool{
+	ap := armcontainerservice.AgentPool{
 		Properties: &armcontainerservice.ManagedClusterAgentPoolProfileProperties{
-			NodeLabels:   labels,
-			NodeTaints:   taintsStr, //[]*string{to.Ptr("sku=gpu:NoSchedule")},
-			Type:         to.Ptr(scaleSetsType),
-			VMSize:       to.Ptr(vmSize),
-			OSType:       to.Ptr(armcontainerservice.OSTypeLinux),
-			Count:        to.Ptr(int32(1)),
-			OSDiskSizeGB: to.Ptr(int32(storage.Value())),
+			NodeLabels:       labels,
+			NodeTaints:       taintsStr, //[]*string{to.Ptr("sku=gpu:NoSchedule")},
+			Type:             to.Ptr(scaleSetsType),
+			VMSize:           to.Ptr(vmSize),
+			OSType:           to.Ptr(armcontainerservice.OSTypeLinux),
+			OSSKU:            osSKU,
+			Count:            to.Ptr(nodeCount),
+			OSDiskSizeGB:     to.Ptr(ToOSDiskSizeGB(*storage)),
+			ScaleSetPriority: to.Ptr(armcontainerservice.ScaleSetPriorityRegular),
 		},
 	}
+	if version, ok := machine.Annotations[v1alpha1.AgentPoolKubernetesVersionAnnotationKey]; ok && version != "" {
+		ap.Properties.OrchestratorVersion = to.Ptr(version)
+	}
+	if availabilityZones := lo.Without(zones, ""); len(availabilityZones) > 0 {
+		ap.Properties.AvailabilityZones = lo.Map(availabilityZones, func(zone string, _ int) *string { return to.Ptr(utils.GetZoneNumber(zone)) })
+	}
+	if capacityType == v1alpha5.CapacityTypeSpot {
+		// the node is deleted on eviction, karpenter-core replaces the machine
+		ap.Properties.ScaleSetPriority = to.Ptr(armcontainerservice.ScaleSetPrioritySpot)
+		ap.Properties.ScaleSetEvictionPolicy = to.Ptr(armcontainerservice.ScaleSetEvictionPolicyDelete)
+		ap.Properties.SpotMaxPrice = to.Ptr(spotMaxPrice)
+	}
+	return ap
 }
 
-func (p *Provider) getNodeByName(ctx context.Context, apName string) (*v1.Node, error) {
-	nodeList := &v1.NodeList{}
-	labelSelector := client.MatchingLabels{"agentpool": apName, "kubernetes.azure.com/agentpool": apName}
+// getCapacityType returns spot if the machine allows spot capacity, otherwise on-demand
+func getCapacityType(machine *v1alpha5.Machine) string {
+	requirements := scheduling.NewNodeSelectorRequirements(machine.Spec.Requirements...)
+	if requirements.Has(v1alpha5.LabelCapacityType) && requirements.Get(v1alpha5.LabelCapacityType).Has(v1alpha5.CapacityTypeSpot) {
+		return v1alpha5.CapacityTypeSpot
+	}
+	return v1alpha5.CapacityTypeOnDemand
+}
 
-	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
-		return true
-	}, func() error {
-		return p.kubeClient.List(ctx, nodeList, labelSelector)
-	})
-	if err != nil {
-		return nil, err
+// getZones returns the zones the machine is restricted to by its zone or alternative zone requirement, or a single
+// empty zone if the agent pool can be placed anywhere in the region
+func getZones(machine *v1alpha5.Machine) []string {
+	requirements := scheduling.NewNodeSelectorRequirements(machine.Spec.Requirements...)
+	var zones sets.String
+	for _, key := range []string{v1.LabelTopologyZone, v1alpha1.AlternativeLabelTopologyZone} {
+		if !requirements.Has(key) || requirements.Get(key).Operator() != v1.NodeSelectorOpIn {
+			continue
+		}
+		values := sets.NewString(requirements.Get(key).Values()...)
+		if zones == nil {
+			zones = values
+		} else {
+			zones = zones.Intersection(values)
+		}
+	}
+	if zones == nil {
+		return []string{""}
 	}
+	return zones.List()
+}
+
+// getNodeCount returns the number of nodes requested for the agent pool of the machine, one if none is requested
+func getNodeCount(machine *v1alpha5.Machine) (int32, error) {
+	value, ok := machine.Annotations[v1alpha1.AgentPoolNodeCountAnnotationKey]
+	if !ok {
+		return 1, nil
+	}
+	count, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || count < 1 || count > maxAgentPoolNodeCount {
+		return 0, fmt.Errorf("annotation %s=%q of machine %s is not a node count between 1 and %d", v1alpha1.AgentPoolNodeCountAnnotationKey, value, machine.Name, maxAgentPoolNodeCount)
+	}
+	return int32(count), nil
+}
 
-	if nodeList == nil || len(nodeList.Items) == 0 {
-		// NotFound is not considered as an error
+// getOSSKU returns the OS SKU selected for the agent pool of the machine, nil if AKS picks the default of the cluster
+func getOSSKU(machine *v1alpha5.Machine) (*armcontainerservice.OSSKU, error) {
+	value, ok := machine.Annotations[v1alpha1.AgentPoolOSSKUAnnotationKey]
+	if !ok {
 		return nil, nil
 	}
+	osSKU, ok := lo.Find(linuxOSSKUs, func(osSKU armcontainerservice.OSSKU) bool { return strings.EqualFold(string(osSKU), value) })
+	if !ok {
+		return nil, fmt.Errorf("annotation %s=%q of machine %s is not one of the os skus %v", v1alpha1.AgentPoolOSSKUAnnotationKey, value, machine.Name, linuxOSSKUs)
+	}
+	return to.Ptr(osSKU), nil
+}
+
+// isOSSKUSupported returns whether the vm size can run the OS SKU. The nvidia drivers of Azure Linux are only
+// validated for some GPU vm sizes, any other vm size runs every OS SKU.
+func isOSSKUSupported(osSKU *armcontainerservice.OSSKU, vmSize string) bool {
+	switch lo.FromPtr(osSKU) {
+	case armcontainerservice.OSSKUAzureLinux, armcontainerservice.OSSKUCBLMariner:
+		return !utils.IsNvidiaEnabledSKU(vmSize) || utils.IsMarinerEnabledGPUSKU(vmSize)
+	default:
+		return true
+	}
+}
+
+// capacityTypeFromPriority maps the scale set priority of an agent pool to the karpenter capacity type
+func capacityTypeFromPriority(priority *armcontainerservice.ScaleSetPriority) string {
+	if lo.FromPtr(priority) == armcontainerservice.ScaleSetPrioritySpot {
+		return v1alpha5.CapacityTypeSpot
+	}
+	return v1alpha5.CapacityTypeOnDemand
+}
+
+// ToOSDiskSizeGB converts a storage request to the OS disk size of an agent pool, which AKS counts in GiB, rounding up
+// to the next GiB
+func ToOSDiskSizeGB(storage resource.Quantity) int32 {
+	return int32((storage.Value() + 1<<30 - 1) >> 30)
+}
+
+// FormatTaint returns the taint in the key=value:effect form used by agent pool node taints
+func FormatTaint(t v1.Taint) string {
+	return fmt.Sprintf("%s=%s:%s", t.Key, t.Value, t.Effect)
+}
+
+// getAgentPoolNodes returns the nodes of the agent pool from the informer cache, the watch keeps their readiness current
+func (p *Provider) getAgentPoolNodes(ctx context.Context, apName string) ([]v1.Node, error) {
+	nodeList := &v1.NodeList{}
+	if err := p.kubeClient.List(ctx, nodeList, client.MatchingFields{NodeAgentPoolIndex: apName}); err != nil {
+		return nil, err
+	}
+	return nodeList.Items, nil
+}
 
-	return &nodeList.Items[0], nil
+// NodeAgentPoolIndexFunc indexes a node by the name of its agent pool
+func NodeAgentPoolIndexFunc(o client.Object) []string {
+	if apName, ok := o.GetLabels()[AgentPoolLabelKey]; ok {
+		return []string{apName}
+	}
+	return nil
 }
@@ -20,13 +20,18 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
 	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/aws/karpenter-core/pkg/cloudprovider"
+	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
+	"github.com/azure/gpu-provisioner/pkg/cache"
 	"github.com/azure/gpu-provisioner/pkg/fake"
+	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
 	"github.com/azure/gpu-provisioner/pkg/tests"
 	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
@@ -34,22 +39,28 @@ import (
 	"go.uber.org/mock/gomock"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 func TestNewAgentPoolObject(t *testing.T) {
 	testCases := []struct {
-		name     string
-		vmSize   string
-		machine  *v1alpha5.Machine
-		expected armcontainerservice.AgentPool
+		name         string
+		vmSize       string
+		capacityType string
+		zones        []string
+		nodeCount    int32
+		osSKU        *armcontainerservice.OSSKU
+		machine      *v1alpha5.Machine
+		expected     armcontainerservice.AgentPool
 	}{
 		{
-			name:   "Machine with Storage requirement",
-			vmSize: "Standard_NC6s_v3",
+			name:         "Machine with Storage requirement",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
 			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
 				Requests: v1.ResourceList{
-					v1.ResourceStorage: lo.FromPtr(resource.NewQuantity(30, resource.DecimalSI)),
+					v1.ResourceStorage: resource.MustParse("30Gi"),
 				},
 			}, []v1.NodeSelectorRequirement{}),
 			expected: tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
@@ -57,8 +68,22 @@ func TestNewAgentPoolObject(t *testing.T) {
 				[]*string{}, 30, "Standard_NC6s_v3"),
 		},
 		{
-			name:   "Machine with no Storage requirement",
-			vmSize: "Standard_NC6s_v3",
+			name:         "Machine with a 128Gi Storage requirement",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
+			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
+				Requests: v1.ResourceList{
+					v1.ResourceStorage: resource.MustParse("128Gi"),
+				},
+			}, []v1.NodeSelectorRequirement{}),
+			expected: tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
+				armcontainerservice.ScaleSetPriorityRegular, map[string]*string{"test": to.Ptr("test")},
+				[]*string{}, 128, "Standard_NC6s_v3"),
+		},
+		{
+			name:         "Machine with no Storage requirement",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
 			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
 				Requests: v1.ResourceList{},
 			}, []v1.NodeSelectorRequirement{}),
@@ -66,13 +91,139 @@ func TestNewAgentPoolObject(t *testing.T) {
 				armcontainerservice.ScaleSetPriorityRegular, map[string]*string{"test": to.Ptr("test")},
 				[]*string{}, 0, "Standard_NC6s_v3"),
 		},
+		{
+			name:         "Zonal machine",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
+			zones:        []string{"eastus-1", "eastus-3"},
+			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
+				Requests: v1.ResourceList{},
+			}, []v1.NodeSelectorRequirement{}),
+			expected: func() armcontainerservice.AgentPool {
+				ap := tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
+					armcontainerservice.ScaleSetPriorityRegular, map[string]*string{"test": to.Ptr("test")},
+					[]*string{}, 0, "Standard_NC6s_v3")
+				ap.Properties.AvailabilityZones = []*string{to.Ptr("1"), to.Ptr("3")}
+				return ap
+			}(),
+		},
+		{
+			name:         "Spot machine",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeSpot,
+			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
+				Requests: v1.ResourceList{},
+			}, []v1.NodeSelectorRequirement{}),
+			expected: tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
+				armcontainerservice.ScaleSetPrioritySpot, map[string]*string{"test": to.Ptr("test")},
+				[]*string{}, 0, "Standard_NC6s_v3"),
+		},
+		{
+			name:         "Multi-node machine",
+			vmSize:       "Standard_ND96asr_v4",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
+			nodeCount:    4,
+			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
+				Requests: v1.ResourceList{},
+			}, []v1.NodeSelectorRequirement{}),
+			expected: func() armcontainerservice.AgentPool {
+				ap := tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
+					armcontainerservice.ScaleSetPriorityRegular, map[string]*string{"test": to.Ptr("test")},
+					[]*string{}, 0, "Standard_ND96asr_v4")
+				ap.Properties.Count = to.Ptr(int32(4))
+				return ap
+			}(),
+		},
+		{
+			name:         "Azure Linux machine",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
+			osSKU:        to.Ptr(armcontainerservice.OSSKUAzureLinux),
+			machine: tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
+				Requests: v1.ResourceList{},
+			}, []v1.NodeSelectorRequirement{}),
+			expected: func() armcontainerservice.AgentPool {
+				ap := tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
+					armcontainerservice.ScaleSetPriorityRegular, map[string]*string{"test": to.Ptr("test")},
+					[]*string{}, 0, "Standard_NC6s_v3")
+				ap.Properties.OSSKU = to.Ptr(armcontainerservice.OSSKUAzureLinux)
+				return ap
+			}(),
+		},
+		{
+			name:         "Machine targeting a kubernetes version",
+			vmSize:       "Standard_NC6s_v3",
+			capacityType: v1alpha5.CapacityTypeOnDemand,
+			machine: func() *v1alpha5.Machine {
+				machine := tests.GetMachineObj("machine-test", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{
+					Requests: v1.ResourceList{},
+				}, []v1.NodeSelectorRequirement{})
+				machine.Annotations = map[string]string{v1alpha1.AgentPoolKubernetesVersionAnnotationKey: "1.27.7"}
+				return machine
+			}(),
+			expected: func() armcontainerservice.AgentPool {
+				ap := tests.GetAgentPoolObj(armcontainerservice.AgentPoolTypeVirtualMachineScaleSets,
+					armcontainerservice.ScaleSetPriorityRegular, map[string]*string{"test": to.Ptr("test")},
+					[]*string{}, 0, "Standard_NC6s_v3")
+				ap.Properties.OrchestratorVersion = to.Ptr("1.27.7")
+				return ap
+			}(),
+		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			result := newAgentPoolObject(tc.vmSize, tc.machine)
+			nodeCount := lo.Ternary(tc.nodeCount == 0, int32(1), tc.nodeCount)
+			result := newAgentPoolObject(tc.vmSize, tc.capacityType, tc.zones, nodeCount, tc.osSKU, tc.machine)
 			assert.Equal(t, tc.expected.Properties.Type, result.Properties.Type)
+			assert.Equal(t, tc.expected.Properties.OSSKU, result.Properties.OSSKU)
+			assert.Equal(t, tc.expected.Properties.OrchestratorVersion, result.Properties.OrchestratorVersion)
+			assert.Equal(t, tc.expected.Properties.Count, result.Properties.Count)
 			assert.Equal(t, tc.expected.Properties.OSDiskSizeGB, result.Properties.OSDiskSizeGB)
+			assert.Equal(t, tc.expected.Properties.ScaleSetPriority, result.Properties.ScaleSetPriority)
+			assert.Equal(t, tc.expected.Properties.AvailabilityZones, result.Properties.AvailabilityZones)
+			if tc.capacityType == v1alpha5.CapacityTypeSpot {
+				assert.Equal(t, armcontainerservice.ScaleSetEvictionPolicyDelete, lo.FromPtr(result.Properties.ScaleSetEvictionPolicy))
+				assert.Equal(t, float32(-1), lo.FromPtr(result.Properties.SpotMaxPrice))
+			} else {
+				assert.Nil(t, result.Properties.ScaleSetEvictionPolicy)
+				assert.Nil(t, result.Properties.SpotMaxPrice)
+			}
+		})
+	}
+}
+
+func TestGetCapacityType(t *testing.T) {
+	testCases := []struct {
+		name         string
+		requirements []v1.NodeSelectorRequirement
+		expected     string
+	}{
+		{
+			name:     "No capacity type requirement is on-demand",
+			expected: v1alpha5.CapacityTypeOnDemand,
+		},
+		{
+			name:         "Spot requirement is spot",
+			requirements: []v1.NodeSelectorRequirement{{Key: v1alpha5.LabelCapacityType, Operator: v1.NodeSelectorOpIn, Values: []string{v1alpha5.CapacityTypeSpot}}},
+			expected:     v1alpha5.CapacityTypeSpot,
+		},
+		{
+			name:         "Spot is preferred when both are allowed",
+			requirements: []v1.NodeSelectorRequirement{{Key: v1alpha5.LabelCapacityType, Operator: v1.NodeSelectorOpIn, Values: []string{v1alpha5.CapacityTypeOnDemand, v1alpha5.CapacityTypeSpot}}},
+			expected:     v1alpha5.CapacityTypeSpot,
+		},
+		{
+			name:         "On-demand requirement is on-demand",
+			requirements: []v1.NodeSelectorRequirement{{Key: v1alpha5.LabelCapacityType, Operator: v1.NodeSelectorOpIn, Values: []string{v1alpha5.CapacityTypeOnDemand}}},
+			expected:     v1alpha5.CapacityTypeOnDemand,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := tests.GetMachineObj("machine-test", map[string]string{}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, tc.requirements)
+			assert.Equal(t, tc.expected, getCapacityType(machine))
 		})
 	}
 }
@@ -133,6 +284,7 @@ func TestGet(t *testing.T) {
 			}
 
 			mockK8sClient := fake.NewClient()
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
 			if tc.callK8sMocks != nil {
 				tc.callK8sMocks(mockK8sClient)
 			}
@@ -153,12 +305,69 @@ func TestGet(t *testing.T) {
 	}
 }
 
+func TestGetNotFound(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool0", gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError())
+
+	p := createTestProvider(agentPoolMocks, fake.NewClient())
+
+	instance, err := p.Get(context.Background(), "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0")
+	assert.Nil(t, instance)
+	assert.True(t, cloudprovider.IsMachineNotFoundError(err), "Expected a MachineNotFound error, got %v", err)
+}
+
+func TestGetCapacityFailure(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+	ap.Properties.ProvisioningState = to.Ptr(ProvisioningStateCreating)
+	ap.Properties.Tags = map[string]*string{ManagedByTagKey: to.Ptr("testCluster"), MachineNameTagKey: to.Ptr("agentpool0")}
+
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool0", gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{AgentPool: ap}, nil)
+	agentPoolMocks.EXPECT().NewListPager(gomock.Any(), gomock.Any(), gomock.Any()).Return(runtime.NewPager(runtime.PagingHandler[armcontainerservice.AgentPoolsClientListResponse]{
+		More: func(armcontainerservice.AgentPoolsClientListResponse) bool { return false },
+		Fetcher: func(context.Context, *armcontainerservice.AgentPoolsClientListResponse) (armcontainerservice.AgentPoolsClientListResponse, error) {
+			return armcontainerservice.AgentPoolsClientListResponse{AgentPoolListResult: armcontainerservice.AgentPoolListResult{Value: []*armcontainerservice.AgentPool{&ap}}}, nil
+		},
+	}))
+
+	// AKS ran out of capacity after it accepted the agent pool
+	mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
+	gomock.InOrder(
+		mockHandler.EXPECT().Done().Return(false),
+		mockHandler.EXPECT().Poll(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil),
+		mockHandler.EXPECT().Done().Return(true).AnyTimes(),
+	)
+	mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(tests.AzErrorWithCode(AllocationFailed))
+
+	mockK8sClient := fake.NewClient()
+	mockReadyNode(mockK8sClient)
+	mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+	p := createTestProvider(agentPoolMocks, mockK8sClient)
+	p.setCreatePoller("agentpool0", newCreatePoller(t, mockHandler))
+
+	instance, err := p.Get(context.Background(), "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0")
+	assert.Nil(t, instance)
+	assert.True(t, cloudprovider.IsInsufficientCapacityError(err), "Expected an InsufficientCapacity error, got %v", err)
+	assert.True(t, p.unavailableOfferings.IsUnavailable("Standard_NC6s_v3", "", v1alpha5.CapacityTypeOnDemand))
+
+	// the machine of the agent pool is garbage collected
+	instances, err := p.List(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, instances)
+}
+
 func TestFromAgentPoolToInstance(t *testing.T) {
 	testCases := []struct {
 		name          string
 		callK8sMocks  func(c *fake.MockClient)
 		mockAgentPool armcontainerservice.AgentPool
-		isInstanceNil bool
+		expectedState string
 		expectedError error
 	}{
 		{
@@ -177,15 +386,49 @@ func TestFromAgentPoolToInstance(t *testing.T) {
 
 				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
 			},
+			expectedState: InstanceStateReady,
 		},
 		{
-			name:          "Fail to get instance from agent pool because node is nil",
+			name:          "Get instance from agent pool whose node is not ready",
 			mockAgentPool: tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3"),
 			callK8sMocks: func(c *fake.MockClient) {
-
+				node := tests.ReadyNode
+				node.Status.Conditions = []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionFalse}}
+				c.CreateMapWithType(&v1.NodeList{})[client.ObjectKeyFromObject(&node)] = &node
 				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
 			},
-			isInstanceNil: true,
+			expectedState: InstanceStateNotReady,
+		},
+		{
+			name: "Get instance from multi-node agent pool whose nodes are not all ready",
+			mockAgentPool: func() armcontainerservice.AgentPool {
+				ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_ND96asr_v4")
+				ap.Properties.Count = to.Ptr(int32(2))
+				return ap
+			}(),
+			callK8sMocks: func(c *fake.MockClient) {
+				mockReadyNode(c)
+				c.On("Patch", mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything, mock.Anything).Return(nil)
+			},
+			expectedState: InstanceStateNotReady,
+		},
+		{
+			name: "Get instance from agent pool that failed to provision",
+			mockAgentPool: func() armcontainerservice.AgentPool {
+				ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+				ap.Properties.ProvisioningState = to.Ptr(ProvisioningStateFailed)
+				return ap
+			}(),
+			callK8sMocks:  mockReadyNode,
+			expectedState: ProvisioningStateFailed,
+		},
+		{
+			name:          "Fail to get instance from agent pool because no node to predict the provider id from is found",
+			mockAgentPool: tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3"),
+			callK8sMocks: func(c *fake.MockClient) {
+				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+			},
+			expectedError: errors.New("no node of an AKS scale set found"),
 		},
 		{
 			name:          "Fail to get instance from agent pool due to error in retrieving node list",
@@ -210,6 +453,7 @@ func TestFromAgentPoolToInstance(t *testing.T) {
 			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
 
 			mockK8sClient := fake.NewClient()
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
 			if tc.callK8sMocks != nil {
 				tc.callK8sMocks(mockK8sClient)
 			}
@@ -220,13 +464,10 @@ func TestFromAgentPoolToInstance(t *testing.T) {
 
 			if tc.expectedError == nil {
 				assert.NoError(t, err, "Not expected to return error")
-				if !tc.isInstanceNil {
-					assert.NotNil(t, instance, "Response instance should not be nil")
-					assert.Equal(t, tc.mockAgentPool.Name, instance.Name, "Instance name should be same as the agent pool")
-					assert.Equal(t, tc.mockAgentPool.Properties.VMSize, instance.Type, "Instance type should be same as agent pool's vm size")
-				} else {
-					assert.Nil(t, instance, "Response instance should be nil")
-				}
+				assert.NotNil(t, instance, "Response instance should not be nil")
+				assert.Equal(t, tc.mockAgentPool.Name, instance.Name, "Instance name should be same as the agent pool")
+				assert.Equal(t, tc.mockAgentPool.Properties.VMSize, instance.Type, "Instance type should be same as agent pool's vm size")
+				assert.Equal(t, tc.expectedState, lo.FromPtr(instance.State))
 			} else {
 				assert.Contains(t, err.Error(), tc.expectedError.Error())
 			}
@@ -241,6 +482,7 @@ func TestDelete(t *testing.T) {
 		id                string
 		mockAgentPoolResp func(mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientDeleteResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientDeleteResponse], error)
 		expectedError     error
+		expectedNotFound  bool
 	}{
 		{
 			name: "Successfully delete instance",
@@ -262,7 +504,7 @@ func TestDelete(t *testing.T) {
 			},
 		},
 		{
-			name: "Successfully deletes instance because poller returns a 404 not found error",
+			name: "Fail to delete instance with MachineNotFound because poller returns a 404 not found error",
 			id:   "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0",
 			mockAgentPoolResp: func(mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientDeleteResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientDeleteResponse], error) {
 				delResp := armcontainerservice.AgentPoolsClientDeleteResponse{}
@@ -279,6 +521,7 @@ func TestDelete(t *testing.T) {
 				p, err := runtime.NewPoller(&resp, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil), pollingOptions)
 				return p, err
 			},
+			expectedNotFound: true,
 		},
 		{
 			name: "Fail to delete instance because poller returns error",
@@ -301,11 +544,12 @@ func TestDelete(t *testing.T) {
 			expectedError: errors.New("Failed to fetch latest status of operation"),
 		},
 		{
-			name: "Successfully delete instance because agentPool.Delete returns a NotFound error",
+			name: "Fail to delete instance with MachineNotFound because agentPool.Delete returns a NotFound error",
 			id:   "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0",
 			mockAgentPoolResp: func(mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientDeleteResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientDeleteResponse], error) {
 				return nil, tests.NotFoundAzError()
 			},
+			expectedNotFound: true,
 		},
 		{
 			name: "Fail to delete instance because agentPool.Delete returns a failure",
@@ -340,7 +584,9 @@ func TestDelete(t *testing.T) {
 
 			err := p.Delete(context.Background(), tc.id)
 
-			if tc.expectedError == nil {
+			if tc.expectedNotFound {
+				assert.True(t, cloudprovider.IsMachineNotFoundError(err), "Expected a MachineNotFound error, got %v", err)
+			} else if tc.expectedError == nil {
 				assert.NoError(t, err, "Not expected to return error")
 			} else {
 				assert.Contains(t, err.Error(), tc.expectedError.Error())
@@ -361,10 +607,14 @@ func TestList(t *testing.T) {
 			name: "Successfully list instances",
 			mockAgentPoolList: func() []*armcontainerservice.AgentPool {
 				ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+				ap.Properties.Tags = map[string]*string{ManagedByTagKey: to.Ptr("testCluster")}
 				ap1 := tests.GetAgentPoolObjWithName("agentpool1", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+				ap1.Properties.Tags = map[string]*string{ManagedByTagKey: to.Ptr("testCluster")}
+				// the system agent pool is not owned by the controller
+				system := tests.GetAgentPoolObjWithName("nodepool1", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-nodepool1-20562481-vmss", "Standard_D4s_v3")
 
 				return []*armcontainerservice.AgentPool{
-					&ap, &ap1,
+					&ap, &ap1, &system,
 				}
 			},
 			mockAgentPoolResp: func(apList []*armcontainerservice.AgentPool) *runtime.Pager[armcontainerservice.AgentPoolsClientListResponse] {
@@ -395,6 +645,22 @@ func TestList(t *testing.T) {
 				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
 			},
 		},
+		{
+			name: "Successfully list no instances",
+			mockAgentPoolList: func() []*armcontainerservice.AgentPool {
+				return []*armcontainerservice.AgentPool{}
+			},
+			mockAgentPoolResp: func(apList []*armcontainerservice.AgentPool) *runtime.Pager[armcontainerservice.AgentPoolsClientListResponse] {
+				return runtime.NewPager(runtime.PagingHandler[armcontainerservice.AgentPoolsClientListResponse]{
+					More: func(page armcontainerservice.AgentPoolsClientListResponse) bool {
+						return false
+					},
+					Fetcher: func(ctx context.Context, page *armcontainerservice.AgentPoolsClientListResponse) (armcontainerservice.AgentPoolsClientListResponse, error) {
+						return armcontainerservice.AgentPoolsClientListResponse{}, nil
+					},
+				})
+			},
+		},
 		{
 			name: "Fail to list instances because pager fails to fetch page",
 			mockAgentPoolList: func() []*armcontainerservice.AgentPool {
@@ -426,6 +692,7 @@ func TestList(t *testing.T) {
 			}
 
 			mockK8sClient := fake.NewClient()
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
 			if tc.callK8sMocks != nil {
 				tc.callK8sMocks(mockK8sClient)
 			}
@@ -437,11 +704,14 @@ func TestList(t *testing.T) {
 			if tc.expectedError == nil {
 				assert.NoError(t, err, "Not expected to return error")
 				assert.NotNil(t, instanceList, "Response instance list should not be nil")
-				assert.Equal(t, len(tc.mockAgentPoolList()), len(instanceList), "Number of Instances should be same as number of agent pools")
+				owned := lo.Filter(tc.mockAgentPoolList(), func(ap *armcontainerservice.AgentPool, _ int) bool {
+					return ap.Properties.Tags[ManagedByTagKey] != nil
+				})
+				assert.Equal(t, len(owned), len(instanceList), "Number of Instances should be same as number of owned agent pools")
 
-				for i := range tc.mockAgentPoolList() {
-					assert.Equal(t, tc.mockAgentPoolList()[i].Name, instanceList[i].Name, "Instance name should be same as agent pool")
-					assert.Equal(t, tc.mockAgentPoolList()[i].Properties.VMSize, instanceList[i].Type, "Instance type should be same as agent pool's vm size")
+				for i := range owned {
+					assert.Equal(t, owned[i].Name, instanceList[i].Name, "Instance name should be same as agent pool")
+					assert.Equal(t, owned[i].Properties.VMSize, instanceList[i].Type, "Instance type should be same as agent pool's vm size")
 				}
 			} else {
 				assert.EqualError(t, err, tc.expectedError.Error())
@@ -450,6 +720,38 @@ func TestList(t *testing.T) {
 	}
 }
 
+func TestListUnpredictableProviderID(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0"
+	ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+	ap.Properties.Tags = map[string]*string{ManagedByTagKey: to.Ptr("testCluster")}
+	ap1 := tests.GetAgentPoolObjWithName("agentpool1", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool1-20562481-vmss", "Standard_NC6s_v3")
+	ap1.Properties.Tags = map[string]*string{ManagedByTagKey: to.Ptr("testCluster")}
+
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().NewListPager(gomock.Any(), gomock.Any(), gomock.Any()).Return(runtime.NewPager(runtime.PagingHandler[armcontainerservice.AgentPoolsClientListResponse]{
+		More: func(armcontainerservice.AgentPoolsClientListResponse) bool { return false },
+		Fetcher: func(context.Context, *armcontainerservice.AgentPoolsClientListResponse) (armcontainerservice.AgentPoolsClientListResponse, error) {
+			return armcontainerservice.AgentPoolsClientListResponse{AgentPoolListResult: armcontainerservice.AgentPoolListResult{Value: []*armcontainerservice.AgentPool{&ap, &ap1}}}, nil
+		},
+	}))
+
+	// no node of the cluster is in a scale set, only the machine of agentpool0 recorded its provider id
+	mockK8sClient := fake.NewClient()
+	mockK8sClient.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+	mockK8sClient.CreateOrUpdateObjectInMap(&v1alpha5.Machine{ObjectMeta: metav1.ObjectMeta{Name: "agentpool0"}, Status: v1alpha5.MachineStatus{ProviderID: providerID}})
+	mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+	p := createTestProvider(agentPoolMocks, mockK8sClient)
+
+	instances, err := p.List(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "agentpool0", lo.FromPtr(instances[0].Name))
+	assert.Equal(t, providerID, lo.FromPtr(instances[0].ID))
+}
+
 func TestFromAPListToInstanceFailure(t *testing.T) {
 	testCases := []struct {
 		name              string
@@ -457,15 +759,6 @@ func TestFromAPListToInstanceFailure(t *testing.T) {
 		mockAgentPoolList func(id string) []*armcontainerservice.AgentPool
 		expectedError     func(err string) error
 	}{
-		{
-			name: "Fail to get instance from agent pool list because no agentpools are found",
-			mockAgentPoolList: func(id string) []*armcontainerservice.AgentPool {
-				return []*armcontainerservice.AgentPool{}
-			},
-			expectedError: func(err string) error {
-				return errors.New("no agentpools found")
-			},
-		},
 		{
 			name: "Fail to get instance from agent pool list because agentpool subId can't be parsed",
 			id:   "/subscriptions/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss",
@@ -501,97 +794,45 @@ func TestFromAPListToInstanceFailure(t *testing.T) {
 }
 
 func TestCreateSuccess(t *testing.T) {
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-%s-20562481-vmss/virtualMachines/0"
 	testCases := []struct {
-		name              string
-		machine           *v1alpha5.Machine
-		mockAgentPoolResp func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error)
-		callK8sMocks      func(c *fake.MockClient)
+		name                string
+		machine             *v1alpha5.Machine
+		done                bool
+		expectedResumeToken bool
 	}{
 		{
-			name: "Successfully create instance",
-			machine: tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+			name: "Return while the agent pool is being created",
+			machine: tests.GetMachineObj("agentpool1", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
 				{
 					Key:      "node.kubernetes.io/instance-type",
 					Operator: "In",
 					Values:   []string{"Standard_NC6s_v3"},
 				},
 			}),
-			mockAgentPoolResp: func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
-				ap := tests.GetAgentPoolObjWithName(machine.Name, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", machine.Spec.Requirements[0].Values[0])
-
-				createResp := armcontainerservice.AgentPoolsClientCreateOrUpdateResponse{
-					AgentPool: ap,
-				}
-				resp := http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}
-
-				mockHandler.EXPECT().Done().Return(true).Times(3)
-				mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(nil)
-
-				pollingOptions := &runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]{
-					Handler:  mockHandler,
-					Response: &createResp,
-				}
-
-				p, err := runtime.NewPoller(&resp, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil), pollingOptions)
-				return p, err
-			},
-			callK8sMocks: func(c *fake.MockClient) {
-				nodeList := tests.GetNodeList([]v1.Node{tests.ReadyNode})
-				relevantMap := c.CreateMapWithType(nodeList)
-				//insert node objects into the map
-				for _, obj := range nodeList.Items {
-					n := obj
-					objKey := client.ObjectKeyFromObject(&n)
-
-					relevantMap[objKey] = &n
-				}
-
-				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
-			},
+			expectedResumeToken: true,
 		},
 		{
-			name: "Successfully create instance after waiting for node to be ready",
-			machine: tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+			name: "Return while the agent pool is being created for a machine name that is not a valid agent pool name",
+			machine: tests.GetMachineObj("workspace-falcon-7b", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
 				{
 					Key:      "node.kubernetes.io/instance-type",
 					Operator: "In",
 					Values:   []string{"Standard_NC6s_v3"},
 				},
 			}),
-			mockAgentPoolResp: func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
-				ap := tests.GetAgentPoolObjWithName(machine.Name, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", machine.Spec.Requirements[0].Values[0])
-
-				createResp := armcontainerservice.AgentPoolsClientCreateOrUpdateResponse{
-					AgentPool: ap,
-				}
-				resp := http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}
-
-				mockHandler.EXPECT().Done().Return(true).Times(3)
-				mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(nil)
-
-				pollingOptions := &runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]{
-					Handler:  mockHandler,
-					Response: &createResp,
-				}
-
-				p, err := runtime.NewPoller(&resp, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil), pollingOptions)
-				return p, err
-			},
-			callK8sMocks: func(c *fake.MockClient) {
-				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil).Once().Run(func(args mock.Arguments) {
-					nodeList := tests.GetNodeList([]v1.Node{tests.ReadyNode})
-					relevantMap := c.CreateMapWithType(nodeList)
-					//insert node objects into the map
-					for _, obj := range nodeList.Items {
-						n := obj
-						objKey := client.ObjectKeyFromObject(&n)
-
-						relevantMap[objKey] = &n
-					}
-				})
-
-				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil).Once()
-			},
+			expectedResumeToken: true,
+		},
+		{
+			name: "Agent pool creation finishes right away",
+			machine: tests.GetMachineObj("agentpool1", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+				{
+					Key:      "node.kubernetes.io/instance-type",
+					Operator: "In",
+					Values:   []string{"Standard_NC6s_v3"},
+				},
+			}),
+			done: true,
 		},
 	}
 
@@ -600,18 +841,15 @@ func TestCreateSuccess(t *testing.T) {
 			mockCtrl := gomock.NewController(t)
 			defer mockCtrl.Finish()
 
+			apName := AgentPoolName(tc.machine.Name)
 			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
-			if tc.mockAgentPoolResp != nil {
-				mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
-
-				p, err := tc.mockAgentPoolResp(tc.machine, mockHandler)
-				agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), tc.machine.Name, gomock.Any(), gomock.Any()).Return(p, err)
-			}
+			mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
+			mockHandler.EXPECT().Done().Return(tc.done).AnyTimes()
+			agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), apName, gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError())
+			agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), apName, gomock.Any(), gomock.Any()).Return(newCreatePoller(t, mockHandler), nil)
 
 			mockK8sClient := fake.NewClient()
-			if tc.callK8sMocks != nil {
-				tc.callK8sMocks(mockK8sClient)
-			}
+			mockReadyNode(mockK8sClient)
 
 			p := createTestProvider(agentPoolMocks, mockK8sClient)
 
@@ -619,8 +857,12 @@ func TestCreateSuccess(t *testing.T) {
 
 			assert.NoError(t, err, "Not expected to return error")
 			assert.NotNil(t, instance, "Response instance should not be nil")
-			assert.Equal(t, &tc.machine.Name, instance.Name, "Instance name should be same as machine name")
+			assert.Equal(t, apName, lo.FromPtr(instance.Name), "Instance name should be the agent pool name of the machine")
 			assert.Equal(t, &tc.machine.Spec.Requirements[0].Values[0], instance.Type, "Instance type should be same as machine's instance type")
+			assert.Equal(t, ProvisioningStateCreating, lo.FromPtr(instance.State))
+			assert.Equal(t, fmt.Sprintf(providerID, apName), lo.FromPtr(instance.ID), "Provider id should be predicted from the other nodes")
+			assert.Equal(t, tc.expectedResumeToken, instance.CreateResumeToken != nil)
+			assert.Equal(t, tc.expectedResumeToken, p.createPollers[apName] != nil)
 		})
 	}
 }
@@ -634,42 +876,7 @@ func TestCreateFailure(t *testing.T) {
 		expectedError     error
 	}{
 		{
-			name: "Fail to create instance because node is not found and returns error on retry",
-			machine: tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
-				{
-					Key:      "node.kubernetes.io/instance-type",
-					Operator: "In",
-					Values:   []string{"Standard_NC6s_v3"},
-				},
-			}),
-			mockAgentPoolResp: func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
-				ap := tests.GetAgentPoolObjWithName(machine.Name, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", machine.Spec.Requirements[0].Values[0])
-
-				createResp := armcontainerservice.AgentPoolsClientCreateOrUpdateResponse{
-					AgentPool: ap,
-				}
-				resp := http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}
-
-				mockHandler.EXPECT().Done().Return(true).Times(3)
-				mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(nil)
-
-				pollingOptions := &runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]{
-					Handler:  mockHandler,
-					Response: &createResp,
-				}
-
-				p, err := runtime.NewPoller(&resp, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil), pollingOptions)
-				return p, err
-			},
-			callK8sMocks: func(c *fake.MockClient) {
-				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil).Once()
-
-				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(errors.New("fail to find the node object"))
-			},
-			expectedError: errors.New("fail to find the node object"),
-		},
-		{
-			name: "Fail to create instance because node object is not found",
+			name: "Fail to create instance because no node to predict the provider id from is found",
 			machine: tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
 				{
 					Key:      "node.kubernetes.io/instance-type",
@@ -677,32 +884,13 @@ func TestCreateFailure(t *testing.T) {
 					Values:   []string{"Standard_NC6s_v3"},
 				},
 			}),
-			mockAgentPoolResp: func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
-				ap := tests.GetAgentPoolObjWithName(machine.Name, "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", machine.Spec.Requirements[0].Values[0])
-
-				createResp := armcontainerservice.AgentPoolsClientCreateOrUpdateResponse{
-					AgentPool: ap,
-				}
-				resp := http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}
-
-				mockHandler.EXPECT().Done().Return(true).Times(3)
-				mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(nil)
-
-				pollingOptions := &runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]{
-					Handler:  mockHandler,
-					Response: &createResp,
-				}
-
-				p, err := runtime.NewPoller(&resp, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil), pollingOptions)
-				return p, err
-			},
 			callK8sMocks: func(c *fake.MockClient) {
 				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
 			},
-			expectedError: errors.New("fail to find the node object"),
+			expectedError: errors.New("no node of an AKS scale set found"),
 		},
 		{
-			name: "Fail to delete instance because poller returns error",
+			name: "Fail to create instance because listing nodes fails",
 			machine: tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
 				{
 					Key:      "node.kubernetes.io/instance-type",
@@ -710,24 +898,10 @@ func TestCreateFailure(t *testing.T) {
 					Values:   []string{"Standard_NC6s_v3"},
 				},
 			}),
-			mockAgentPoolResp: func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
-				createResp := armcontainerservice.AgentPoolsClientCreateOrUpdateResponse{
-					AgentPool: armcontainerservice.AgentPool{},
-				}
-				resp := http.Response{StatusCode: http.StatusBadRequest, Body: http.NoBody}
-
-				mockHandler.EXPECT().Done().Return(false)
-				mockHandler.EXPECT().Poll(gomock.Any()).Return(&resp, errors.New("Failed to fetch latest status of operation"))
-
-				pollingOptions := &runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]{
-					Handler:  mockHandler,
-					Response: &createResp,
-				}
-
-				p, err := runtime.NewPoller(&resp, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil), pollingOptions)
-				return p, err
+			callK8sMocks: func(c *fake.MockClient) {
+				c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(errors.New("fail to list nodes"))
 			},
-			expectedError: errors.New("Failed to fetch latest status of operation"),
+			expectedError: errors.New("fail to list nodes"),
 		},
 		{
 			name: "Fail to create instance because agentPool.CreateOrUpdate returns a failure",
@@ -741,6 +915,7 @@ func TestCreateFailure(t *testing.T) {
 			mockAgentPoolResp: func(machine *v1alpha5.Machine, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
 				return nil, errors.New("Failed to create agent pool")
 			},
+			callK8sMocks:  mockReadyNode,
 			expectedError: errors.New("Failed to create agent pool"),
 		},
 		{
@@ -748,12 +923,6 @@ func TestCreateFailure(t *testing.T) {
 			machine:       tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{}),
 			expectedError: errors.New("machine spec has no requirement for instance type"),
 		},
-		{
-			name:    "Fail to create instance because of invalid machine name",
-			machine: tests.GetMachineObj("invalid-machine-name", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{}),
-
-			expectedError: errors.New("the length agentpool name should be less than 11"),
-		},
 	}
 
 	for _, tc := range testCases {
@@ -766,7 +935,8 @@ func TestCreateFailure(t *testing.T) {
 				mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
 
 				p, err := tc.mockAgentPoolResp(tc.machine, mockHandler)
-				agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), tc.machine.Name, gomock.Any(), gomock.Any()).Return(p, err)
+				agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), AgentPoolName(tc.machine.Name), gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError())
+				agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), AgentPoolName(tc.machine.Name), gomock.Any(), gomock.Any()).Return(p, err)
 			}
 
 			mockK8sClient := fake.NewClient()
@@ -784,7 +954,618 @@ func TestCreateFailure(t *testing.T) {
 	}
 }
 
+func TestCreateFallback(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	machine := tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+		{
+			Key:      "node.kubernetes.io/instance-type",
+			Operator: "In",
+			Values:   []string{"Standard_NC12s_v3", "Standard_NC6s_v3"},
+		},
+	})
+
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
+	mockHandler.EXPECT().Done().Return(false).AnyTimes()
+	poller := newCreatePoller(t, mockHandler)
+
+	// the cheapest size is tried first, fails, gets cleaned up, and the next size is used
+	gomock.InOrder(
+		agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError()),
+		agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, _, _, _ string, ap armcontainerservice.AgentPool, _ *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
+				assert.Equal(t, "Standard_NC6s_v3", lo.FromPtr(ap.Properties.VMSize))
+				return nil, tests.AzErrorWithCode(AllocationFailed)
+			}),
+		agentPoolMocks.EXPECT().BeginDelete(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any()).Return(nil, tests.NotFoundAzError()),
+		agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any(), gomock.Any()).
+			DoAndReturn(func(_ context.Context, _, _, _ string, ap armcontainerservice.AgentPool, _ *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
+				assert.Equal(t, "Standard_NC12s_v3", lo.FromPtr(ap.Properties.VMSize))
+				return poller, nil
+			}),
+	)
+
+	mockK8sClient := fake.NewClient()
+	mockReadyNode(mockK8sClient)
+
+	p := createTestProvider(agentPoolMocks, mockK8sClient)
+
+	instance, err := p.Create(context.Background(), machine)
+	assert.NoError(t, err, "Not expected to return error")
+	assert.Equal(t, "Standard_NC12s_v3", lo.FromPtr(instance.Type))
+	assert.True(t, p.unavailableOfferings.IsUnavailable("Standard_NC6s_v3", "", v1alpha5.CapacityTypeOnDemand), "failed size should be marked unavailable")
+	assert.False(t, p.unavailableOfferings.IsUnavailable("Standard_NC12s_v3", "", v1alpha5.CapacityTypeOnDemand))
+}
+
+func TestCreateNoFallbackOnNonCapacityError(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	machine := tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+		{
+			Key:      "node.kubernetes.io/instance-type",
+			Operator: "In",
+			Values:   []string{"Standard_NC12s_v3", "Standard_NC6s_v3"},
+		},
+	})
+
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any(), gomock.Any()).Return(nil, tests.AzErrorWithCode("InvalidParameter")).Times(1)
+	agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError())
+
+	mockK8sClient := fake.NewClient()
+	mockReadyNode(mockK8sClient)
+	p := createTestProvider(agentPoolMocks, mockK8sClient)
+
+	instance, err := p.Create(context.Background(), machine)
+	assert.Nil(t, instance)
+	assert.ErrorContains(t, err, "InvalidParameter")
+	assert.False(t, cloudprovider.IsInsufficientCapacityError(err))
+	assert.False(t, p.unavailableOfferings.IsUnavailable("Standard_NC6s_v3", "", v1alpha5.CapacityTypeOnDemand))
+}
+
+func TestCreateAllOfferingsUnavailable(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	machine := tests.GetMachineObj("agentpool0", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+		{
+			Key:      "node.kubernetes.io/instance-type",
+			Operator: "In",
+			Values:   []string{"Standard_NC6s_v3"},
+		},
+	})
+
+	agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+	agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any(), gomock.Any()).Return(nil, tests.AzErrorWithCode(SKUNotAvailable)).Times(1)
+	agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), machine.Name, gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{}, tests.NotFoundAzError()).Times(2)
+
+	mockK8sClient := fake.NewClient()
+	mockReadyNode(mockK8sClient)
+	p := createTestProvider(agentPoolMocks, mockK8sClient)
+
+	_, err := p.Create(context.Background(), machine)
+	assert.True(t, cloudprovider.IsInsufficientCapacityError(err))
+	assert.True(t, p.unavailableOfferings.IsUnavailable("Standard_NC6s_v3", "", v1alpha5.CapacityTypeOnDemand))
+
+	// the next create skips the unavailable size without trying to create the agent pool
+	_, err = p.Create(context.Background(), machine)
+	assert.True(t, cloudprovider.IsInsufficientCapacityError(err))
+}
+
+func TestCreateExistingAgentPool(t *testing.T) {
+	providerID := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool1-20562481-vmss/virtualMachines/0"
+	testCases := []struct {
+		name          string
+		uid           string
+		vmSize        string
+		state         string
+		nodeCount     string
+		osSKU         string
+		instanceTypes []string
+		// createFailure is the error the creation of the agent pool polled by this controller finishes with
+		createFailure  error
+		deleted        bool
+		recreated      bool
+		expectedVMSize string
+		expectedICE    bool
+		expectedError  string
+	}{
+		{
+			name:   "Agent pool created for the machine is adopted",
+			uid:    "machine-uid",
+			vmSize: "Standard_NC6s_v3",
+			state:  ProvisioningStateCreating,
+		},
+		{
+			name:          "Agent pool created for the machine does not match its spec",
+			uid:           "machine-uid",
+			vmSize:        "Standard_NC12s_v3",
+			state:         ProvisioningStateCreating,
+			expectedError: "does not match the machine spec, vm size Standard_NC12s_v3 is not one of the requested instance types",
+		},
+		{
+			name:          "Agent pool created for the machine does not have the requested node count",
+			uid:           "machine-uid",
+			vmSize:        "Standard_NC6s_v3",
+			nodeCount:     "2",
+			state:         ProvisioningStateCreating,
+			expectedError: "does not match the machine spec, node count 1 is not the requested node count 2",
+		},
+		{
+			name:          "Agent pool created for the machine does not have the requested os sku",
+			uid:           "machine-uid",
+			vmSize:        "Standard_NC6s_v3",
+			osSKU:         "AzureLinux",
+			state:         ProvisioningStateCreating,
+			expectedError: "does not match the machine spec, os sku Ubuntu is not the requested os sku AzureLinux",
+		},
+		{
+			name:          "Agent pool of another machine is not touched",
+			uid:           "other-uid",
+			vmSize:        "Standard_NC6s_v3",
+			state:         "Succeeded",
+			expectedError: `agent pool "agentpool1" already exists and is not owned by machine agentpool1`,
+		},
+		{
+			name:          "Agent pool without owner is not touched",
+			vmSize:        "Standard_NC6s_v3",
+			state:         "Succeeded",
+			expectedError: `agent pool "agentpool1" already exists and is not owned by machine agentpool1`,
+		},
+		{
+			name:      "Agent pool created for the machine that failed is created again",
+			uid:       "machine-uid",
+			vmSize:    "Standard_NC6s_v3",
+			state:     ProvisioningStateFailed,
+			deleted:   true,
+			recreated: true,
+		},
+		{
+			name:           "Agent pool created for the machine that failed for lack of capacity is created with the remaining instance types",
+			uid:            "machine-uid",
+			vmSize:         "Standard_NC6s_v3",
+			state:          ProvisioningStateCreating,
+			instanceTypes:  []string{"Standard_NC6s_v3", "Standard_NC12s_v3"},
+			createFailure:  tests.AzErrorWithCode(AllocationFailed),
+			deleted:        true,
+			recreated:      true,
+			expectedVMSize: "Standard_NC12s_v3",
+		},
+		{
+			name:          "Agent pool created for the machine that failed for lack of capacity has no remaining instance types",
+			uid:           "machine-uid",
+			vmSize:        "Standard_NC6s_v3",
+			state:         ProvisioningStateCreating,
+			createFailure: tests.AzErrorWithCode(AllocationFailed),
+			deleted:       true,
+			expectedICE:   true,
+			expectedError: "all requested instance types [Standard_NC6s_v3] are currently unavailable",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			instanceTypes := lo.Ternary(len(tc.instanceTypes) > 0, tc.instanceTypes, []string{"Standard_NC6s_v3"})
+			machine := tests.GetMachineObj("agentpool1", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+				{
+					Key:      "node.kubernetes.io/instance-type",
+					Operator: "In",
+					Values:   instanceTypes,
+				},
+			})
+			machine.UID = "machine-uid"
+			machine.Annotations = map[string]string{}
+			if tc.nodeCount != "" {
+				machine.Annotations[v1alpha1.AgentPoolNodeCountAnnotationKey] = tc.nodeCount
+			}
+			if tc.osSKU != "" {
+				machine.Annotations[v1alpha1.AgentPoolOSSKUAnnotationKey] = tc.osSKU
+			}
+
+			ap := tests.GetAgentPoolObjWithName("agentpool1", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool1-20562481-vmss", tc.vmSize)
+			ap.Properties.ProvisioningState = to.Ptr(tc.state)
+			ap.Properties.Tags = map[string]*string{MachineNameTagKey: to.Ptr(machine.Name)}
+			if tc.uid != "" {
+				ap.Properties.Tags[MachineUIDTagKey] = to.Ptr(tc.uid)
+			}
+
+			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+			agentPoolMocks.EXPECT().Get(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool1", gomock.Any()).Return(armcontainerservice.AgentPoolsClientGetResponse{AgentPool: ap}, nil)
+			deleteCall := agentPoolMocks.EXPECT().BeginDelete(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool1", gomock.Any()).Return(nil, tests.NotFoundAzError()).Times(lo.Ternary(tc.deleted, 1, 0))
+			if tc.recreated {
+				mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
+				mockHandler.EXPECT().Done().Return(false).AnyTimes()
+				agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool1", gomock.Any(), gomock.Any()).
+					DoAndReturn(func(_ context.Context, _, _, _ string, ap armcontainerservice.AgentPool, _ *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*createPoller, error) {
+						assert.Equal(t, lo.Ternary(tc.expectedVMSize != "", tc.expectedVMSize, "Standard_NC6s_v3"), lo.FromPtr(ap.Properties.VMSize))
+						return newCreatePoller(t, mockHandler), nil
+					}).After(deleteCall)
+			}
+
+			mockK8sClient := fake.NewClient()
+			mockReadyNode(mockK8sClient)
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+			p := createTestProvider(agentPoolMocks, mockK8sClient)
+			if tc.createFailure != nil {
+				mockHandler := fake.NewMockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse](mockCtrl)
+				gomock.InOrder(
+					mockHandler.EXPECT().Done().Return(false),
+					mockHandler.EXPECT().Poll(gomock.Any()).Return(&http.Response{StatusCode: http.StatusOK}, nil),
+					mockHandler.EXPECT().Done().Return(true).AnyTimes(),
+				)
+				mockHandler.EXPECT().Result(gomock.Any(), gomock.Any()).Return(tc.createFailure)
+				p.setCreatePoller("agentpool1", newCreatePoller(t, mockHandler))
+			}
+
+			instance, err := p.Create(context.Background(), machine)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				assert.Equal(t, tc.expectedICE, cloudprovider.IsInsufficientCapacityError(err))
+				assert.Nil(t, instance)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, providerID, lo.FromPtr(instance.ID))
+			assert.Equal(t, lo.Ternary(tc.expectedVMSize != "", tc.expectedVMSize, "Standard_NC6s_v3"), lo.FromPtr(instance.Type))
+			assert.Equal(t, ProvisioningStateCreating, lo.FromPtr(instance.State))
+			assert.Equal(t, tc.recreated, instance.CreateResumeToken != nil)
+		})
+	}
+}
+
+func TestOrderInstanceTypes(t *testing.T) {
+	testCases := []struct {
+		name        string
+		requested   []string
+		zones       []string
+		unavailable map[string]string // instance type to zone
+		expected    []string
+	}{
+		{
+			name:      "Instance types are sorted by on-demand price",
+			requested: []string{"Standard_NC24s_v3", "Standard_NC6s_v3", "Standard_NC12s_v3"},
+			zones:     []string{""},
+			expected:  []string{"Standard_NC6s_v3", "Standard_NC12s_v3", "Standard_NC24s_v3"},
+		},
+		{
+			name:      "Instance types without a known price go last in requested order",
+			requested: []string{"Standard_Unknown_2", "Standard_NC12s_v3", "Standard_Unknown_1", "Standard_NC6s_v3"},
+			zones:     []string{""},
+			expected:  []string{"Standard_NC6s_v3", "Standard_NC12s_v3", "Standard_Unknown_2", "Standard_Unknown_1"},
+		},
+		{
+			name:        "Unavailable instance types are skipped",
+			requested:   []string{"Standard_NC24s_v3", "Standard_NC6s_v3", "Standard_NC12s_v3"},
+			zones:       []string{""},
+			unavailable: map[string]string{"Standard_NC6s_v3": ""},
+			expected:    []string{"Standard_NC12s_v3", "Standard_NC24s_v3"},
+		},
+		{
+			name:        "Instance types unavailable in one of the zones are kept",
+			requested:   []string{"Standard_NC24s_v3", "Standard_NC6s_v3"},
+			zones:       []string{"eastus-1", "eastus-2"},
+			unavailable: map[string]string{"Standard_NC6s_v3": "eastus-1"},
+			expected:    []string{"Standard_NC6s_v3", "Standard_NC24s_v3"},
+		},
+		{
+			name:        "Instance types unavailable in the only requested zone are skipped",
+			requested:   []string{"Standard_NC24s_v3", "Standard_NC6s_v3"},
+			zones:       []string{"eastus-1"},
+			unavailable: map[string]string{"Standard_NC6s_v3": "eastus-1"},
+			expected:    []string{"Standard_NC24s_v3"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := createTestProvider(nil, nil)
+			for instanceType, zone := range tc.unavailable {
+				p.unavailableOfferings.MarkUnavailable(context.Background(), "test", instanceType, zone, v1alpha5.CapacityTypeOnDemand)
+			}
+			assert.Equal(t, tc.expected, p.orderInstanceTypes(tc.requested, tc.zones, v1alpha5.CapacityTypeOnDemand))
+		})
+	}
+}
+
+func TestGetZones(t *testing.T) {
+	testCases := []struct {
+		name         string
+		requirements []v1.NodeSelectorRequirement
+		expected     []string
+	}{
+		{
+			name:     "No zone requirement is regional",
+			expected: []string{""},
+		},
+		{
+			name:         "Zone requirement",
+			requirements: []v1.NodeSelectorRequirement{{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"eastus-2", "eastus-1"}}},
+			expected:     []string{"eastus-1", "eastus-2"},
+		},
+		{
+			name:         "Alternative zone requirement",
+			requirements: []v1.NodeSelectorRequirement{{Key: v1alpha1.AlternativeLabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"eastus-3"}}},
+			expected:     []string{"eastus-3"},
+		},
+		{
+			name: "Both zone requirements are intersected",
+			requirements: []v1.NodeSelectorRequirement{
+				{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"eastus-1", "eastus-2"}},
+				{Key: v1alpha1.AlternativeLabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"eastus-2", "eastus-3"}},
+			},
+			expected: []string{"eastus-2"},
+		},
+		{
+			name:         "NotIn zone requirement is regional",
+			requirements: []v1.NodeSelectorRequirement{{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpNotIn, Values: []string{"eastus-1"}}},
+			expected:     []string{""},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := tests.GetMachineObj("machine-test", map[string]string{}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, tc.requirements)
+			assert.Equal(t, tc.expected, getZones(machine))
+		})
+	}
+}
+
+// mockReadyNode makes the client return a ready node of agentpool0
+func mockReadyNode(c *fake.MockClient) {
+	node := tests.ReadyNode
+	c.CreateMapWithType(&v1.NodeList{})[client.ObjectKeyFromObject(&node)] = &node
+	c.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+}
+
+// newCreatePoller returns a create poller driven by the mock handler
+func newCreatePoller(t *testing.T, mockHandler *fake.MockPollingHandler[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]) *runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse] {
+	poller, err := runtime.NewPoller(&http.Response{StatusCode: http.StatusAccepted, Body: http.NoBody}, runtime.NewPipeline("", "", runtime.PipelineOptions{}, nil),
+		&runtime.NewPollerOptions[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse]{
+			Handler:  mockHandler,
+			Response: &armcontainerservice.AgentPoolsClientCreateOrUpdateResponse{},
+		})
+	assert.NoError(t, err)
+	return poller
+}
+
 func createTestProvider(agentPoolsAPIMocks *fake.MockAgentPoolsAPI, mockK8sClient *fake.MockClient) *Provider {
 	mockAzClient := NewAZClientFromAPI(agentPoolsAPIMocks, nil)
-	return NewProvider(mockAzClient, mockK8sClient, nil, nil, "testRG", "nodeRG", "testCluster")
+	// the fake pricing API returns no data, so the provider serves the static eastus prices
+	pricingProvider := pricing.NewProvider(context.Background(), &fake.PricingAPI{}, "eastus", make(chan struct{}))
+	return NewProvider(mockAzClient, mockK8sClient, nil, pricingProvider, cache.NewUnavailableOfferings(), "eastus", "testRG", "nodeRG", "testCluster")
+}
+
+func TestGetAgentPoolNodes(t *testing.T) {
+	mockK8sClient := fake.NewClient()
+	node := tests.ReadyNode
+	mockK8sClient.CreateMapWithType(&v1.NodeList{})[client.ObjectKeyFromObject(&node)] = &node
+	// the node is looked up through the agent pool index of the informer cache
+	mockK8sClient.On("List", mock.Anything, mock.IsType(&v1.NodeList{}), []client.ListOption{client.MatchingFields{NodeAgentPoolIndex: "agentpool0"}}).Return(nil)
+	p := createTestProvider(nil, mockK8sClient)
+
+	result, err := p.getAgentPoolNodes(context.Background(), "agentpool0")
+	assert.NoError(t, err)
+	assert.Len(t, result, 1)
+	assert.Equal(t, node.Name, result[0].Name)
+	mockK8sClient.AssertExpectations(t)
+
+	assert.Equal(t, []string{"agentpool0"}, NodeAgentPoolIndexFunc(&node))
+	assert.Empty(t, NodeAgentPoolIndexFunc(&v1.Node{}))
+}
+
+func TestGetNodeCount(t *testing.T) {
+	testCases := []struct {
+		name          string
+		annotations   map[string]string
+		expected      int32
+		expectedError bool
+	}{
+		{
+			name:     "Machine without node count",
+			expected: 1,
+		},
+		{
+			name:        "Machine with node count",
+			annotations: map[string]string{v1alpha1.AgentPoolNodeCountAnnotationKey: "4"},
+			expected:    4,
+		},
+		{
+			name:          "Machine with zero nodes",
+			annotations:   map[string]string{v1alpha1.AgentPoolNodeCountAnnotationKey: "0"},
+			expectedError: true,
+		},
+		{
+			name:          "Machine with more nodes than an agent pool can have",
+			annotations:   map[string]string{v1alpha1.AgentPoolNodeCountAnnotationKey: "1001"},
+			expectedError: true,
+		},
+		{
+			name:          "Machine with malformed node count",
+			annotations:   map[string]string{v1alpha1.AgentPoolNodeCountAnnotationKey: "four"},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := tests.GetMachineObj("machine-test", map[string]string{}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{})
+			machine.Annotations = tc.annotations
+			count, err := getNodeCount(machine)
+			if tc.expectedError {
+				assert.ErrorContains(t, err, "is not a node count")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, count)
+		})
+	}
+}
+
+func TestNodeProviderIDs(t *testing.T) {
+	newNode := func(name, providerID string) v1.Node {
+		return v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v1.NodeSpec{ProviderID: providerID}}
+	}
+	scaleSet := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/"
+	expected := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/"
+	nodes := []v1.Node{
+		newNode("aks-agentpool0-20562481-vmss00000a", scaleSet+"10"),
+		newNode("aks-agentpool0-20562481-vmss000002", scaleSet+"2"),
+		// the provider id is set after the node registered
+		newNode("aks-agentpool0-20562481-vmss000003", ""),
+		newNode("aks-agentpool0-20562481-vmss000001", scaleSet+"1"),
+	}
+
+	p := createTestProvider(nil, fake.NewClient())
+	assert.Equal(t, []string{expected + "1", expected + "2", expected + "10"}, p.nodeProviderIDs("00000000-0000-0000-0000-000000000000", nodes))
+	assert.Empty(t, p.nodeProviderIDs("00000000-0000-0000-0000-000000000000", nil))
+}
+
+func TestLaunchedProviderID(t *testing.T) {
+	scaleSet := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/"
+	expected := "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/noderg/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/"
+	testCases := []struct {
+		name string
+		// launchedID is the provider id recorded on the machine, empty while it has none
+		launchedID      string
+		joined          []string
+		expectedID      string
+		expectedNodeIDs []string
+	}{
+		{
+			name:            "Second node joins before the first one",
+			launchedID:      expected + "0",
+			joined:          []string{"1"},
+			expectedID:      expected + "0",
+			expectedNodeIDs: []string{expected + "1"},
+		},
+		{
+			name:            "Second node joins before the machine records its provider id",
+			joined:          []string{"1"},
+			expectedID:      expected + "0",
+			expectedNodeIDs: []string{expected + "1"},
+		},
+		{
+			name:            "First node joins after the second one",
+			launchedID:      expected + "0",
+			joined:          []string{"1", "0"},
+			expectedID:      expected + "0",
+			expectedNodeIDs: []string{expected + "0", expected + "1"},
+		},
+		{
+			name:            "First node is replaced",
+			launchedID:      expected + "0",
+			joined:          []string{"2", "1"},
+			expectedID:      expected + "0",
+			expectedNodeIDs: []string{expected + "1", expected + "2"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_ND96asr_v4")
+			ap.Properties.Count = to.Ptr(int32(2))
+
+			mockK8sClient := fake.NewClient()
+			nodes := mockK8sClient.CreateMapWithType(&v1.NodeList{})
+			for _, instanceID := range tc.joined {
+				node := tests.ReadyNode
+				node.Name = "aks-agentpool0-20562481-vmss_" + instanceID
+				node.Spec.ProviderID = scaleSet + instanceID
+				nodes[client.ObjectKeyFromObject(&node)] = &node
+			}
+			mockK8sClient.On("List", mock.IsType(context.Background()), mock.IsType(&v1.NodeList{}), mock.Anything).Return(nil)
+			mockK8sClient.CreateOrUpdateObjectInMap(&v1alpha5.Machine{ObjectMeta: metav1.ObjectMeta{Name: "agentpool0"}, Status: v1alpha5.MachineStatus{ProviderID: tc.launchedID}})
+			mockK8sClient.On("Get", mock.Anything, mock.Anything, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+			// every node is mapped to the machine
+			mockK8sClient.On("Patch", mock.Anything, mock.MatchedBy(func(m *v1alpha5.Machine) bool {
+				return m.Annotations[v1alpha1.AgentPoolNodeProviderIDsAnnotationKey] == strings.Join(tc.expectedNodeIDs, ",")
+			}), mock.Anything, mock.Anything).Return(nil).Once()
+			p := createTestProvider(nil, mockK8sClient)
+
+			instance, err := p.fromAgentPoolToInstance(context.Background(), &ap)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedID, lo.FromPtr(instance.ID))
+			assert.Equal(t, tc.expectedNodeIDs, instance.NodeIDs)
+			mockK8sClient.AssertNumberOfCalls(t, "Patch", 1)
+		})
+	}
+}
+
+func TestGetOSSKU(t *testing.T) {
+	testCases := []struct {
+		name          string
+		annotations   map[string]string
+		expected      *armcontainerservice.OSSKU
+		expectedError bool
+	}{
+		{
+			name: "Machine without os sku",
+		},
+		{
+			name:        "Machine with os sku",
+			annotations: map[string]string{v1alpha1.AgentPoolOSSKUAnnotationKey: "AzureLinux"},
+			expected:    to.Ptr(armcontainerservice.OSSKUAzureLinux),
+		},
+		{
+			name:        "Machine with os sku in another case",
+			annotations: map[string]string{v1alpha1.AgentPoolOSSKUAnnotationKey: "ubuntu"},
+			expected:    to.Ptr(armcontainerservice.OSSKUUbuntu),
+		},
+		{
+			name:          "Machine with windows os sku",
+			annotations:   map[string]string{v1alpha1.AgentPoolOSSKUAnnotationKey: "Windows2022"},
+			expectedError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			machine := tests.GetMachineObj("machine-test", map[string]string{}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{})
+			machine.Annotations = tc.annotations
+			osSKU, err := getOSSKU(machine)
+			if tc.expectedError {
+				assert.ErrorContains(t, err, "is not one of the os skus")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, osSKU)
+		})
+	}
+}
+
+func TestIsOSSKUSupported(t *testing.T) {
+	azureLinux := to.Ptr(armcontainerservice.OSSKUAzureLinux)
+	assert.True(t, isOSSKUSupported(nil, "Standard_ND96asr_v4"))
+	assert.True(t, isOSSKUSupported(to.Ptr(armcontainerservice.OSSKUUbuntu), "Standard_ND96asr_v4"))
+	assert.True(t, isOSSKUSupported(azureLinux, "Standard_NC6s_v3"))
+	assert.True(t, isOSSKUSupported(azureLinux, "Standard_NC6s_v3_Promo"))
+	assert.True(t, isOSSKUSupported(azureLinux, "Standard_D4s_v3"))
+	assert.False(t, isOSSKUSupported(azureLinux, "Standard_ND96asr_v4"))
+	assert.False(t, isOSSKUSupported(to.Ptr(armcontainerservice.OSSKUCBLMariner), "Standard_ND96asr_v4"))
+}
+
+func TestCreateUnsupportedOSSKU(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	machine := tests.GetMachineObj("agentpool1", map[string]string{"test": "test"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{
+		{
+			Key:      "node.kubernetes.io/instance-type",
+			Operator: "In",
+			Values:   []string{"Standard_ND96asr_v4"},
+		},
+	})
+	machine.Annotations = map[string]string{v1alpha1.AgentPoolOSSKUAnnotationKey: "AzureLinux"}
+
+	// nothing is created for a gpu vm size that is not validated for Azure Linux
+	p := createTestProvider(fake.NewMockAgentPoolsAPI(mockCtrl), fake.NewClient())
+	instance, err := p.Create(context.Background(), machine)
+	assert.ErrorContains(t, err, "none of the requested instance types [Standard_ND96asr_v4] is validated for os sku AzureLinux")
+	assert.Nil(t, instance)
 }
@@ -0,0 +1,152 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	"github.com/Azure/skewer"
+
+	// nolint SA1019 - deprecated package
+	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2022-08-01/compute"
+)
+
+// ErrAZClientNotReady is returned by a reloadable AZClient that has not been loaded yet
+var ErrAZClientNotReady = errors.New("azure client is not ready")
+
+// NewReloadableAZClient returns an AZClient whose clients can be replaced with Reload, e.g. when the cloud config
+// changes. The providers keep the AZClient and SKUClient they were created with and use the new clients right away.
+// A nil azClient returns ErrAZClientNotReady from every call until the first Reload.
+func NewReloadableAZClient(azClient *AZClient) *AZClient {
+	if azClient == nil {
+		return &AZClient{
+			agentPoolsClient: &reloadableAgentPoolsClient{},
+			SKUClient:        &reloadableSKUClient{},
+		}
+	}
+	return &AZClient{
+		agentPoolsClient: &reloadableAgentPoolsClient{client: azClient.agentPoolsClient},
+		SKUClient:        &reloadableSKUClient{client: azClient.SKUClient},
+	}
+}
+
+// Reload replaces the clients of a reloadable AZClient with the clients of azClient
+func (c *AZClient) Reload(azClient *AZClient) error {
+	agentPoolsClient, ok := c.agentPoolsClient.(*reloadableAgentPoolsClient)
+	if !ok {
+		return errors.New("azure client is not reloadable")
+	}
+	skuClient, ok := c.SKUClient.(*reloadableSKUClient)
+	if !ok {
+		return errors.New("azure client is not reloadable")
+	}
+	agentPoolsClient.set(azClient.agentPoolsClient)
+	skuClient.set(azClient.SKUClient)
+	return nil
+}
+
+// reloadableAgentPoolsClient delegates to the agent pools client built from the current cloud config
+type reloadableAgentPoolsClient struct {
+	mu     sync.RWMutex
+	client AgentPoolsAPI
+}
+
+var _ AgentPoolsAPI = &reloadableAgentPoolsClient{}
+
+func (r *reloadableAgentPoolsClient) get() AgentPoolsAPI {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.client == nil {
+		return notReadyAgentPoolsClient{}
+	}
+	return r.client
+}
+
+func (r *reloadableAgentPoolsClient) set(client AgentPoolsAPI) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client = client
+}
+
+func (r *reloadableAgentPoolsClient) BeginCreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, agentPoolName string, parameters armcontainerservice.AgentPool, options *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
+	return r.get().BeginCreateOrUpdate(ctx, resourceGroupName, resourceName, agentPoolName, parameters, options)
+}
+
+func (r *reloadableAgentPoolsClient) Get(ctx context.Context, resourceGroupName string, resourceName string, agentPoolName string, options *armcontainerservice.AgentPoolsClientGetOptions) (armcontainerservice.AgentPoolsClientGetResponse, error) {
+	return r.get().Get(ctx, resourceGroupName, resourceName, agentPoolName, options)
+}
+
+func (r *reloadableAgentPoolsClient) BeginDelete(ctx context.Context, resourceGroupName string, resourceName string, agentPoolName string, options *armcontainerservice.AgentPoolsClientBeginDeleteOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientDeleteResponse], error) {
+	return r.get().BeginDelete(ctx, resourceGroupName, resourceName, agentPoolName, options)
+}
+
+func (r *reloadableAgentPoolsClient) NewListPager(resourceGroupName string, resourceName string, options *armcontainerservice.AgentPoolsClientListOptions) *runtime.Pager[armcontainerservice.AgentPoolsClientListResponse] {
+	return r.get().NewListPager(resourceGroupName, resourceName, options)
+}
+
+// reloadableSKUClient delegates to the SKU client built from the current cloud config
+type reloadableSKUClient struct {
+	mu     sync.RWMutex
+	client skewer.ResourceClient
+}
+
+var _ skewer.ResourceClient = &reloadableSKUClient{}
+
+func (r *reloadableSKUClient) set(client skewer.ResourceClient) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client = client
+}
+
+func (r *reloadableSKUClient) ListComplete(ctx context.Context, filter, includeExtendedLocations string) (compute.ResourceSkusResultIterator, error) {
+	r.mu.RLock()
+	client := r.client
+	r.mu.RUnlock()
+	if client == nil {
+		return compute.ResourceSkusResultIterator{}, ErrAZClientNotReady
+	}
+	return client.ListComplete(ctx, filter, includeExtendedLocations)
+}
+
+// notReadyAgentPoolsClient is used until the first client has been built
+type notReadyAgentPoolsClient struct{}
+
+var _ AgentPoolsAPI = notReadyAgentPoolsClient{}
+
+func (notReadyAgentPoolsClient) BeginCreateOrUpdate(_ context.Context, _ string, _ string, _ string, _ armcontainerservice.AgentPool, _ *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
+	return nil, ErrAZClientNotReady
+}
+
+func (notReadyAgentPoolsClient) Get(_ context.Context, _ string, _ string, _ string, _ *armcontainerservice.AgentPoolsClientGetOptions) (armcontainerservice.AgentPoolsClientGetResponse, error) {
+	return armcontainerservice.AgentPoolsClientGetResponse{}, ErrAZClientNotReady
+}
+
+func (notReadyAgentPoolsClient) BeginDelete(_ context.Context, _ string, _ string, _ string, _ *armcontainerservice.AgentPoolsClientBeginDeleteOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientDeleteResponse], error) {
+	return nil, ErrAZClientNotReady
+}
+
+func (notReadyAgentPoolsClient) NewListPager(_ string, _ string, _ *armcontainerservice.AgentPoolsClientListOptions) *runtime.Pager[armcontainerservice.AgentPoolsClientListResponse] {
+	return runtime.NewPager(runtime.PagingHandler[armcontainerservice.AgentPoolsClientListResponse]{
+		More: func(armcontainerservice.AgentPoolsClientListResponse) bool { return false },
+		Fetcher: func(context.Context, *armcontainerservice.AgentPoolsClientListResponse) (armcontainerservice.AgentPoolsClientListResponse, error) {
+			return armcontainerservice.AgentPoolsClientListResponse{}, ErrAZClientNotReady
+		},
+	})
+}
@@ -0,0 +1,111 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/samber/lo"
+	"knative.dev/pkg/logging"
+)
+
+// Azure tag names cannot contain "/", so the karpenter.sh domain of the tag keys is separated with "_"
+const (
+	// MachineNameTagKey is the agent pool tag that records the name of the Machine the agent pool was created for
+	MachineNameTagKey = "karpenter.sh_machine-name"
+	// MachineUIDTagKey is the agent pool tag that records the UID of the Machine the agent pool was created for. Only
+	// the Machine with this UID owns the agent pool, a Machine recreated with the same name does not.
+	MachineUIDTagKey = "karpenter.sh_machine-uid"
+	// ProvisionerNameTagKey is the agent pool tag that records the provisioner of the Machine
+	ProvisionerNameTagKey = "karpenter.sh_provisioner-name"
+	// ManagedByTagKey is the agent pool tag that records the cluster whose controller created the agent pool
+	ManagedByTagKey = "karpenter.sh_managed-by"
+)
+
+// ownershipTags returns the tags that mark an agent pool as created for the machine by the controller of the cluster
+func (p *Provider) ownershipTags(machine *v1alpha5.Machine) map[string]*string {
+	return map[string]*string{
+		MachineNameTagKey:     to.Ptr(machine.Name),
+		MachineUIDTagKey:      to.Ptr(string(machine.UID)),
+		ProvisionerNameTagKey: to.Ptr(lo.ValueOr(machine.Labels, v1alpha5.ProvisionerNameLabelKey, "default")),
+		ManagedByTagKey:       to.Ptr(p.cluster().clusterName),
+	}
+}
+
+// isOwned returns true if the agent pool is tagged as created by the controller of the cluster
+func (p *Provider) isOwned(apObj *armcontainerservice.AgentPool) bool {
+	if apObj.Properties == nil {
+		return false
+	}
+	managedBy, ok := apObj.Properties.Tags[ManagedByTagKey]
+	return ok && lo.FromPtr(managedBy) == p.cluster().clusterName
+}
+
+// isLegacy returns true if the agent pool may have been created before the ownership tags existed. Those agent pools
+// only carry the provisioner label every created agent pool puts on its nodes, which anyone can set on an agent pool.
+func isLegacy(apObj *armcontainerservice.AgentPool) bool {
+	if apObj.Properties == nil {
+		return false
+	}
+	if _, ok := apObj.Properties.Tags[ManagedByTagKey]; ok {
+		return false
+	}
+	_, ok := apObj.Properties.NodeLabels[v1alpha5.ProvisionerNameLabelKey]
+	return ok
+}
+
+// migrateLegacyAgentPool tags an agent pool created before the ownership tags existed with the ownership tags of its
+// machine, and returns true if the agent pool is owned. The label alone does not prove the controller created the
+// agent pool, so an agent pool without a machine is left alone and never garbage collected. Once the tags are
+// written the agent pool is owned like any other, the migration is only retried while the update fails.
+func (p *Provider) migrateLegacyAgentPool(ctx context.Context, apObj *armcontainerservice.AgentPool) (bool, error) {
+	machine, err := p.machineForAgentPool(ctx, apObj)
+	if err != nil {
+		return false, fmt.Errorf("getting machine of agent pool %q, %w", lo.FromPtr(apObj.Name), err)
+	}
+	if machine == nil {
+		return false, nil
+	}
+	properties := *apObj.Properties
+	properties.Tags = lo.Assign(apObj.Properties.Tags, p.ownershipTags(machine))
+	tagged := *apObj
+	tagged.Properties = &properties
+	if _, err := beginCreateAgentPool(ctx, p.azClient.agentPoolsClient, p.cluster().resourceGroup, lo.FromPtr(apObj.Name), p.cluster().clusterName, tagged); err != nil {
+		logging.FromContext(ctx).Errorf("tagging agent pool %s of machine %s, %s", lo.FromPtr(apObj.Name), machine.Name, err)
+		return true, nil
+	}
+	logging.FromContext(ctx).Infof("tagged agent pool %s of machine %s created before the ownership tags existed", lo.FromPtr(apObj.Name), machine.Name)
+	apObj.Properties = &properties
+	return true, nil
+}
+
+// MachineName returns the name of the Machine the agent pool of the instance was created for
+func (i *Instance) MachineName() string {
+	return machineName(i.Name, i.Tags)
+}
+
+// machineName returns the machine name recorded in the agent pool tags. Agent pools created before the machine name
+// was tagged are named after their machine.
+func machineName(apName *string, tags map[string]*string) string {
+	if name, ok := tags[MachineNameTagKey]; ok {
+		return lo.FromPtr(name)
+	}
+	return lo.FromPtr(apName)
+}
@@ -0,0 +1,155 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
+	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
+	"github.com/samber/lo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.uber.org/mock/gomock"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/azure/gpu-provisioner/pkg/fake"
+	"github.com/azure/gpu-provisioner/pkg/tests"
+)
+
+func TestOwnershipTags(t *testing.T) {
+	machine := tests.GetMachineObj("workspace-falcon-7b", map[string]string{v1alpha5.ProvisionerNameLabelKey: "kaito"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{})
+	machine.UID = "machine-uid"
+	p := createTestProvider(nil, fake.NewClient())
+
+	tags := p.ownershipTags(machine)
+	assert.Equal(t, map[string]string{
+		MachineNameTagKey:     "workspace-falcon-7b",
+		MachineUIDTagKey:      "machine-uid",
+		ProvisionerNameTagKey: "kaito",
+		ManagedByTagKey:       "testCluster",
+	}, lo.MapValues(tags, func(v *string, _ string) string { return lo.FromPtr(v) }))
+
+	ap := armcontainerservice.AgentPool{Name: to.Ptr(AgentPoolName(machine.Name)), Properties: &armcontainerservice.ManagedClusterAgentPoolProfileProperties{Tags: tags}}
+	assert.True(t, p.isOwned(&ap))
+	assert.Equal(t, machine.Name, p.agentPoolToInstance(&ap, "").MachineName())
+}
+
+func TestIsOwned(t *testing.T) {
+	testCases := []struct {
+		name       string
+		tags       map[string]*string
+		nodeLabels map[string]*string
+		expected   bool
+	}{
+		{
+			name:     "Agent pool created by the controller of the cluster",
+			tags:     map[string]*string{ManagedByTagKey: to.Ptr("testCluster")},
+			expected: true,
+		},
+		{
+			name:       "Agent pool created by the controller of another cluster",
+			tags:       map[string]*string{ManagedByTagKey: to.Ptr("otherCluster")},
+			nodeLabels: map[string]*string{v1alpha5.ProvisionerNameLabelKey: to.Ptr("default")},
+		},
+		{
+			name:       "Labelled agent pool without ownership tags",
+			nodeLabels: map[string]*string{v1alpha5.ProvisionerNameLabelKey: to.Ptr("default")},
+		},
+		{
+			name:       "System agent pool",
+			nodeLabels: map[string]*string{"kubernetes.azure.com/mode": to.Ptr("system")},
+		},
+	}
+
+	p := createTestProvider(nil, fake.NewClient())
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ap := armcontainerservice.AgentPool{Properties: &armcontainerservice.ManagedClusterAgentPoolProfileProperties{Tags: tc.tags, NodeLabels: tc.nodeLabels}}
+			assert.Equal(t, tc.expected, p.isOwned(&ap))
+		})
+	}
+}
+
+func TestMigrateLegacyAgentPool(t *testing.T) {
+	testCases := []struct {
+		name          string
+		machine       bool
+		createErr     error
+		expectedOwned bool
+		expectedTags  bool
+	}{
+		{
+			name:          "Agent pool of an existing machine is tagged",
+			machine:       true,
+			expectedOwned: true,
+			expectedTags:  true,
+		},
+		{
+			name:          "Agent pool of an existing machine stays owned while tagging fails",
+			machine:       true,
+			createErr:     errors.New("operation in progress"),
+			expectedOwned: true,
+		},
+		{
+			name: "Agent pool without a machine is not owned",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			ap := tests.GetAgentPoolObjWithName("agentpool0", "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss", "Standard_NC6s_v3")
+			ap.Properties.NodeLabels[v1alpha5.ProvisionerNameLabelKey] = to.Ptr("default")
+			assert.True(t, isLegacy(&ap))
+
+			agentPoolMocks := fake.NewMockAgentPoolsAPI(mockCtrl)
+			mockK8sClient := fake.NewClient()
+			if tc.machine {
+				machine := tests.GetMachineObj("agentpool0", map[string]string{v1alpha5.ProvisionerNameLabelKey: "default"}, []v1.Taint{}, v1alpha5.ResourceRequirements{}, []v1.NodeSelectorRequirement{})
+				machine.Namespace = ""
+				machine.UID = "machine-uid"
+				mockK8sClient.CreateOrUpdateObjectInMap(machine)
+				mockK8sClient.On("Get", mock.Anything, types.NamespacedName{Name: "agentpool0"}, mock.IsType(&v1alpha5.Machine{}), mock.Anything).Return(nil)
+				agentPoolMocks.EXPECT().BeginCreateOrUpdate(gomock.Any(), gomock.Any(), gomock.Any(), "agentpool0", gomock.Any(), gomock.Any()).DoAndReturn(
+					func(_ context.Context, _, _, _ string, tagged armcontainerservice.AgentPool, _ *armcontainerservice.AgentPoolsClientBeginCreateOrUpdateOptions) (*runtime.Poller[armcontainerservice.AgentPoolsClientCreateOrUpdateResponse], error) {
+						assert.Equal(t, "machine-uid", lo.FromPtr(tagged.Properties.Tags[MachineUIDTagKey]))
+						assert.Equal(t, "testCluster", lo.FromPtr(tagged.Properties.Tags[ManagedByTagKey]))
+						assert.Equal(t, ap.Properties.VMSize, tagged.Properties.VMSize)
+						return nil, tc.createErr
+					})
+			} else {
+				mockK8sClient.On("Get", mock.Anything, types.NamespacedName{Name: "agentpool0"}, mock.IsType(&v1alpha5.Machine{}), mock.Anything).
+					Return(apierrors.NewNotFound(schema.GroupResource{Resource: "machines"}, "agentpool0"))
+			}
+			p := createTestProvider(agentPoolMocks, mockK8sClient)
+
+			owned, err := p.migrateLegacyAgentPool(context.Background(), &ap)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedOwned, owned)
+			assert.Equal(t, tc.expectedTags, p.isOwned(&ap))
+		})
+	}
+}
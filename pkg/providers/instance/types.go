@@ -15,15 +15,41 @@ limitations under the License.
 
 package instance
 
+const (
+	// InstanceStateReady is the state of an instance whose agent pool is provisioned and whose node is ready
+	InstanceStateReady = "Ready"
+	// InstanceStateNotReady is the state of an instance whose agent pool is provisioned and whose node is missing or
+	// not ready
+	InstanceStateNotReady = "NotReady"
+)
+
 // Instance a struct to isolate weather vm or vmss
 type Instance struct {
-	Name         *string // agentPoolName or instance/vmName
+	Name *string // agentPoolName or instance/vmName
+	// State is the provisioning state of the agent pool, e.g. Creating or Failed, until it is provisioned. Once it is
+	// the state is InstanceStateReady or InstanceStateNotReady depending on the readiness of its node.
 	State        *string
 	ID           *string
 	ImageID      *string
 	Type         *string
 	CapacityType *string
+	// OSSKU is the OS SKU of the nodes of the agent pool, nil if it runs the default of the cluster
+	OSSKU *string
+	// NodeCount is the number of nodes of the agent pool
+	NodeCount *int32
+	// NodeIDs are the provider ids of the nodes of the agent pool that joined the cluster, ordered by their scale set
+	// instance id. ID stays the one the machine was launched with even if that node was replaced.
+	NodeIDs []string
+	// Zones are the zones the agent pool is pinned to, empty if it is regional
+	Zones        []string
 	SubnetID     *string
 	Tags         map[string]*string
 	Labels       map[string]string
+	Taints       []string
+	OSDiskSizeGB *int32
+	// OrchestratorVersion is the Kubernetes version the agent pool is currently running
+	OrchestratorVersion *string
+	// CreateResumeToken resumes polling the creation of the agent pool, it is only set by Create while AKS is still
+	// creating the agent pool
+	CreateResumeToken *string
 }
@@ -110,6 +110,15 @@ func computeRequirements(ctx context.Context, sku *skewer.SKU, offerings cloudpr
 		// all additive feature initialized elsewhere
 	)
 
+	// zonal offerings, regions without availability zones have no zone requirement
+	zones := lo.Without(lo.Uniq(lo.Map(offerings.Available(), func(o cloudprovider.Offering, _ int) string { return o.Zone })), "")
+	if len(zones) > 0 {
+		requirements.Add(
+			scheduling.NewRequirement(v1.LabelTopologyZone, v1.NodeSelectorOpIn, zones...),
+			scheduling.NewRequirement(v1alpha1.AlternativeLabelTopologyZone, v1.NodeSelectorOpIn, zones...),
+		)
+	}
+
 	// composites
 	requirements[v1alpha1.LabelSKUName].Insert(sku.GetName())
 	requirements[v1alpha1.LabelSKUSize].Insert(*sku.Size)
@@ -19,18 +19,20 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/aws/karpenter-core/pkg/apis/v1alpha5"
 
 	kcache "github.com/azure/gpu-provisioner/pkg/cache"
+	"github.com/azure/gpu-provisioner/pkg/utils"
 	"github.com/patrickmn/go-cache"
+	"github.com/samber/lo"
 	"knative.dev/pkg/logging"
 
 	"github.com/aws/karpenter-core/pkg/cloudprovider"
 
-	"github.com/azure/gpu-provisioner/pkg/apis/v1alpha1"
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
 
 	"github.com/Azure/skewer"
@@ -39,6 +41,9 @@ import (
 const (
 	InstanceTypesCacheKey = "types"
 	InstanceTypesCacheTTL = 23 * time.Hour // AWS uses 5 min here. TODO: check on why that frequent. Pricing?
+
+	// lowPriorityCapable is the SKU capability of vm sizes that can run as spot
+	lowPriorityCapable = "LowPriorityCapable"
 )
 
 type Provider struct {
@@ -62,6 +67,15 @@ func NewProvider(region string, cache *cache.Cache, resourceSkusClient skewer.Re
 	}
 }
 
+// SetRegion changes the region of the instance types, it is called once a cloud config that was invalid at startup has
+// been fixed. The cached SKUs of the previous region are dropped.
+func (p *Provider) SetRegion(region string) {
+	p.Lock()
+	defer p.Unlock()
+	p.region = region
+	p.cache.Flush()
+}
+
 // List Get all instance type options
 func (p *Provider) List(
 	ctx context.Context, kc *v1alpha5.KubeletConfiguration) ([]*cloudprovider.InstanceType, error) {
@@ -96,14 +110,38 @@ func (p *Provider) LivenessProbe(req *http.Request) error {
 func (p *Provider) createOfferings(ctx context.Context, sku *skewer.SKU) []cloudprovider.Offering {
 
 	var offerings []cloudprovider.Offering
+	if sku.IsRestricted(p.region) {
+		return offerings
+	}
 	onDemandPrice, ok := p.pricingProvider.OnDemandPrice(*sku.Name)
 
-	if !p.unavailableOfferings.IsUnavailable(*sku.Name, p.region, v1alpha1.PriorityRegular) {
-		offerings = append(offerings, cloudprovider.Offering{Zone: "", CapacityType: v1alpha1.PriorityRegular, Price: onDemandPrice, Available: ok})
+	for _, zone := range p.zones(sku) {
+		if !p.unavailableOfferings.IsUnavailable(*sku.Name, zone, v1alpha5.CapacityTypeOnDemand) {
+			offerings = append(offerings, cloudprovider.Offering{Zone: zone, CapacityType: v1alpha5.CapacityTypeOnDemand, Price: onDemandPrice, Available: ok})
+		}
+		if sku.HasCapability(lowPriorityCapable) && !p.unavailableOfferings.IsUnavailable(*sku.Name, zone, v1alpha5.CapacityTypeSpot) {
+			spotPrice, spotOK := p.pricingProvider.SpotPrice(*sku.Name, zone)
+			if !spotOK {
+				// spot agent pools are created with a max price of -1, so the on-demand price is what a spot vm costs at most
+				spotPrice, spotOK = onDemandPrice, ok
+			}
+			offerings = append(offerings, cloudprovider.Offering{Zone: zone, CapacityType: v1alpha5.CapacityTypeSpot, Price: spotPrice, Available: spotOK})
+		}
 	}
 	return offerings
 }
 
+// zones returns the zone label values of the availability zones in the region where the sku is available and not
+// restricted. Regions without availability zones get a single regional offering with an empty zone.
+func (p *Provider) zones(sku *skewer.SKU) []string {
+	availabilityZones := lo.Keys(sku.AvailabilityZones(p.region))
+	if len(availabilityZones) == 0 {
+		return []string{""}
+	}
+	sort.Strings(availabilityZones)
+	return lo.Map(availabilityZones, func(zone string, _ int) string { return utils.MakeZone(p.region, zone) })
+}
+
 // getInstanceTypes retrieves all instance types from skewer using some opinionated filters
 func (p *Provider) getInstanceTypes(ctx context.Context) (map[string]*skewer.SKU, error) {
 	if cached, ok := p.cache.Get(InstanceTypesCacheKey); ok {
@@ -18,30 +18,84 @@ package client
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
-	apiVersion = "2021-10-01-preview"
+	// savings plan prices are only returned from 2023-01-01-preview on
+	apiVersion = "2023-01-01-preview"
 	pricingURL = "https://prices.azure.com/api/retail/prices?api-version=" + apiVersion
+
+	// defaultTimeout bounds a single page request, so a hung connection cannot block the pricing update
+	defaultTimeout    = 30 * time.Second
+	defaultMaxRetries = 5
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = 30 * time.Second
 )
 
 type PricingAPI interface {
 	GetProductsPricePages(context.Context, []*Filter, func(output *ProductsPricePage)) error
 }
 
-type pricingAPI struct{}
+type pricingAPI struct {
+	httpClient *http.Client
+	baseURL    string
+	maxRetries int
+	retryDelay time.Duration
+}
+
+// StatusError is returned when the retail prices API answers with a non-200 status code
+type StatusError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("got a non-200 status code: %d", e.StatusCode)
+}
 
+// retryable returns true for throttling and server side errors
+func (e *StatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// New returns a pricing API client with a per request timeout
 func New() PricingAPI {
-	return &pricingAPI{}
+	return NewWithClient(&http.Client{Timeout: defaultTimeout})
+}
+
+// NewWithClient returns a pricing API client that sends its requests with the given http client, which is reused
+// across pages and updates
+func NewWithClient(httpClient *http.Client) PricingAPI {
+	return &pricingAPI{
+		httpClient: httpClient,
+		baseURL:    pricingURL,
+		maxRetries: defaultMaxRetries,
+		retryDelay: defaultRetryDelay,
+	}
 }
 
-func (papi *pricingAPI) GetProductsPricePages(_ context.Context, filters []*Filter, pageHandler func(output *ProductsPricePage)) error {
-	nextURL := pricingURL
+// NewUnavailable returns a pricing API for clouds the retail prices API does not cover, every request fails so the
+// pricing provider keeps using the static or stored prices
+func NewUnavailable(cloudName string) PricingAPI {
+	return unavailableAPI(cloudName)
+}
+
+type unavailableAPI string
+
+func (u unavailableAPI) GetProductsPricePages(_ context.Context, _ []*Filter, _ func(output *ProductsPricePage)) error {
+	return fmt.Errorf("retail prices are not available in %s", string(u))
+}
+
+func (papi *pricingAPI) GetProductsPricePages(ctx context.Context, filters []*Filter, pageHandler func(output *ProductsPricePage)) error {
+	nextURL := papi.baseURL
 
 	if len(filters) > 0 {
 		filterParams := []string{}
@@ -55,28 +109,87 @@ func (papi *pricingAPI) GetProductsPricePages(_ context.Context, filters []*Filt
 	}
 
 	for nextURL != "" {
-		res, err := http.Get(nextURL)
+		page, err := papi.getPageWithRetry(ctx, nextURL)
 		if err != nil {
 			return err
 		}
 
-		if res.StatusCode != 200 {
-			return fmt.Errorf("got a non-200 status code: %d", res.StatusCode)
-		}
+		pageHandler(page)
+		nextURL = page.NextPageLink
+	}
+	return nil
+}
 
-		resBody, err := io.ReadAll(res.Body)
-		if err != nil {
-			return err
+// getPageWithRetry retries throttled and failed requests with exponential backoff, waiting at least as long as the
+// Retry-After header asks for
+func (papi *pricingAPI) getPageWithRetry(ctx context.Context, pageURL string) (*ProductsPricePage, error) {
+	delay := papi.retryDelay
+	for attempt := 0; ; attempt++ {
+		page, err := papi.getPage(ctx, pageURL)
+		if err == nil {
+			return page, nil
+		}
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || !statusErr.retryable() || attempt >= papi.maxRetries {
+			return nil, err
 		}
 
-		page := ProductsPricePage{}
-		err = json.Unmarshal(resBody, &page)
-		if err != nil {
-			return err
+		wait := delay
+		if statusErr.RetryAfter > wait {
+			wait = statusErr.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("waiting to retry after %w, %s", err, ctx.Err())
+		case <-time.After(wait):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
 		}
+	}
+}
 
-		pageHandler(&page)
-		nextURL = page.NextPageLink
+func (papi *pricingAPI) getPage(ctx context.Context, pageURL string) (*ProductsPricePage, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	res, err := papi.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		// drain the body so the connection can be reused
+		_, _ = io.Copy(io.Discard, res.Body)
+		return nil, &StatusError{StatusCode: res.StatusCode, RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
+	}
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	page := ProductsPricePage{}
+	err = json.Unmarshal(resBody, &page)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of seconds or an http date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
 }
@@ -0,0 +1,157 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAPI(server *httptest.Server) *pricingAPI {
+	papi := NewWithClient(server.Client()).(*pricingAPI)
+	papi.baseURL = server.URL + "?api-version=" + apiVersion
+	papi.retryDelay = time.Millisecond
+	return papi
+}
+
+func writePage(w http.ResponseWriter, page ProductsPricePage) {
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func TestGetProductsPricePages(t *testing.T) {
+	testCases := []struct {
+		name           string
+		responses      []int
+		retryAfter     string
+		expectedCalls  int32
+		expectedStatus int
+	}{
+		{
+			name:          "Successful request is not retried",
+			responses:     []int{http.StatusOK},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Throttled request is retried",
+			responses:     []int{http.StatusTooManyRequests, http.StatusOK},
+			retryAfter:    "0",
+			expectedCalls: 2,
+		},
+		{
+			name:          "Server errors are retried",
+			responses:     []int{http.StatusInternalServerError, http.StatusServiceUnavailable, http.StatusOK},
+			expectedCalls: 3,
+		},
+		{
+			name:           "Client errors are not retried",
+			responses:      []int{http.StatusBadRequest},
+			expectedCalls:  1,
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name:           "Retries give up after the max retries",
+			responses:      []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError},
+			expectedCalls:  defaultMaxRetries + 1,
+			expectedStatus: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				status := tc.responses[atomic.AddInt32(&calls, 1)-1]
+				if status != http.StatusOK {
+					if tc.retryAfter != "" {
+						w.Header().Set("Retry-After", tc.retryAfter)
+					}
+					w.WriteHeader(status)
+					return
+				}
+				writePage(w, ProductsPricePage{Items: []Item{{ArmSkuName: "Standard_D1", RetailPrice: 1.2}}})
+			}))
+			defer server.Close()
+
+			var items []Item
+			err := newTestAPI(server).GetProductsPricePages(context.Background(), []*Filter{{Field: "armRegionName", Operator: Equals, Value: "eastus"}}, func(page *ProductsPricePage) {
+				items = append(items, page.Items...)
+			})
+
+			assert.Equal(t, tc.expectedCalls, atomic.LoadInt32(&calls))
+			if tc.expectedStatus == 0 {
+				assert.NoError(t, err)
+				assert.Len(t, items, 1)
+			} else {
+				var statusErr *StatusError
+				assert.True(t, errors.As(err, &statusErr), "expected a StatusError, got %v", err)
+				assert.Equal(t, tc.expectedStatus, statusErr.StatusCode)
+			}
+		})
+	}
+}
+
+func TestGetProductsPricePagesFollowsNextPageLink(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			writePage(w, ProductsPricePage{Items: []Item{{ArmSkuName: "Standard_D1"}}, NextPageLink: server.URL + "?page=2"})
+			return
+		}
+		writePage(w, ProductsPricePage{Items: []Item{{ArmSkuName: "Standard_D2"}}})
+	}))
+	defer server.Close()
+
+	var names []string
+	err := newTestAPI(server).GetProductsPricePages(context.Background(), nil, func(page *ProductsPricePage) {
+		for _, item := range page.Items {
+			names = append(names, item.ArmSkuName)
+		}
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Standard_D1", "Standard_D2"}, names)
+}
+
+func TestGetProductsPricePagesHonorsContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := newTestAPI(server).GetProductsPricePages(ctx, nil, func(page *ProductsPricePage) {})
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 10*time.Second, "the retry must not outlive the context")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon"))
+	date := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, float64(time.Minute), float64(parseRetryAfter(date)), float64(2*time.Second))
+}
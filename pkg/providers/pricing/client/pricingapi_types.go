@@ -22,29 +22,36 @@ import (
 )
 
 type Item struct {
-	CurrencyCode         string    `json:"currencyCode"`
-	TierMinimumUnits     float64   `json:"tierMinimumUnits"`
-	RetailPrice          float64   `json:"retailPrice"`
-	UnitPrice            float64   `json:"unitPrice"`
-	ArmRegionName        string    `json:"armRegionName"`
-	Location             string    `json:"location"`
-	EffectiveStartDate   time.Time `json:"effectiveStartDate"`
-	MeterID              string    `json:"meterId"`
-	MeterName            string    `json:"meterName"`
-	ProductID            string    `json:"productId"`
-	SkuID                string    `json:"skuId"`
-	AvailabilityID       any       `json:"availabilityId"`
-	ProductName          string    `json:"productName"`
-	SkuName              string    `json:"skuName"`
-	ServiceName          string    `json:"serviceName"`
-	ServiceID            string    `json:"serviceId"`
-	ServiceFamily        string    `json:"serviceFamily"`
-	UnitOfMeasure        string    `json:"unitOfMeasure"`
-	Type                 string    `json:"type"`
-	IsPrimaryMeterRegion bool      `json:"isPrimaryMeterRegion"`
-	ArmSkuName           string    `json:"armSkuName"`
-	EffectiveEndDate     time.Time `json:"effectiveEndDate,omitempty"`
-	ReservationTerm      string    `json:"reservationTerm,omitempty"`
+	CurrencyCode         string        `json:"currencyCode"`
+	TierMinimumUnits     float64       `json:"tierMinimumUnits"`
+	RetailPrice          float64       `json:"retailPrice"`
+	UnitPrice            float64       `json:"unitPrice"`
+	ArmRegionName        string        `json:"armRegionName"`
+	Location             string        `json:"location"`
+	EffectiveStartDate   time.Time     `json:"effectiveStartDate"`
+	MeterID              string        `json:"meterId"`
+	MeterName            string        `json:"meterName"`
+	ProductID            string        `json:"productId"`
+	SkuID                string        `json:"skuId"`
+	AvailabilityID       any           `json:"availabilityId"`
+	ProductName          string        `json:"productName"`
+	SkuName              string        `json:"skuName"`
+	ServiceName          string        `json:"serviceName"`
+	ServiceID            string        `json:"serviceId"`
+	ServiceFamily        string        `json:"serviceFamily"`
+	UnitOfMeasure        string        `json:"unitOfMeasure"`
+	Type                 string        `json:"type"`
+	IsPrimaryMeterRegion bool          `json:"isPrimaryMeterRegion"`
+	ArmSkuName           string        `json:"armSkuName"`
+	EffectiveEndDate     time.Time     `json:"effectiveEndDate,omitempty"`
+	ReservationTerm      string        `json:"reservationTerm,omitempty"`
+	SavingsPlan          []SavingsPlan `json:"savingsPlan,omitempty"`
+}
+
+type SavingsPlan struct {
+	UnitPrice   float64 `json:"unitPrice"`
+	RetailPrice float64 `json:"retailPrice"`
+	Term        string  `json:"term"`
 }
 
 type ProductsPricePage struct {
@@ -21,9 +21,12 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/aws/karpenter-core/pkg/utils/pretty"
+	"github.com/azure/gpu-provisioner/pkg/apis/settings"
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing/client"
 	"github.com/samber/lo"
 	"knative.dev/pkg/logging"
@@ -32,6 +35,27 @@ import (
 // pricingUpdatePeriod is how often we try to update our pricing information after the initial update on startup
 const pricingUpdatePeriod = 12 * time.Hour
 
+// Price types of the retail prices API, plus SavingsPlan which is served as part of the consumption prices
+const (
+	PriceTypeConsumption = "Consumption"
+	PriceTypeReservation = "Reservation"
+	PriceTypeSavingsPlan = "SavingsPlan"
+
+	// oneYearTerm is the reservation and savings plan term used to rank instance types
+	oneYearTerm = "1 Year"
+	// hoursPerYear converts the price of a 1 year reservation, which covers the whole term, to an hourly price
+	hoursPerYear = 365 * 24
+)
+
+// PriceSource identifies which retail prices the provider serves
+type PriceSource struct {
+	Currency  string
+	PriceType string
+}
+
+// DefaultPriceSource is the price source of the generated static prices of every region
+var DefaultPriceSource = PriceSource{Currency: "USD", PriceType: PriceTypeConsumption}
+
 // Provider provides actual pricing data to the Azure cloud provider to allow it to make more informed decisions
 // regarding which instances to launch.  This is initialized at startup with a periodically updated static price list to
 // support running in locations where pricing data is unavailable.  In those cases the static pricing data provides a
@@ -40,12 +64,20 @@ const pricingUpdatePeriod = 12 * time.Hour
 // updates never succeed.
 type Provider struct {
 	pricing client.PricingAPI
-	region  string
-	cm      *pretty.ChangeMonitor
+	// regionName is only changed once a cloud config that was invalid at startup has been fixed
+	regionName atomic.Pointer[string]
+	source     PriceSource
+	cm         *pretty.ChangeMonitor
 
 	mu                 sync.RWMutex
 	onDemandUpdateTime time.Time
 	onDemandPrices     map[string]float64
+	spotUpdateTime     time.Time
+	spotPrices         map[string]float64
+
+	// stores persist the prices across restarts, savedUpdateTime is the newest update time they already hold
+	stores          []Store
+	savedUpdateTime time.Time
 }
 
 type Err struct {
@@ -53,27 +85,34 @@ type Err struct {
 	lastUpdateTime time.Time
 }
 
-// NewAPI returns a pricing API
-func NewAPI() client.PricingAPI {
-	return client.New()
-}
-
-func NewProvider(ctx context.Context, pricing client.PricingAPI, region string, startAsync <-chan struct{}) *Provider {
-	// see if we've got region specific pricing data
-	staticPricing, ok := initialOnDemandPrices[region]
-	if !ok {
-		// and if not, fall back to the always available eastus
-		staticPricing = initialOnDemandPrices["eastus"]
+// NewAPI returns a pricing API for the cloud. The retail prices API serves the public and the US government clouds,
+// the other clouds rely on the static or stored prices.
+func NewAPI(env *azure.Environment) client.PricingAPI {
+	switch env.Name {
+	case azure.PublicCloud.Name, azure.USGovernmentCloud.Name:
+		return client.New()
 	}
+	return client.NewUnavailable(env.Name)
+}
 
+// NewProvider returns a pricing provider that starts from the newest of the static prices and the prices held by the
+// stores. The prices are saved to the stores after each update once the provider is signaled to start async, i.e.
+// when it has been elected leader.
+func NewProvider(ctx context.Context, pricing client.PricingAPI, region string, startAsync <-chan struct{}, stores ...Store) *Provider {
+	source := priceSourceFromContext(ctx)
 	p := &Provider{
-		region:             region,
+		source:             source,
 		onDemandUpdateTime: initialPriceUpdate,
-		onDemandPrices:     staticPricing,
+		onDemandPrices:     staticPricing(initialOnDemandPrices, source, region),
+		spotUpdateTime:     initialPriceUpdate,
+		spotPrices:         staticPricing(initialSpotPrices, source, region),
 		pricing:            pricing,
 		cm:                 pretty.NewChangeMonitor(),
+		stores:             stores,
 	}
+	p.regionName.Store(&region)
 	ctx = logging.WithLogger(ctx, logging.FromContext(ctx).Named("pricing"))
+	p.load(ctx)
 
 	go func() {
 		// perform an initial price update at startup
@@ -91,6 +130,7 @@ func NewProvider(ctx context.Context, pricing client.PricingAPI, region string,
 		if time.Since(startup) > pricingUpdatePeriod {
 			p.updatePricing(ctx)
 		}
+		p.save(ctx)
 
 		for {
 			select {
@@ -98,17 +138,108 @@ func NewProvider(ctx context.Context, pricing client.PricingAPI, region string,
 				return
 			case <-time.After(pricingUpdatePeriod):
 				p.updatePricing(ctx)
+				p.save(ctx)
 			}
 		}
 	}()
 	return p
 }
 
-// InstanceTypes returns the list of all instance types for which either a price is known.
+// priceSourceFromContext returns the price source configured in the settings, or the default price source if the
+// settings are not injected, e.g. when generating the static prices
+func priceSourceFromContext(ctx context.Context) PriceSource {
+	if s, ok := ctx.Value(settings.ContextKey).(*settings.Settings); ok {
+		return PriceSource{Currency: s.PriceCurrency, PriceType: s.PriceType}
+	}
+	return DefaultPriceSource
+}
+
+// staticPricing returns the generated static prices of the price source for the region. Only some price sources have
+// static prices, the others fall back to the default price source which still provides a relative ordering.
+func staticPricing(prices map[PriceSource]map[string]map[string]float64, source PriceSource, region string) map[string]float64 {
+	sourcePricing, ok := prices[source]
+	if !ok {
+		sourcePricing = prices[DefaultPriceSource]
+	}
+	// see if we've got region specific pricing data
+	staticPricing, ok := sourcePricing[region]
+	if !ok {
+		// and if not, fall back to the always available eastus
+		staticPricing = sourcePricing["eastus"]
+	}
+	return staticPricing
+}
+
+// load replaces the prices with the stored prices of the region and price source if the stored prices are newer
+func (p *Provider) load(ctx context.Context) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, store := range p.stores {
+		snapshot, err := store.Load(ctx)
+		if err != nil {
+			logging.FromContext(ctx).Errorf("loading stored pricing for region %s, %s", p.region(), err)
+			continue
+		}
+		if snapshot == nil {
+			continue
+		}
+		if snapshot.Region != p.region() || (PriceSource{Currency: snapshot.Currency, PriceType: snapshot.PriceType}) != p.source {
+			logging.FromContext(ctx).Debugf("ignoring stored %s pricing in %s for region %s", snapshot.PriceType, snapshot.Currency, snapshot.Region)
+			continue
+		}
+		if len(snapshot.OnDemandPrices) > 0 && snapshot.OnDemandUpdateTime.After(p.onDemandUpdateTime) {
+			p.onDemandPrices = snapshot.OnDemandPrices
+			p.onDemandUpdateTime = snapshot.OnDemandUpdateTime
+			logging.FromContext(ctx).With("instance-type-count", len(p.onDemandPrices)).Infof("loaded on-demand pricing from %s", p.onDemandUpdateTime.Format(time.RFC3339))
+		}
+		if len(snapshot.SpotPrices) > 0 && snapshot.SpotUpdateTime.After(p.spotUpdateTime) {
+			p.spotPrices = snapshot.SpotPrices
+			p.spotUpdateTime = snapshot.SpotUpdateTime
+			logging.FromContext(ctx).With("instance-type-count", len(p.spotPrices)).Infof("loaded spot pricing from %s", p.spotUpdateTime.Format(time.RFC3339))
+		}
+	}
+	p.savedUpdateTime = latest(p.onDemandUpdateTime, p.spotUpdateTime)
+}
+
+// save writes the prices to the stores if they have been updated since they were loaded or last saved
+func (p *Provider) save(ctx context.Context) {
+	p.mu.RLock()
+	snapshot := &Snapshot{
+		Region:             p.region(),
+		Currency:           p.source.Currency,
+		PriceType:          p.source.PriceType,
+		OnDemandUpdateTime: p.onDemandUpdateTime,
+		OnDemandPrices:     lo.Assign(p.onDemandPrices),
+		SpotUpdateTime:     p.spotUpdateTime,
+		SpotPrices:         lo.Assign(p.spotPrices),
+	}
+	p.mu.RUnlock()
+
+	updateTime := latest(snapshot.OnDemandUpdateTime, snapshot.SpotUpdateTime)
+	if !updateTime.After(p.savedUpdateTime) {
+		return
+	}
+	for _, store := range p.stores {
+		if err := store.Save(ctx, snapshot); err != nil {
+			logging.FromContext(ctx).Errorf("saving pricing for region %s, %s", p.region(), err)
+			return
+		}
+	}
+	p.savedUpdateTime = updateTime
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// InstanceTypes returns the list of all instance types for which either an on-demand or a spot price is known.
 func (p *Provider) InstanceTypes() []string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return lo.Keys(p.onDemandPrices)
+	return lo.Union(lo.Keys(p.onDemandPrices), lo.Keys(p.spotPrices))
 }
 
 // OnDemandLastUpdated returns the time that the on-demand pricing was last updated
@@ -130,13 +261,40 @@ func (p *Provider) OnDemandPrice(instanceType string) (float64, bool) {
 	return price, true
 }
 
+// SpotLastUpdated returns the time that the spot pricing was last updated
+func (p *Provider) SpotLastUpdated() time.Time {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.spotUpdateTime
+}
+
+// SpotPrice returns the last known spot price for a given instance type in a zone, returning false if there is no
+// known spot pricing for the instance type. Azure prices spot capacity per region, so all the zones of the region
+// share the same price.
+func (p *Provider) SpotPrice(instanceType string, _ string) (float64, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	price, ok := p.spotPrices[instanceType]
+	if !ok {
+		return 0.0, false
+	}
+	return price, true
+}
+
 func (p *Provider) updatePricing(ctx context.Context) {
 	var wg sync.WaitGroup
-	wg.Add(1)
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		if err := p.UpdateOnDemandPricing(ctx); err != nil {
-			logging.FromContext(ctx).Errorf("error updating on-demand pricing for region %s, %s, using existing pricing data from %s", p.region, err, err.lastUpdateTime.Format(time.RFC3339))
+			logging.FromContext(ctx).Errorf("error updating on-demand pricing for region %s, %s, using existing pricing data from %s", p.region(), err, err.lastUpdateTime.Format(time.RFC3339))
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		if err := p.UpdateSpotPricing(ctx); err != nil {
+			logging.FromContext(ctx).Errorf("error updating spot pricing for region %s, %s, using existing pricing data from %s", p.region(), err, err.lastUpdateTime.Format(time.RFC3339))
 		}
 	}()
 
@@ -171,23 +329,64 @@ func (p *Provider) UpdateOnDemandPricing(ctx context.Context) *Err {
 	p.onDemandPrices = lo.Assign(onDemandPrices)
 	p.onDemandUpdateTime = time.Now()
 	if p.cm.HasChanged("on-demand-prices", p.onDemandPrices) {
-		logging.FromContext(ctx).With("instance-type-count", len(p.onDemandPrices)).Infof("updated on-demand pricing for region %s", p.region)
+		logging.FromContext(ctx).With("instance-type-count", len(p.onDemandPrices)).Infof("updated on-demand %s pricing in %s for region %s", p.source.PriceType, p.source.Currency, p.region())
+	}
+	return nil
+}
+
+func (p *Provider) UpdateSpotPricing(ctx context.Context) *Err {
+	spotPrices, err := p.fetchSpotPricing(ctx)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		return &Err{error: err, lastUpdateTime: p.spotUpdateTime}
+	}
+
+	if len(spotPrices) == 0 {
+		return &Err{error: errors.New("no spot pricing found"), lastUpdateTime: p.spotUpdateTime}
+	}
+
+	p.spotPrices = lo.Assign(spotPrices)
+	p.spotUpdateTime = time.Now()
+	if p.cm.HasChanged("spot-prices", p.spotPrices) {
+		logging.FromContext(ctx).With("instance-type-count", len(p.spotPrices)).Infof("updated spot pricing in %s for region %s", p.source.Currency, p.region())
 	}
 	return nil
 }
 
 func (p *Provider) fetchOnDemandPricing(ctx context.Context) (map[string]float64, error) {
+	consumptionPrices := map[string]float64{}
+	discountedPrices := map[string]float64{}
+	// reservations are separate price items, the consumption items are needed as well for the instance types
+	// without a reservation
+	priceType := PriceTypeConsumption
+	if p.source.PriceType == PriceTypeReservation {
+		priceType = ""
+	}
+	if err := p.pricing.GetProductsPricePages(ctx, p.filters(priceType), p.onDemandPage(consumptionPrices, discountedPrices)); err != nil {
+		return nil, err
+	}
+	// instance types without a reservation or savings plan price are ranked by their consumption price
+	return lo.Assign(consumptionPrices, discountedPrices), nil
+}
+
+func (p *Provider) fetchSpotPricing(ctx context.Context) (map[string]float64, error) {
 	prices := map[string]float64{}
+	if err := p.pricing.GetProductsPricePages(ctx, p.filters(PriceTypeConsumption), p.spotPage(prices)); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+// filters selects the linux virtual machine prices of the region in the configured currency, an empty price type
+// selects all the price types
+func (p *Provider) filters(priceType string) []*client.Filter {
 	filters := []*client.Filter{
-		{
-			Field:    "priceType",
-			Operator: client.Equals,
-			Value:    "Consumption",
-		},
 		{
 			Field:    "currencyCode",
 			Operator: client.Equals,
-			Value:    "USD",
+			Value:    p.source.Currency,
 		},
 		{
 			Field:    "serviceFamily",
@@ -202,15 +401,19 @@ func (p *Provider) fetchOnDemandPricing(ctx context.Context) (map[string]float64
 		{
 			Field:    "armRegionName",
 			Operator: client.Equals,
-			Value:    p.region,
+			Value:    p.region(),
 		}}
-	if err := p.pricing.GetProductsPricePages(ctx, filters, p.onDemandPage(prices)); err != nil {
-		return nil, err
+	if priceType != "" {
+		filters = append([]*client.Filter{{
+			Field:    "priceType",
+			Operator: client.Equals,
+			Value:    priceType,
+		}}, filters...)
 	}
-	return prices, nil
+	return filters
 }
 
-func (p *Provider) onDemandPage(prices map[string]float64) func(page *client.ProductsPricePage) {
+func (p *Provider) onDemandPage(consumptionPrices, discountedPrices map[string]float64) func(page *client.ProductsPricePage) {
 	return func(page *client.ProductsPricePage) {
 		for _, pItem := range page.Items {
 			if strings.HasSuffix(pItem.ProductName, " Windows") {
@@ -223,6 +426,35 @@ func (p *Provider) onDemandPage(prices map[string]float64) func(page *client.Pro
 			if strings.HasSuffix(pItem.SkuName, " Spot") {
 				continue
 			}
+			switch pItem.Type {
+			case PriceTypeConsumption:
+				consumptionPrices[pItem.ArmSkuName] = pItem.RetailPrice
+				if p.source.PriceType != PriceTypeSavingsPlan {
+					continue
+				}
+				for _, plan := range pItem.SavingsPlan {
+					if plan.Term == oneYearTerm {
+						discountedPrices[pItem.ArmSkuName] = plan.RetailPrice
+					}
+				}
+			case PriceTypeReservation:
+				if p.source.PriceType == PriceTypeReservation && pItem.ReservationTerm == oneYearTerm {
+					discountedPrices[pItem.ArmSkuName] = pItem.RetailPrice / hoursPerYear
+				}
+			}
+		}
+	}
+}
+
+func (p *Provider) spotPage(prices map[string]float64) func(page *client.ProductsPricePage) {
+	return func(page *client.ProductsPricePage) {
+		for _, pItem := range page.Items {
+			if strings.HasSuffix(pItem.ProductName, " Windows") {
+				continue
+			}
+			if !strings.HasSuffix(pItem.SkuName, " Spot") {
+				continue
+			}
 			prices[pItem.ArmSkuName] = pItem.RetailPrice
 		}
 	}
@@ -236,16 +468,23 @@ func (p *Provider) LivenessProbe(_ *http.Request) error {
 	return nil
 }
 
-func (p *Provider) Reset() {
-	// see if we've got region specific pricing data
-	staticPricing, ok := initialOnDemandPrices[p.region]
-	if !ok {
-		// and if not, fall back to the always available eastus
-		staticPricing = initialOnDemandPrices["eastus"]
-	}
+func (p *Provider) region() string {
+	return *p.regionName.Load()
+}
 
+// SetRegion changes the region of the prices, it is called once a cloud config that was invalid at startup has been
+// fixed. The prices start over from the static prices of the region and are updated right away.
+func (p *Provider) SetRegion(ctx context.Context, region string) {
+	p.regionName.Store(&region)
+	p.Reset()
+	go p.updatePricing(logging.WithLogger(ctx, logging.FromContext(ctx).Named("pricing")))
+}
+
+func (p *Provider) Reset() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.onDemandPrices = staticPricing
+	p.onDemandPrices = staticPricing(initialOnDemandPrices, p.source, p.region())
 	p.onDemandUpdateTime = initialPriceUpdate
+	p.spotPrices = staticPricing(initialSpotPrices, p.source, p.region())
+	p.spotUpdateTime = initialPriceUpdate
 }
@@ -0,0 +1,143 @@
+/*
+       Copyright (c) Microsoft Corporation.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pricing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SnapshotKey is the ConfigMap data key, and the file format, of a persisted price table
+const SnapshotKey = "prices.json"
+
+// Snapshot is the price table of a region and price source at the time it was last fetched
+type Snapshot struct {
+	Region             string             `json:"region"`
+	Currency           string             `json:"currency"`
+	PriceType          string             `json:"priceType"`
+	OnDemandUpdateTime time.Time          `json:"onDemandUpdateTime"`
+	OnDemandPrices     map[string]float64 `json:"onDemandPrices"`
+	SpotUpdateTime     time.Time          `json:"spotUpdateTime,omitempty"`
+	SpotPrices         map[string]float64 `json:"spotPrices,omitempty"`
+}
+
+// Store persists the last known prices so a restarted provider does not fall back to the static prices. Load returns
+// a nil snapshot if nothing has been stored yet.
+type Store interface {
+	Load(ctx context.Context) (*Snapshot, error)
+	Save(ctx context.Context, snapshot *Snapshot) error
+}
+
+// ConfigMapStore stores the price table in a ConfigMap. The ConfigMap can also be created by an operator to seed the
+// prices of clusters that cannot reach the retail prices API.
+type ConfigMapStore struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+}
+
+func NewConfigMapStore(kubeClient kubernetes.Interface, namespace, name string) *ConfigMapStore {
+	return &ConfigMapStore{
+		kubeClient: kubeClient,
+		namespace:  namespace,
+		name:       name,
+	}
+}
+
+func (s *ConfigMapStore) Load(ctx context.Context) (*Snapshot, error) {
+	cm, err := s.kubeClient.CoreV1().ConfigMaps(s.namespace).Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting configmap %s/%s, %w", s.namespace, s.name, err)
+	}
+	data, ok := cm.Data[SnapshotKey]
+	if !ok {
+		return nil, nil
+	}
+	return decodeSnapshot([]byte(data))
+}
+
+func (s *ConfigMapStore) Save(ctx context.Context, snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("marshaling prices, %w", err)
+	}
+	configMaps := s.kubeClient.CoreV1().ConfigMaps(s.namespace)
+	cm, err := configMaps.Get(ctx, s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: s.name, Namespace: s.namespace},
+			Data:       map[string]string{SnapshotKey: string(data)},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating configmap %s/%s, %w", s.namespace, s.name, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting configmap %s/%s, %w", s.namespace, s.name, err)
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[SnapshotKey] = string(data)
+	if _, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating configmap %s/%s, %w", s.namespace, s.name, err)
+	}
+	return nil
+}
+
+// FileStore reads a price table provided by an operator, e.g. from a mounted volume. The file is never written.
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Load(_ context.Context) (*Snapshot, error) {
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s, %w", s.path, err)
+	}
+	return decodeSnapshot(data)
+}
+
+func (s *FileStore) Save(_ context.Context, _ *Snapshot) error {
+	return nil
+}
+
+func decodeSnapshot(data []byte) (*Snapshot, error) {
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		return nil, fmt.Errorf("unmarshaling prices, %w", err)
+	}
+	return snapshot, nil
+}
@@ -17,17 +17,23 @@ package pricing_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	kubefake "k8s.io/client-go/kubernetes/fake"
 	. "knative.dev/pkg/logging/testing"
 
+	"github.com/azure/gpu-provisioner/pkg/apis/settings"
 	"github.com/azure/gpu-provisioner/pkg/fake"
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing"
 	"github.com/azure/gpu-provisioner/pkg/providers/pricing/client"
+	"github.com/samber/lo"
 )
 
 var ctx context.Context
@@ -88,4 +94,172 @@ var _ = Describe("Pricing", func() {
 		Expect(ok).To(BeTrue())
 		Expect(price).To(BeNumerically("==", 1.23))
 	})
+	It("should update spot pricing with response from the pricing API", func() {
+		fakePricingAPI.ProductsPricePage.Set(&client.ProductsPricePage{
+			Items: []client.Item{
+				fake.NewProductPrice("Standard_D1", 1.20),
+				fake.NewSpotProductPrice("Standard_D1", 0.24),
+				fake.NewSpotProductPrice("Standard_D14", 0.25),
+			},
+		})
+		updateStart := time.Now()
+		p := pricing.NewProvider(ctx, fakePricingAPI, "", make(chan struct{}))
+		Eventually(func() bool { return p.SpotLastUpdated().After(updateStart) }).Should(BeTrue())
+		Eventually(func() bool { return p.OnDemandLastUpdated().After(updateStart) }).Should(BeTrue())
+
+		price, ok := p.SpotPrice("Standard_D1", "")
+		Expect(ok).To(BeTrue())
+		Expect(price).To(BeNumerically("==", 0.24))
+
+		price, ok = p.SpotPrice("Standard_D14", "eastus-1")
+		Expect(ok).To(BeTrue())
+		Expect(price).To(BeNumerically("==", 0.25))
+
+		// spot prices are not mixed into the on-demand prices
+		price, ok = p.OnDemandPrice("Standard_D1")
+		Expect(ok).To(BeTrue())
+		Expect(price).To(BeNumerically("==", 1.20))
+		_, ok = p.OnDemandPrice("Standard_D14")
+		Expect(ok).To(BeFalse())
+	})
+	Context("Price Source", func() {
+		It("should filter the prices by the configured currency", func() {
+			fakePricingAPI.ProductsPricePage.Set(&client.ProductsPricePage{
+				Items: []client.Item{fake.NewProductPrice("Standard_D1", 1.10)},
+			})
+			sourceCtx := settings.ToContext(ctx, &settings.Settings{PriceCurrency: "EUR", PriceType: pricing.PriceTypeConsumption})
+			updateStart := time.Now()
+			p := pricing.NewProvider(sourceCtx, fakePricingAPI, "westeurope", make(chan struct{}))
+			Eventually(func() bool { return p.OnDemandLastUpdated().After(updateStart) }).Should(BeTrue())
+
+			var filters []*client.Filter
+			for fakePricingAPI.FiltersInput.Len() > 0 {
+				filters = append(filters, *fakePricingAPI.FiltersInput.Pop()...)
+			}
+			Expect(filters).To(ContainElement(&client.Filter{Field: "currencyCode", Operator: client.Equals, Value: "EUR"}))
+			Expect(filters).To(ContainElement(&client.Filter{Field: "armRegionName", Operator: client.Equals, Value: "westeurope"}))
+			Expect(filters).To(ContainElement(&client.Filter{Field: "priceType", Operator: client.Equals, Value: pricing.PriceTypeConsumption}))
+		})
+		It("should convert 1 year reservations to hourly prices", func() {
+			fakePricingAPI.ProductsPricePage.Set(&client.ProductsPricePage{
+				Items: []client.Item{
+					fake.NewProductPrice("Standard_D1", 1.20),
+					fake.NewReservationProductPrice("Standard_D1", "1 Year", 8760),
+					fake.NewReservationProductPrice("Standard_D1", "3 Years", 17520),
+					fake.NewProductPrice("Standard_D14", 1.23),
+				},
+			})
+			sourceCtx := settings.ToContext(ctx, &settings.Settings{PriceCurrency: "USD", PriceType: pricing.PriceTypeReservation})
+			updateStart := time.Now()
+			p := pricing.NewProvider(sourceCtx, fakePricingAPI, "", make(chan struct{}))
+			Eventually(func() bool { return p.OnDemandLastUpdated().After(updateStart) }).Should(BeTrue())
+
+			price, ok := p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 1))
+			// instance types without a reservation keep their consumption price
+			price, ok = p.OnDemandPrice("Standard_D14")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 1.23))
+		})
+		It("should prefer 1 year savings plan prices over consumption prices", func() {
+			fakePricingAPI.ProductsPricePage.Set(&client.ProductsPricePage{
+				Items: []client.Item{
+					fake.NewSavingsPlanProductPrice("Standard_D1", 1.20, 0.80),
+					fake.NewProductPrice("Standard_D14", 1.23),
+				},
+			})
+			sourceCtx := settings.ToContext(ctx, &settings.Settings{PriceCurrency: "USD", PriceType: pricing.PriceTypeSavingsPlan})
+			updateStart := time.Now()
+			p := pricing.NewProvider(sourceCtx, fakePricingAPI, "", make(chan struct{}))
+			Eventually(func() bool { return p.OnDemandLastUpdated().After(updateStart) }).Should(BeTrue())
+
+			price, ok := p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 0.80))
+			price, ok = p.OnDemandPrice("Standard_D14")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 1.23))
+		})
+		It("should fall back to the default static prices for price sources without static prices", func() {
+			fakePricingAPI.NextError.Set(fmt.Errorf("failed"))
+			sourceCtx := settings.ToContext(ctx, &settings.Settings{PriceCurrency: "EUR", PriceType: pricing.PriceTypeReservation})
+			p := pricing.NewProvider(sourceCtx, fakePricingAPI, "", make(chan struct{}))
+			price, ok := p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically(">", 0))
+		})
+	})
+	Context("Stores", func() {
+		var store *pricing.ConfigMapStore
+		var snapshot *pricing.Snapshot
+		BeforeEach(func() {
+			store = pricing.NewConfigMapStore(kubefake.NewSimpleClientset(), "gpu-provisioner", "gpu-provisioner-pricing")
+			snapshot = &pricing.Snapshot{
+				Region:             "westus2",
+				Currency:           pricing.DefaultPriceSource.Currency,
+				PriceType:          pricing.DefaultPriceSource.PriceType,
+				OnDemandUpdateTime: time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+				OnDemandPrices:     map[string]float64{"Standard_D1": 0.42},
+				SpotUpdateTime:     time.Now().Add(-time.Hour).UTC().Truncate(time.Second),
+				SpotPrices:         map[string]float64{"Standard_D1": 0.04},
+			}
+		})
+		It("should load the stored prices before the first update", func() {
+			Expect(store.Save(ctx, snapshot)).To(Succeed())
+			fakePricingAPI.NextError.Set(fmt.Errorf("failed"))
+			p := pricing.NewProvider(ctx, fakePricingAPI, "westus2", make(chan struct{}), store)
+
+			Expect(p.OnDemandLastUpdated()).To(Equal(snapshot.OnDemandUpdateTime))
+			price, ok := p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 0.42))
+			price, ok = p.SpotPrice("Standard_D1", "")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 0.04))
+		})
+		It("should ignore the stored prices of another region or price source", func() {
+			Expect(store.Save(ctx, snapshot)).To(Succeed())
+			fakePricingAPI.NextError.Set(fmt.Errorf("failed"))
+			p := pricing.NewProvider(ctx, fakePricingAPI, "eastus", make(chan struct{}), store)
+			price, ok := p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeTrue())
+			Expect(price).ToNot(BeNumerically("==", 0.42))
+
+			sourceCtx := settings.ToContext(ctx, &settings.Settings{PriceCurrency: "EUR", PriceType: pricing.PriceTypeConsumption})
+			p = pricing.NewProvider(sourceCtx, fakePricingAPI, "westus2", make(chan struct{}), store)
+			Expect(p.OnDemandLastUpdated()).ToNot(Equal(snapshot.OnDemandUpdateTime))
+			_, ok = p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeFalse())
+		})
+		It("should seed the prices from an operator provided file", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "prices.json")
+			Expect(os.WriteFile(path, lo.Must(json.Marshal(snapshot)), 0600)).To(Succeed())
+			fakePricingAPI.NextError.Set(fmt.Errorf("failed"))
+			p := pricing.NewProvider(ctx, fakePricingAPI, "westus2", make(chan struct{}), pricing.NewFileStore(path), store)
+			price, ok := p.OnDemandPrice("Standard_D1")
+			Expect(ok).To(BeTrue())
+			Expect(price).To(BeNumerically("==", 0.42))
+		})
+		It("should save the updated prices once elected", func() {
+			fakePricingAPI.ProductsPricePage.Set(&client.ProductsPricePage{
+				Items: []client.Item{
+					fake.NewProductPrice("Standard_D1", 1.20),
+					fake.NewSpotProductPrice("Standard_D1", 0.24),
+				},
+			})
+			elected := make(chan struct{})
+			updateStart := time.Now()
+			p := pricing.NewProvider(ctx, fakePricingAPI, "westus2", elected, store)
+			Eventually(func() bool { return p.OnDemandLastUpdated().After(updateStart) }).Should(BeTrue())
+			Consistently(func() (*pricing.Snapshot, error) { return store.Load(ctx) }, "100ms").Should(BeNil())
+
+			close(elected)
+			Eventually(func() (*pricing.Snapshot, error) { return store.Load(ctx) }).ShouldNot(BeNil())
+			stored := lo.Must(store.Load(ctx))
+			Expect(stored.Region).To(Equal("westus2"))
+			Expect(stored.OnDemandPrices).To(HaveKeyWithValue("Standard_D1", 1.20))
+			Expect(stored.SpotPrices).To(HaveKeyWithValue("Standard_D1", 0.24))
+		})
+	})
 })
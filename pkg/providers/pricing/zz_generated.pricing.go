@@ -22,11 +22,18 @@ import "time"
 // generated at 2023-09-28T21:13:32Z
 
 var initialPriceUpdate, _ = time.Parse(time.RFC3339, "2023-09-28T21:13:32Z")
-var initialOnDemandPrices = map[string]map[string]float64{}
+var initialOnDemandPrices = map[PriceSource]map[string]map[string]float64{}
+var initialSpotPrices = map[PriceSource]map[string]map[string]float64{}
 
 func init() {
+	// USD Consumption
+	onDemandPrices := map[string]map[string]float64{}
+	spotPrices := map[string]map[string]float64{}
+	initialOnDemandPrices[PriceSource{Currency: "USD", PriceType: "Consumption"}] = onDemandPrices
+	initialSpotPrices[PriceSource{Currency: "USD", PriceType: "Consumption"}] = spotPrices
+
 	// australiacentral
-	initialOnDemandPrices["australiacentral"] = map[string]float64{
+	onDemandPrices["australiacentral"] = map[string]float64{
 		"Basic_A0":               0.024000,
 		"Basic_A1":               0.032000,
 		"Basic_A2":               0.098000,
@@ -574,7 +581,7 @@ func init() {
 		"Standard_NC8as_T4_v3":   0.977000,
 	}
 	// australiacentral2
-	initialOnDemandPrices["australiacentral2"] = map[string]float64{
+	onDemandPrices["australiacentral2"] = map[string]float64{
 		"Basic_A0":               0.024000,
 		"Basic_A1":               0.032000,
 		"Basic_A2":               0.098000,
@@ -1113,7 +1120,7 @@ func init() {
 		"Standard_NC8as_T4_v3":   0.977000,
 	}
 	// australiaeast
-	initialOnDemandPrices["australiaeast"] = map[string]float64{
+	onDemandPrices["australiaeast"] = map[string]float64{
 		"DCdsv3 Type1":            7.498000,
 		"Dasv4_Type2":             6.600000,
 		"Ddsv5_Type1":             7.498000,
@@ -1288,7 +1295,7 @@ func init() {
 		"Standard_NV6ads_A10_v5":  0.658000,
 	}
 	// australiasoutheast
-	initialOnDemandPrices["australiasoutheast"] = map[string]float64{
+	onDemandPrices["australiasoutheast"] = map[string]float64{
 		"Basic_A4":               0.464000,
 		"Dadsv5_Type1":           8.248000,
 		"Dasv4_Type2":            6.589000,
@@ -1638,7 +1645,7 @@ func init() {
 		"Standard_M8-4ms":        2.227900,
 	}
 	// brazilsouth
-	initialOnDemandPrices["brazilsouth"] = map[string]float64{
+	onDemandPrices["brazilsouth"] = map[string]float64{
 		"Basic_A0":                  0.022000,
 		"Basic_A1":                  0.041000,
 		"Basic_A2":                  0.112000,
@@ -2277,7 +2284,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":   13.040000,
 	}
 	// brazilsoutheast
-	initialOnDemandPrices["brazilsoutheast"] = map[string]float64{
+	onDemandPrices["brazilsoutheast"] = map[string]float64{
 		"Basic_A2":               0.146000,
 		"Ddsv5_Type1":            12.355000,
 		"Ebdsv5-Type1":           12.195000,
@@ -2464,7 +2471,7 @@ func init() {
 		"Standard_PB12s":         1.660000,
 	}
 	// canadacentral
-	initialOnDemandPrices["canadacentral"] = map[string]float64{
+	onDemandPrices["canadacentral"] = map[string]float64{
 		"Basic_A0":                  0.020000,
 		"Basic_A1":                  0.026000,
 		"Basic_A2":                  0.087000,
@@ -3192,7 +3199,7 @@ func init() {
 		"Standard_NV8as_v4":         0.559000,
 	}
 	// canadaeast
-	initialOnDemandPrices["canadaeast"] = map[string]float64{
+	onDemandPrices["canadaeast"] = map[string]float64{
 		"Basic_A0":                  0.020000,
 		"Basic_A1":                  0.026000,
 		"Basic_A2":                  0.087000,
@@ -3811,7 +3818,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 39.324000,
 	}
 	// centralindia
-	initialOnDemandPrices["centralindia"] = map[string]float64{
+	onDemandPrices["centralindia"] = map[string]float64{
 		"Basic_A0":                 0.018000,
 		"Basic_A1":                 0.030000,
 		"Basic_A2":                 0.096000,
@@ -4559,7 +4566,7 @@ func init() {
 		"Standard_NV8as_v4":        0.652000,
 	}
 	// centralus
-	initialOnDemandPrices["centralus"] = map[string]float64{
+	onDemandPrices["centralus"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.025000,
 		"Basic_A2":                  0.085000,
@@ -5321,7 +5328,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":   8.020000,
 	}
 	// eastasia
-	initialOnDemandPrices["eastasia"] = map[string]float64{
+	onDemandPrices["eastasia"] = map[string]float64{
 		"Basic_A0":                 0.018000,
 		"Basic_A1":                 0.038000,
 		"Basic_A2":                 0.104000,
@@ -6020,7 +6027,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":  10.106000,
 	}
 	// eastus
-	initialOnDemandPrices["eastus"] = map[string]float64{
+	onDemandPrices["eastus"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.023000,
 		"Basic_A2":                  0.079000,
@@ -6863,7 +6870,7 @@ func init() {
 		"Standard_PB6s":             0.830000,
 	}
 	// eastus2
-	initialOnDemandPrices["eastus2"] = map[string]float64{
+	onDemandPrices["eastus2"] = map[string]float64{
 		"Dasv4_Type2":              5.069000,
 		"Ddsv4_Type2":              4.723000,
 		"Dsv5_Type1":               5.280000,
@@ -7049,7 +7056,7 @@ func init() {
 		"Standard_NV4as_v4":        0.233000,
 	}
 	// francecentral
-	initialOnDemandPrices["francecentral"] = map[string]float64{
+	onDemandPrices["francecentral"] = map[string]float64{
 		"Basic_A2":                  0.101000,
 		"Basic_A4":                  0.449000,
 		"Dadsv5_Type1":              7.454000,
@@ -7397,7 +7404,7 @@ func init() {
 		"Standard_NV48s_v3":         5.700000,
 	}
 	// francesouth
-	initialOnDemandPrices["francesouth"] = map[string]float64{
+	onDemandPrices["francesouth"] = map[string]float64{
 		"Basic_A0":              0.026000,
 		"Basic_A1":              0.033800,
 		"Basic_A2":              0.131300,
@@ -7901,7 +7908,7 @@ func init() {
 		"Standard_L8s_v3":       1.050000,
 	}
 	// germanynorth
-	initialOnDemandPrices["germanynorth"] = map[string]float64{
+	onDemandPrices["germanynorth"] = map[string]float64{
 		"Dasv4_Type1":               8.222000,
 		"Dasv4_Type2":               8.222000,
 		"Dasv5_Type1":               8.328000,
@@ -8250,7 +8257,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 55.381000,
 	}
 	// germanywestcentral
-	initialOnDemandPrices["germanywestcentral"] = map[string]float64{
+	onDemandPrices["germanywestcentral"] = map[string]float64{
 		"Dadsv5_Type1":             7.700000,
 		"Dasv4_Type1":              6.325000,
 		"Dasv4_Type2":              6.325000,
@@ -8852,7 +8859,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":  8.476000,
 	}
 	// japaneast
-	initialOnDemandPrices["japaneast"] = map[string]float64{
+	onDemandPrices["japaneast"] = map[string]float64{
 		"Basic_A0":                  0.022000,
 		"Basic_A1":                  0.032000,
 		"Basic_A2":                  0.109000,
@@ -9643,7 +9650,7 @@ func init() {
 		"Standard_NV8as_v4":         0.676000,
 	}
 	// japanwest
-	initialOnDemandPrices["japanwest"] = map[string]float64{
+	onDemandPrices["japanwest"] = map[string]float64{
 		"Basic_A0":                  0.017100,
 		"Basic_A1":                  0.032000,
 		"Basic_A2":                  0.099000,
@@ -10259,7 +10266,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 50.794000,
 	}
 	// jioindiacentral
-	initialOnDemandPrices["jioindiacentral"] = map[string]float64{
+	onDemandPrices["jioindiacentral"] = map[string]float64{
 		"Dadsv5_Type1":          4.133000,
 		"Dasv4_Type1":           5.333000,
 		"Dasv4_Type2":           5.333000,
@@ -10550,7 +10557,7 @@ func init() {
 		"Standard_L8s_v3":       0.792000,
 	}
 	// jioindiawest
-	initialOnDemandPrices["jioindiawest"] = map[string]float64{
+	onDemandPrices["jioindiawest"] = map[string]float64{
 		"Dadsv5_Type1":             4.133000,
 		"Dasv4_Type1":              5.333000,
 		"Dasv4_Type2":              5.333000,
@@ -10882,7 +10889,7 @@ func init() {
 		"Standard_NC96ads_A100_v4": 20.569000,
 	}
 	// koreacentral
-	initialOnDemandPrices["koreacentral"] = map[string]float64{
+	onDemandPrices["koreacentral"] = map[string]float64{
 		"Basic_A4":                0.449000,
 		"Dasv5_Type1":             6.530000,
 		"Easv5_Type1":             7.181000,
@@ -11070,7 +11077,7 @@ func init() {
 		"Standard_NV8as_v4":       0.629000,
 	}
 	// koreasouth
-	initialOnDemandPrices["koreasouth"] = map[string]float64{
+	onDemandPrices["koreasouth"] = map[string]float64{
 		"Basic_A4":                0.404000,
 		"Dasv4_Type2":             5.847000,
 		"Dasv5_Type1":             6.092000,
@@ -11271,7 +11278,7 @@ func init() {
 		"Standard_NV36ads_A10_v5": 4.000000,
 	}
 	// northcentralus
-	initialOnDemandPrices["northcentralus"] = map[string]float64{
+	onDemandPrices["northcentralus"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.023000,
 		"Basic_A2":                  0.085000,
@@ -11958,7 +11965,7 @@ func init() {
 		"Standard_NV8as_v4":         0.559000,
 	}
 	// northeurope
-	initialOnDemandPrices["northeurope"] = map[string]float64{
+	onDemandPrices["northeurope"] = map[string]float64{
 		"Basic_A0":                 0.018000,
 		"Basic_A1":                 0.025000,
 		"Basic_A2":                 0.075000,
@@ -12785,7 +12792,7 @@ func init() {
 		"Standard_NV8as_v4":        0.559000,
 	}
 	// norwayeast
-	initialOnDemandPrices["norwayeast"] = map[string]float64{
+	onDemandPrices["norwayeast"] = map[string]float64{
 		"Dadsv5_Type1":              9.073000,
 		"Dasv4_Type1":               7.550000,
 		"Dasv4_Type2":               7.550000,
@@ -13320,7 +13327,7 @@ func init() {
 		"Standard_NV48s_v3":         6.270000,
 	}
 	// norwaywest
-	initialOnDemandPrices["norwaywest"] = map[string]float64{
+	onDemandPrices["norwaywest"] = map[string]float64{
 		"Dasv4_Type2":           9.816000,
 		"Ddsv4_Type 1":          6.846000,
 		"Ddsv5_Type1":           10.269000,
@@ -13681,7 +13688,7 @@ func init() {
 		"Standard_NV48s_v3":     8.151000,
 	}
 	// polandcentral
-	initialOnDemandPrices["polandcentral"] = map[string]float64{
+	onDemandPrices["polandcentral"] = map[string]float64{
 		"Basic_A0":                  0.023200,
 		"Basic_A1":                  0.029700,
 		"Basic_A2":                  0.102000,
@@ -14166,7 +14173,7 @@ func init() {
 		"Standard_SQLG7_AMD_NVME":   10.701000,
 	}
 	// qatarcentral
-	initialOnDemandPrices["qatarcentral"] = map[string]float64{
+	onDemandPrices["qatarcentral"] = map[string]float64{
 		"Basic_A0":                  0.019800,
 		"Basic_A1":                  0.029700,
 		"Basic_A2":                  0.085800,
@@ -14750,7 +14757,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":   9.324000,
 	}
 	// southafricanorth
-	initialOnDemandPrices["southafricanorth"] = map[string]float64{
+	onDemandPrices["southafricanorth"] = map[string]float64{
 		"Dadsv5_Type1":              8.470000,
 		"Dasv4_Type1":               6.985000,
 		"Dasv4_Type2":               6.985000,
@@ -15347,7 +15354,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":   9.519000,
 	}
 	// southafricawest
-	initialOnDemandPrices["southafricawest"] = map[string]float64{
+	onDemandPrices["southafricawest"] = map[string]float64{
 		"Dadsv5_Type1":              11.011000,
 		"Dasv4_Type2":               9.080000,
 		"Ddsv5_Type1":               10.296000,
@@ -15718,7 +15725,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 62.197000,
 	}
 	// southcentralus
-	initialOnDemandPrices["southcentralus"] = map[string]float64{
+	onDemandPrices["southcentralus"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.025000,
 		"Basic_A2":                  0.079000,
@@ -16489,7 +16496,7 @@ func init() {
 		"Standard_PB6s":             0.913000,
 	}
 	// southeastasia
-	initialOnDemandPrices["southeastasia"] = map[string]float64{
+	onDemandPrices["southeastasia"] = map[string]float64{
 		"Basic_A1":                 0.030000,
 		"Basic_A2":                 0.095000,
 		"DCdsv3 Type1":             7.445000,
@@ -16854,7 +16861,7 @@ func init() {
 		"Standard_NV6ads_A10_v5":   0.590000,
 	}
 	// southindia
-	initialOnDemandPrices["southindia"] = map[string]float64{
+	onDemandPrices["southindia"] = map[string]float64{
 		"Basic_A4":                0.418000,
 		"Dasv4_Type1":             7.445000,
 		"Easv4_Type1":             9.380000,
@@ -17032,7 +17039,7 @@ func init() {
 		"Standard_SQLG7_AMD_IaaS": 11.370000,
 	}
 	// swedencentral
-	initialOnDemandPrices["swedencentral"] = map[string]float64{
+	onDemandPrices["swedencentral"] = map[string]float64{
 		"Dasv4_Type1":                5.610000,
 		"Dasv5_Type1":                5.667000,
 		"Ddsv4_Type 1":               4.224000,
@@ -17577,7 +17584,7 @@ func init() {
 		"Standard_SQLG7_NVME":        7.904000,
 	}
 	// swedensouth
-	initialOnDemandPrices["swedensouth"] = map[string]float64{
+	onDemandPrices["swedensouth"] = map[string]float64{
 		"Dadsv5_Type1":            8.809000,
 		"Dasv4_Type1":             7.293000,
 		"Dasv4_Type2":             7.293000,
@@ -18048,7 +18055,7 @@ func init() {
 		"Standard_L8s_v3":         0.946000,
 	}
 	// switzerlandnorth
-	initialOnDemandPrices["switzerlandnorth"] = map[string]float64{
+	onDemandPrices["switzerlandnorth"] = map[string]float64{
 		"DCdsv3 Type1":              8.950000,
 		"DCsv3 Type1":               7.603000,
 		"Dadsv5_Type1":              9.073000,
@@ -18584,7 +18591,7 @@ func init() {
 		"Standard_NV48s_v3":         6.270000,
 	}
 	// switzerlandwest
-	initialOnDemandPrices["switzerlandwest"] = map[string]float64{
+	onDemandPrices["switzerlandwest"] = map[string]float64{
 		"Dadsv5_Type1":              11.795000,
 		"Dasv4_Type1":               9.816000,
 		"Dasv4_Type2":               9.816000,
@@ -19119,7 +19126,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 60.919000,
 	}
 	// uaecentral
-	initialOnDemandPrices["uaecentral"] = map[string]float64{
+	onDemandPrices["uaecentral"] = map[string]float64{
 		"Ddsv4_Type 1":              6.464000,
 		"Ddsv4_Type2":               7.676000,
 		"Ddsv5_Type1":               9.514000,
@@ -19574,7 +19581,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 60.919000,
 	}
 	// uaenorth
-	initialOnDemandPrices["uaenorth"] = map[string]float64{
+	onDemandPrices["uaenorth"] = map[string]float64{
 		"Dadsv5_Type1":              7.817000,
 		"Dasv4_Type1":               6.474000,
 		"Dasv4_Type2":               6.474000,
@@ -20196,7 +20203,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":   9.324000,
 	}
 	// uksouth
-	initialOnDemandPrices["uksouth"] = map[string]float64{
+	onDemandPrices["uksouth"] = map[string]float64{
 		"Basic_A0":                  0.020000,
 		"Basic_A1":                  0.026000,
 		"Basic_A2":                  0.101000,
@@ -20965,7 +20972,7 @@ func init() {
 		"Standard_NV8as_v4":         0.582000,
 	}
 	// ukwest
-	initialOnDemandPrices["ukwest"] = map[string]float64{
+	onDemandPrices["ukwest"] = map[string]float64{
 		"Basic_A0":                  0.020000,
 		"Basic_A1":                  0.026000,
 		"Basic_A2":                  0.101000,
@@ -21548,7 +21555,7 @@ func init() {
 		"Standard_ND96amsr_A100_v4": 42.929000,
 	}
 	// westcentralus
-	initialOnDemandPrices["westcentralus"] = map[string]float64{
+	onDemandPrices["westcentralus"] = map[string]float64{
 		"Basic_A0":                0.018000,
 		"Basic_A1":                0.025000,
 		"Basic_A2":                0.079000,
@@ -22116,7 +22123,7 @@ func init() {
 		"Standard_L8s_v3":         0.838000,
 	}
 	// westeurope
-	initialOnDemandPrices["westeurope"] = map[string]float64{
+	onDemandPrices["westeurope"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.027000,
 		"Basic_A2":                  0.078000,
@@ -23028,7 +23035,7 @@ func init() {
 		"Standard_PB6s":             1.079000,
 	}
 	// westindia
-	initialOnDemandPrices["westindia"] = map[string]float64{
+	onDemandPrices["westindia"] = map[string]float64{
 		"Basic_A0":               0.018000,
 		"Basic_A1":               0.030000,
 		"Basic_A2":               0.096000,
@@ -23554,7 +23561,7 @@ func init() {
 		"Standard_L8s_v3":        0.893000,
 	}
 	// westus
-	initialOnDemandPrices["westus"] = map[string]float64{
+	onDemandPrices["westus"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.031000,
 		"Basic_A2":                  0.081000,
@@ -24352,7 +24359,7 @@ func init() {
 		"Standard_NV72ads_A10_v5":   8.476000,
 	}
 	// westus2
-	initialOnDemandPrices["westus2"] = map[string]float64{
+	onDemandPrices["westus2"] = map[string]float64{
 		"Basic_A0":                  0.018000,
 		"Basic_A1":                  0.023000,
 		"Basic_A2":                  0.068000,
@@ -25103,7 +25110,7 @@ func init() {
 		"Standard_PB6s":             0.830000,
 	}
 	// westus3
-	initialOnDemandPrices["westus3"] = map[string]float64{
+	onDemandPrices["westus3"] = map[string]float64{
 		"Dadsv5_Type1":              6.345000,
 		"Dasv4_Type1":               5.280000,
 		"Dasv4_Type2":               5.280000,
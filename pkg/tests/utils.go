@@ -16,6 +16,11 @@ limitations under the License.
 package tests
 
 import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/containerservice/armcontainerservice/v4"
@@ -62,6 +67,7 @@ func GetAgentPoolObjWithName(apName string, apId string, vmSize string) armconta
 		ID:   &apId,
 		Properties: &armcontainerservice.ManagedClusterAgentPoolProfileProperties{
 			VMSize: &vmSize,
+			Count:  to.Ptr(int32(1)),
 			NodeLabels: map[string]*string{
 				"test": to.Ptr("test"),
 			},
@@ -83,6 +89,9 @@ var (
 				"kubernetes.azure.com/agentpool": "agentpool0",
 			},
 		},
+		Spec: v1.NodeSpec{
+			ProviderID: "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/nodeRG/providers/Microsoft.Compute/virtualMachineScaleSets/aks-agentpool0-20562481-vmss/virtualMachines/0",
+		},
 		Status: v1.NodeStatus{
 			Conditions: []v1.NodeCondition{
 				{
@@ -97,3 +106,19 @@ var (
 func NotFoundAzError() *azcore.ResponseError {
 	return &azcore.ResponseError{ErrorCode: "NotFound"}
 }
+
+func AzErrorWithCode(code string) *azcore.ResponseError {
+	return &azcore.ResponseError{ErrorCode: code}
+}
+
+// AzErrorWithMessage returns an ARM error whose response body carries the given message
+func AzErrorWithMessage(code, message string) *azcore.ResponseError {
+	body := fmt.Sprintf(`{"error":{"code":%q,"message":%q}}`, code, message)
+	return &azcore.ResponseError{
+		ErrorCode: code,
+		RawResponse: &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Body:       io.NopCloser(strings.NewReader(body)),
+		},
+	}
+}
@@ -109,3 +109,11 @@ func IsNvidiaEnabledSKU(vmSize string) bool {
 	vmSize = strings.TrimSuffix(vmSize, "_promo")
 	return NvidiaEnabledSKUs[vmSize]
 }
+
+// IsMarinerEnabledGPUSKU determines if an VM SKU has nvidia driver support on Mariner (Azure Linux)
+func IsMarinerEnabledGPUSKU(vmSize string) bool {
+	// Trim the optional _Promo suffix.
+	vmSize = strings.ToLower(vmSize)
+	vmSize = strings.TrimSuffix(vmSize, "_promo")
+	return MarinerNvidiaEnabledSKUs[vmSize]
+}
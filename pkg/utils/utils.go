@@ -25,7 +25,8 @@ import (
 	"github.com/aws/karpenter-core/pkg/cloudprovider"
 )
 
-// ParseAgentPoolNameFromID parses the id stored on the instance ID
+// ParseAgentPoolNameFromID parses the id stored on the instance ID. Agent pool names are alphanumeric, so the agent pool
+// name is the part of the aks-<agentpool>-<hash>-vmss scale set name between the first two "-".
 func ParseAgentPoolNameFromID(id string) (string, error) {
 	///subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachineScaleSets/<VMSSName>/virtualMachines/0
 	r := regexp.MustCompile(`azure:///subscriptions/.*/resourceGroups/.*/providers/Microsoft.Compute/virtualMachineScaleSets/(?P<VMSSName>.*)/virtualMachines/.*`)
@@ -63,6 +64,19 @@ func ParseSubIDFromID(id string) (*string, error) {
 	return nil, fmt.Errorf("error while parsing id %s", id)
 }
 
+// MakeZone returns the zone label value of an availability zone in the region, e.g. eastus-1
+func MakeZone(region, zone string) string {
+	if zone == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", strings.ToLower(region), zone)
+}
+
+// GetZoneNumber returns the availability zone ARM expects for a zone label value, e.g. 1 for eastus-1
+func GetZoneNumber(zone string) string {
+	return zone[strings.LastIndex(zone, "-")+1:]
+}
+
 func GetAllSingleValuedRequirementLabels(instanceType *cloudprovider.InstanceType) map[string]string {
 	labels := map[string]string{}
 	if instanceType == nil {